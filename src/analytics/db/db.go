@@ -29,3 +29,8 @@ func Connect() {
 func GetDB() *sql.DB {
 	return db
 }
+
+// SetDB подменяет подключение к базе данных (в тестах)
+func SetDB(conn *sql.DB) {
+	db = conn
+}
@@ -4,4 +4,26 @@ go 1.23.1
 
 require github.com/confluentinc/confluent-kafka-go v1.9.2
 
-require github.com/lib/pq v1.10.9
+require (
+	github.com/DATA-DOG/go-sqlmock v1.5.2
+	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/lib/pq v1.10.9
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/go-redis/redis/v8 v8.11.5 // indirect
+)
+
+require (
+	auth v0.0.0
+	events v0.0.0
+	health v0.0.0
+)
+
+replace (
+	auth => ../auth
+	events => ../events
+	health => ../health
+)
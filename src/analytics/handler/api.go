@@ -0,0 +1,378 @@
+package handler
+
+import (
+	"analytics/db"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"events"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Ограничения выборок API
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+	defaultRange     = 30 * 24 * time.Hour
+	maxRange         = 366 * 24 * time.Hour
+)
+
+type TimeRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+type Page struct {
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+}
+
+type ListResponse struct {
+	Range TimeRange   `json:"range"`
+	Page  *Page       `json:"page,omitempty"`
+	Items interface{} `json:"items"`
+}
+
+type ProductLikesStat struct {
+	ProductID int    `json:"product_id"`
+	Name      string `json:"name"`
+	Category  string `json:"category"`
+	Likes     int    `json:"likes"`
+	Unlikes   int    `json:"unlikes"`
+	Net       int    `json:"net"`
+}
+
+type CategoryStat struct {
+	Category   string `json:"category"`
+	Likes      int    `json:"likes"`
+	Unlikes    int    `json:"unlikes"`
+	Engagement int    `json:"engagement"`
+}
+
+type RegistrationsStat struct {
+	Day   string `json:"day"`
+	Count int    `json:"count"`
+}
+
+type ActiveUserStat struct {
+	UserID  int `json:"user_id"`
+	Actions int `json:"actions"`
+	Likes   int `json:"likes"`
+	Unlikes int `json:"unlikes"`
+}
+
+type ProductHistoryItem struct {
+	Action      string    `json:"action"`
+	UserID      int       `json:"user_id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Category    string    `json:"category"`
+	Likes       int       `json:"likes"`
+	At          time.Time `json:"at"`
+}
+
+// Лайки и анлайки по продуктам за период
+func productLikesStats(w http.ResponseWriter, r *http.Request) {
+	period, page, ok := parseListParams(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+
+	var productID interface{}
+	if v := q.Get("product_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid product_id", http.StatusBadRequest)
+			return
+		}
+		productID = id
+	}
+	var category interface{}
+	if v := q.Get("category"); v != "" {
+		category = v
+	}
+
+	rows, err := db.GetDB().Query(`SELECT product_id,
+			(array_agg(name ORDER BY occurred_at DESC))[1],
+			(array_agg(category ORDER BY occurred_at DESC))[1],
+			COUNT(*) FILTER (WHERE action = $3),
+			COUNT(*) FILTER (WHERE action = $4)
+		FROM product_actions
+		WHERE occurred_at >= $1 AND occurred_at < $2 AND action IN ($3, $4)
+			AND ($5::int IS NULL OR product_id = $5)
+			AND ($6::text IS NULL OR category = $6)
+		GROUP BY product_id
+		ORDER BY COUNT(*) FILTER (WHERE action = $3) DESC, product_id
+		LIMIT $7 OFFSET $8`,
+		period.From, period.To, events.ProductLiked, events.ProductUnliked, productID, category, page.Limit, page.Offset)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	items := []ProductLikesStat{}
+	for rows.Next() {
+		var s ProductLikesStat
+		if err := rows.Scan(&s.ProductID, &s.Name, &s.Category, &s.Likes, &s.Unlikes); err != nil {
+			writeQueryError(w, err)
+			return
+		}
+		s.Net = s.Likes - s.Unlikes
+		items = append(items, s)
+	}
+	writeList(w, period, &page, items, rows.Err())
+}
+
+// Топ категорий по вовлеченности (лайки + анлайки)
+func topCategories(w http.ResponseWriter, r *http.Request) {
+	period, page, ok := parseListParams(w, r)
+	if !ok {
+		return
+	}
+
+	rows, err := db.GetDB().Query(`SELECT category,
+			COUNT(*) FILTER (WHERE action = $3),
+			COUNT(*) FILTER (WHERE action = $4),
+			COUNT(*)
+		FROM product_actions
+		WHERE occurred_at >= $1 AND occurred_at < $2 AND action IN ($3, $4)
+		GROUP BY category
+		ORDER BY COUNT(*) DESC, category
+		LIMIT $5 OFFSET $6`,
+		period.From, period.To, events.ProductLiked, events.ProductUnliked, page.Limit, page.Offset)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	items := []CategoryStat{}
+	for rows.Next() {
+		var s CategoryStat
+		if err := rows.Scan(&s.Category, &s.Likes, &s.Unlikes, &s.Engagement); err != nil {
+			writeQueryError(w, err)
+			return
+		}
+		items = append(items, s)
+	}
+	writeList(w, period, &page, items, rows.Err())
+}
+
+// Регистрации по дням (UTC)
+func registrationsPerDay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	period, err := parseTimeRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.GetDB().Query(`SELECT to_char(date_trunc('day', registered_at AT TIME ZONE 'UTC'), 'YYYY-MM-DD'), COUNT(*)
+		FROM users
+		WHERE registered_at >= $1 AND registered_at < $2
+		GROUP BY 1
+		ORDER BY 1`,
+		period.From, period.To)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	items := []RegistrationsStat{}
+	for rows.Next() {
+		var s RegistrationsStat
+		if err := rows.Scan(&s.Day, &s.Count); err != nil {
+			writeQueryError(w, err)
+			return
+		}
+		items = append(items, s)
+	}
+	writeList(w, period, nil, items, rows.Err())
+}
+
+// Самые активные пользователи по числу действий с продуктами
+func mostActiveUsers(w http.ResponseWriter, r *http.Request) {
+	period, page, ok := parseListParams(w, r)
+	if !ok {
+		return
+	}
+
+	rows, err := db.GetDB().Query(`SELECT user_id,
+			COUNT(*),
+			COUNT(*) FILTER (WHERE action = $3),
+			COUNT(*) FILTER (WHERE action = $4)
+		FROM product_actions
+		WHERE occurred_at >= $1 AND occurred_at < $2 AND user_id IS NOT NULL AND user_id <> 0
+		GROUP BY user_id
+		ORDER BY COUNT(*) DESC, user_id
+		LIMIT $5 OFFSET $6`,
+		period.From, period.To, events.ProductLiked, events.ProductUnliked, page.Limit, page.Offset)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	items := []ActiveUserStat{}
+	for rows.Next() {
+		var s ActiveUserStat
+		if err := rows.Scan(&s.UserID, &s.Actions, &s.Likes, &s.Unlikes); err != nil {
+			writeQueryError(w, err)
+			return
+		}
+		items = append(items, s)
+	}
+	writeList(w, period, &page, items, rows.Err())
+}
+
+// История изменений продукта: создание, правки, удаление
+func productHistory(w http.ResponseWriter, r *http.Request) {
+	period, page, ok := parseListParams(w, r)
+	if !ok {
+		return
+	}
+	productID, err := strconv.Atoi(r.URL.Query().Get("product_id"))
+	if err != nil {
+		http.Error(w, "Missing or invalid product_id", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.GetDB().Query(`SELECT action, COALESCE(user_id, 0), name, description, category, likes, occurred_at
+		FROM product_actions
+		WHERE product_id = $1 AND occurred_at >= $2 AND occurred_at < $3 AND action IN ($4, $5, $6)
+		ORDER BY occurred_at DESC, id DESC
+		LIMIT $7 OFFSET $8`,
+		productID, period.From, period.To, events.ProductCreated, events.ProductUpdated, events.ProductDeleted, page.Limit, page.Offset)
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	items := []ProductHistoryItem{}
+	for rows.Next() {
+		var item ProductHistoryItem
+		if err := rows.Scan(&item.Action, &item.UserID, &item.Name, &item.Description, &item.Category, &item.Likes, &item.At); err != nil {
+			writeQueryError(w, err)
+			return
+		}
+		items = append(items, item)
+	}
+	writeList(w, period, &page, items, rows.Err())
+}
+
+func parseListParams(w http.ResponseWriter, r *http.Request) (TimeRange, Page, bool) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return TimeRange{}, Page{}, false
+	}
+	period, err := parseTimeRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return TimeRange{}, Page{}, false
+	}
+	page, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return TimeRange{}, Page{}, false
+	}
+	return period, page, true
+}
+
+// parseTimeRange читает from/to в формате RFC3339 или YYYY-MM-DD.
+// По умолчанию последние 30 дней, период не длиннее года.
+func parseTimeRange(r *http.Request) (TimeRange, error) {
+	q := r.URL.Query()
+	period := TimeRange{To: time.Now().UTC()}
+
+	if v := q.Get("to"); v != "" {
+		t, err := parseTime(v, true)
+		if err != nil {
+			return period, fmt.Errorf("invalid to: %w", err)
+		}
+		period.To = t
+	}
+	period.From = period.To.Add(-defaultRange)
+	if v := q.Get("from"); v != "" {
+		t, err := parseTime(v, false)
+		if err != nil {
+			return period, fmt.Errorf("invalid from: %w", err)
+		}
+		period.From = t
+	}
+
+	if !period.From.Before(period.To) {
+		return period, errors.New("from must be before to")
+	}
+	if period.To.Sub(period.From) > maxRange {
+		return period, errors.New("time range must not exceed 366 days")
+	}
+	return period, nil
+}
+
+// parseTime разбирает RFC3339 или YYYY-MM-DD. Граница to исключающая, поэтому
+// дата без времени в to (end) означает начало следующего дня: день входит в период.
+func parseTime(v string, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t.UTC(), nil
+	}
+	t, err := time.Parse("2006-01-02", v)
+	if err == nil && end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, err
+}
+
+func parsePage(r *http.Request) (Page, error) {
+	q := r.URL.Query()
+	page := Page{Limit: defaultPageLimit}
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return page, errors.New("invalid limit")
+		}
+		if limit > maxPageLimit {
+			limit = maxPageLimit
+		}
+		page.Limit = limit
+	}
+	if v := q.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return page, errors.New("invalid offset")
+		}
+		page.Offset = offset
+	}
+	return page, nil
+}
+
+func writeList(w http.ResponseWriter, period TimeRange, page *Page, items interface{}, err error) {
+	if err != nil {
+		writeQueryError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ListResponse{Range: period, Page: page, Items: items}); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+func writeQueryError(w http.ResponseWriter, err error) {
+	if err == sql.ErrNoRows {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("Error querying analytics: %v", err)
+	http.Error(w, "Could not query analytics", http.StatusInternalServerError)
+}
@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseTimeRange(t *testing.T) {
+	day := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+	tests := []struct {
+		name    string
+		query   string
+		from    time.Time
+		to      time.Time
+		wantErr bool
+	}{
+		{"dates include the last day", "from=2024-03-01&to=2024-03-31", day("2024-03-01"), day("2024-04-01"), false},
+		{"single day", "from=2024-03-05&to=2024-03-05", day("2024-03-05"), day("2024-03-06"), false},
+		{"rfc3339 is exact", "from=2024-03-01T00:00:00Z&to=2024-03-31T12:00:00%2B02:00",
+			day("2024-03-01"), time.Date(2024, 3, 31, 10, 0, 0, 0, time.UTC), false},
+		{"default from is 30 days before to", "to=2024-03-31", day("2024-04-01").Add(-defaultRange), day("2024-04-01"), false},
+		{"from after to", "from=2024-03-10&to=2024-03-01", time.Time{}, time.Time{}, true},
+		{"longer than a year", "from=2023-01-01&to=2024-03-01", time.Time{}, time.Time{}, true},
+		{"invalid to", "to=yesterday", time.Time{}, time.Time{}, true},
+		{"invalid from", "from=2024-13-01", time.Time{}, time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			period, err := parseTimeRange(httptest.NewRequest("GET", "/analytics/users/active?"+tt.query, nil))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTimeRange error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !period.From.Equal(tt.from) || !period.To.Equal(tt.to) {
+				t.Errorf("parseTimeRange = [%v, %v), want [%v, %v)", period.From, period.To, tt.from, tt.to)
+			}
+		})
+	}
+}
+
+func TestParseTimeRangeDefault(t *testing.T) {
+	period, err := parseTimeRange(httptest.NewRequest("GET", "/analytics/users/active", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(period.To); d < 0 || d > time.Minute {
+		t.Errorf("to = %v, want now", period.To)
+	}
+	if got := period.To.Sub(period.From); got != defaultRange {
+		t.Errorf("range = %v, want %v", got, defaultRange)
+	}
+}
+
+func TestParsePage(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    Page
+		wantErr bool
+	}{
+		{"defaults", "", Page{Limit: defaultPageLimit}, false},
+		{"explicit", "limit=5&offset=10", Page{Limit: 5, Offset: 10}, false},
+		{"limit is capped", "limit=1000", Page{Limit: maxPageLimit}, false},
+		{"zero limit", "limit=0", Page{}, true},
+		{"negative offset", "offset=-1", Page{}, true},
+		{"not a number", "limit=ten", Page{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := parsePage(httptest.NewRequest("GET", "/analytics/users/active?"+tt.query, nil))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePage error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && page != tt.want {
+				t.Errorf("parsePage = %+v, want %+v", page, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"analytics/db"
+	"database/sql"
+	"errors"
+	"events"
+	"log"
+	"os"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// Обезличивание удаленного пользователя по событию user.deleted: из журналов
+// убираются имя, email и связь действий с продуктами, в измерении users
+// остается только факт регистрации и удаления — агрегаты не меняются.
+// Ошибки БД повторяет retryIngest, поэтому users получает только подтверждение успеха.
+
+// Имя сервиса в конверте событий и в подтверждениях удаления
+const eventProducer = "analytics"
+
+const ackDeliveryTimeout = 10 * time.Second
+
+var ackProducer *kafka.Producer
+
+func initAckProducer() {
+	var err error
+	ackProducer, err = kafka.NewProducer(&kafka.ConfigMap{"bootstrap.servers": os.Getenv("KAFKA_BROKER")})
+	if err != nil {
+		log.Fatalf("Не удалось создать продюсер: %s", err)
+	}
+}
+
+// userErased сообщает, удален ли пользователь; опоздавшие события не должны вернуть его данные.
+// FOR SHARE ждет идущего стирания, и запись события в той же транзакции не проскочит мимо него.
+func userErased(tx *sql.Tx, userID int) (bool, error) {
+	var erased bool
+	err := tx.QueryRow("SELECT deleted_at IS NOT NULL FROM users WHERE user_id = $1 FOR SHARE", userID).Scan(&erased)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return erased, err
+}
+
+// processUserDeleted повторяется целиком, пока не будет доставлено подтверждение;
+// обезличивание идемпотентно
+func processUserDeleted(envelope events.Envelope, event events.UserPayload, position kafkaPosition) error {
+	if err := eraseUser(envelope, event, occurredAt(envelope, position), position); err != nil {
+		return err
+	}
+	return publishErasureAck(event)
+}
+
+func eraseUser(envelope events.Envelope, event events.UserPayload, at time.Time, position kafkaPosition) error {
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO user_actions (event_id, kafka_topic, kafka_partition, kafka_offset, user_id, action, occurred_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT DO NOTHING`,
+		nullableEventID(envelope), position.Topic, position.Partition, position.Offset, event.UserID, envelope.Type, at)
+	if err != nil {
+		return err
+	}
+	// Строка пользователя помечается первой: ее блокировка заставляет события,
+	// записываемые параллельно, дождаться стирания (см. userErased)
+	_, err = tx.Exec(`INSERT INTO users (user_id, updated_at, deleted_at)
+		VALUES ($1, $2, $2)
+		ON CONFLICT (user_id) DO UPDATE SET
+			name = NULL,
+			email = NULL,
+			updated_at = GREATEST(users.updated_at, EXCLUDED.updated_at),
+			deleted_at = COALESCE(users.deleted_at, EXCLUDED.deleted_at)`,
+		event.UserID, at)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE user_actions SET name = NULL, email = NULL WHERE user_id = $1", event.UserID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE product_actions SET user_id = NULL WHERE user_id = $1", event.UserID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("User %d anonymised", event.UserID)
+	return nil
+}
+
+// publishErasureAck сообщает users о завершении и ждет подтверждения доставки
+func publishErasureAck(event events.UserPayload) error {
+	ack := events.ErasurePayload{DeletionID: event.DeletionID, UserID: event.UserID, Service: eventProducer}
+	envelope, err := events.New(eventProducer, events.UserErasureCompleted, ack)
+	if err != nil {
+		return err
+	}
+	data, err := envelope.Encode()
+	if err != nil {
+		return err
+	}
+
+	topic := events.UserErasureCompleted.Topic()
+	deliveryChan := make(chan kafka.Event, 1)
+	err = ackProducer.Produce(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Value:          data,
+	}, deliveryChan)
+	if err != nil {
+		return err
+	}
+	select {
+	case e := <-deliveryChan:
+		if m, ok := e.(*kafka.Message); ok {
+			return m.TopicPartition.Error
+		}
+		return nil
+	case <-time.After(ackDeliveryTimeout):
+		return errors.New("delivery report timed out")
+	}
+}
@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"analytics/db"
+	"auth/access"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Данные пользователя для выгрузки по запросу users; пользователь — из токена сервиса
+type UserDataExport struct {
+	UserID        int                    `json:"user_id"`
+	Profile       *ExportedProfile       `json:"profile"`
+	UserEvents    []ExportedUserEvent    `json:"user_events"`
+	ProductEvents []ExportedProductEvent `json:"product_events"`
+}
+
+// ExportedProfile текущее состояние пользователя в аналитике
+type ExportedProfile struct {
+	Name         string     `json:"name,omitempty"`
+	Email        string     `json:"email,omitempty"`
+	RegisteredAt *time.Time `json:"registered_at,omitempty"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+type ExportedUserEvent struct {
+	Action     string    `json:"action"`
+	Name       string    `json:"name,omitempty"`
+	Email      string    `json:"email,omitempty"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+type ExportedProductEvent struct {
+	Action     string    `json:"action"`
+	ProductID  int       `json:"product_id"`
+	Name       string    `json:"name,omitempty"`
+	Category   string    `json:"category,omitempty"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+func exportUserData(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	p, _ := access.FromContext(r.Context())
+	export, err := loadUserData(p.ID)
+	if err != nil {
+		http.Error(w, "Could not export user data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(export)
+}
+
+func loadUserData(userID int) (UserDataExport, error) {
+	export := UserDataExport{UserID: userID, UserEvents: []ExportedUserEvent{}, ProductEvents: []ExportedProductEvent{}}
+
+	var profile ExportedProfile
+	var name, email sql.NullString
+	var registeredAt sql.NullTime
+	err := db.GetDB().QueryRow("SELECT name, email, registered_at, updated_at FROM users WHERE user_id = $1", userID).
+		Scan(&name, &email, &registeredAt, &profile.UpdatedAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return export, err
+	}
+	if err == nil {
+		profile.Name, profile.Email = name.String, email.String
+		if registeredAt.Valid {
+			profile.RegisteredAt = &registeredAt.Time
+		}
+		export.Profile = &profile
+	}
+
+	rows, err := db.GetDB().Query(`SELECT COALESCE(action, ''), name, email, occurred_at
+		FROM user_actions WHERE user_id = $1 ORDER BY occurred_at, id`, userID)
+	if err != nil {
+		return export, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var event ExportedUserEvent
+		if err := rows.Scan(&event.Action, &name, &email, &event.OccurredAt); err != nil {
+			return export, err
+		}
+		event.Name, event.Email = name.String, email.String
+		export.UserEvents = append(export.UserEvents, event)
+	}
+	if err := rows.Err(); err != nil {
+		return export, err
+	}
+
+	rows, err = db.GetDB().Query(`SELECT COALESCE(action, ''), COALESCE(product_id, 0), COALESCE(name, ''), COALESCE(category, ''), occurred_at
+		FROM product_actions WHERE user_id = $1 ORDER BY occurred_at, id`, userID)
+	if err != nil {
+		return export, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var event ExportedProductEvent
+		if err := rows.Scan(&event.Action, &event.ProductID, &event.Name, &event.Category, &event.OccurredAt); err != nil {
+			return export, err
+		}
+		export.ProductEvents = append(export.ProductEvents, event)
+	}
+	return export, rows.Err()
+}
@@ -2,119 +2,333 @@ package handler
 
 import (
 	"analytics/db"
-	"encoding/json"
+	"auth"
+	"auth/access"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"events"
+	"health"
+	"io"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"sync/atomic"
+	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/lib/pq"
 )
 
-type UserKafkaMessage struct {
-	Action string `json:"action"`
-	UserID int    `json:"user_id"`
-	Email  string `json:"email"`
-	Name   string `json:"name"`
-}
+// Задержка между повторами записи события при недоступной БД
+const (
+	ingestRetryMinBackoff = 500 * time.Millisecond
+	ingestRetryMaxBackoff = 30 * time.Second
+)
+
+// Текущие консьюмеры, нужны для проверки готовности
+var (
+	userUpdatesConsumer    atomic.Pointer[kafka.Consumer]
+	productUpdatesConsumer atomic.Pointer[kafka.Consumer]
+)
+
+// Открытые ключи для проверки токенов публикует сервис пользователей
+const defaultJWKSURL = "http://user-service:9999/users/.well-known/jwks.json"
 
-type ProductKafkaMessage struct {
-	Action             string `json:"action"`
-	UserID             int    `json:"user_id"`
-	ProductID          string `json:"product_id"`
-	ProductCategory    string `json:"product_category"`
-	NumberOfLikes      int    `json:"number_of_likes"`
-	ProductDescription string `json:"description"`
-	ProductName        string `json:"name"`
+func jwksURL() string {
+	if url := os.Getenv("JWKS_URL"); url != "" {
+		return url
+	}
+	return defaultJWKSURL
 }
 
 func InitializeRoutes() {
 	db.Connect()
+	verifier := auth.NewJWKSVerifier(jwksURL(), auth.RevocationStoreFromEnv())
+	registerRoutes(access.NewRouter(http.DefaultServeMux, verifier))
+}
+
+// registerRoutes маршруты сервиса; статистика доступна только с правом analytics:read,
+// выгрузку данных пользователя вызывает users
+func registerRoutes(rt *access.Router) {
+	read := access.Require(access.AnalyticsRead)
+	rt.HandleFunc("/analytics/products/likes", read, productLikesStats)                                 // Лайки/анлайки по продуктам за период
+	rt.HandleFunc("/analytics/products/history", read, productHistory)                                  // История изменений продукта
+	rt.HandleFunc("/analytics/categories/top", read, topCategories)                                     // Топ категорий по вовлеченности
+	rt.HandleFunc("/analytics/users/registrations", read, registrationsPerDay)                          // Регистрации по дням
+	rt.HandleFunc("/analytics/users/active", read, mostActiveUsers)                                     // Самые активные пользователи
+	rt.HandleFunc("/analytics/internal/export", access.Service(auth.PurposeDataExport), exportUserData) // Данные пользователя для выгрузки, вызывает users
+
+	rt.HandleFunc("/health", access.Public(), health.Live)
+	rt.HandleFunc("/ready", access.Public(), ready)
 }
 
 func InitKafka() {
+	initAckProducer()
 	go initUserUpdatesConsumer()
 	go initProductUpdatesConsumer()
 }
 
 func initUserUpdatesConsumer() {
-	consumer, err := kafka.NewConsumer(&kafka.ConfigMap{
-		"bootstrap.servers": os.Getenv("KAFKA_BROKER"),
-		"group.id":          "analytics_user_updates",
-		"auto.offset.reset": "earliest",
-	})
-	if err != nil {
-		log.Fatalf("Ошибка создания консьюмера для user_updates: %v", err)
-	}
+	consumer := newConsumer("analytics_user_updates")
 	defer consumer.Close()
+	userUpdatesConsumer.Store(consumer)
+	defer userUpdatesConsumer.Store(nil)
 
 	// Подписка на топик
-	consumer.SubscribeTopics([]string{"user_updates"}, nil)
+	consumer.SubscribeTopics([]string{events.TopicUserUpdates}, nil)
 
 	// Чтение сообщений
-	kafkaLoopUserUpdates(consumer)
+	kafkaLoop(consumer, processUserKafkaMessage)
 }
 
 func initProductUpdatesConsumer() {
-	consumer, err := kafka.NewConsumer(&kafka.ConfigMap{
-		"bootstrap.servers": os.Getenv("KAFKA_BROKER"),
-		"group.id":          "analytics_product_updates",
-		"auto.offset.reset": "earliest",
-	})
-	if err != nil {
-		log.Fatalf("Ошибка создания консьюмера для product_updates: %v", err)
-	}
+	consumer := newConsumer("analytics_product_updates")
 	defer consumer.Close()
+	productUpdatesConsumer.Store(consumer)
+	defer productUpdatesConsumer.Store(nil)
 
 	// Подписка на топик
-	consumer.SubscribeTopics([]string{"product_updates"}, nil)
+	consumer.SubscribeTopics([]string{events.TopicProductUpdates}, nil)
 
 	// Чтение сообщений
-	kafkaLoopProductUpdates(consumer)
+	kafkaLoop(consumer, processProductKafkaMessage)
 }
 
-func kafkaLoopUserUpdates(consumer *kafka.Consumer) {
+// Офсет сохраняется только после записи события в БД (at-least-once),
+// повторная доставка отсекается уникальными ключами при вставке
+func newConsumer(groupID string) *kafka.Consumer {
+	consumer, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers":        os.Getenv("KAFKA_BROKER"),
+		"group.id":                 groupID,
+		"auto.offset.reset":        "earliest",
+		"enable.auto.offset.store": false,
+	})
+	if err != nil {
+		log.Fatalf("Ошибка создания консьюмера %s: %v", groupID, err)
+	}
+	return consumer
+}
+
+// Положение сообщения в Kafka и время, когда оно туда попало
+type kafkaPosition struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Timestamp time.Time
+}
+
+func kafkaLoop(consumer *kafka.Consumer, process func(events.Envelope, kafkaPosition) error) {
 	for {
 		msg, err := consumer.ReadMessage(-1)
+		if err != nil {
+			log.Printf("Error while consuming message: %s", err)
+			continue
+		}
+
+		position := kafkaPosition{
+			Topic:     *msg.TopicPartition.Topic,
+			Partition: msg.TopicPartition.Partition,
+			Offset:    int64(msg.TopicPartition.Offset),
+			Timestamp: msg.Timestamp,
+		}
+		envelope, err := events.Decode(msg.Value)
 		if err == nil {
-			var event UserKafkaMessage
-			if err := json.Unmarshal(msg.Value, &event); err != nil {
-				log.Printf("Error unmarshalling user_updates message: %s", err)
-				continue
-			}
-			processUserKafkaMessage(event)
-		} else {
-			log.Printf("Error while consuming user_updates message: %s", err)
+			err = retryIngest(func() error { return process(envelope, position) })
+		}
+		if err != nil {
+			// Битое сообщение или постоянная ошибка записи не исправятся повторами:
+			// сообщение уходит в dead_letters, чтобы не блокировать партицию
+			log.Printf("Error ingesting %s message at offset %d, moving to dead letters: %s", position.Topic, position.Offset, err)
+			deadLetter(position, msg.Value, err)
+		}
+
+		if _, err := consumer.StoreMessage(msg); err != nil {
+			log.Printf("Error storing offset: %s", err)
 		}
 	}
 }
 
-func kafkaLoopProductUpdates(consumer *kafka.Consumer) {
+// retryIngest повторяет запись события, пока ошибка временная (БД недоступна,
+// конфликт сериализации). Постоянную ошибку возвращает сразу.
+func retryIngest(ingest func() error) error {
+	backoff := ingestRetryMinBackoff
 	for {
-		msg, err := consumer.ReadMessage(-1)
-		if err == nil {
-			var event ProductKafkaMessage
-			if err := json.Unmarshal(msg.Value, &event); err != nil {
-				log.Printf("Error unmarshalling product_updates message: %s", err)
-				continue
-			}
-			processProductKafkaMessage(event)
-		} else {
-			log.Printf("Error while consuming product_updates message: %s", err)
+		err := ingest()
+		if err == nil || !isTransient(err) {
+			return err
+		}
+		log.Printf("Error ingesting event, retrying in %s: %s", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > ingestRetryMaxBackoff {
+			backoff = ingestRetryMaxBackoff
+		}
+	}
+}
+
+// isTransient: ошибки соединения и откаты транзакций, которые стоит повторить
+func isTransient(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Class() {
+		case "08", // connection exception
+			"40", // transaction rollback: serialization failure, deadlock
+			"53", // insufficient resources
+			"57": // operator intervention: перезапуск сервера
+			return true
 		}
+		return false
+	}
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
+
+// deadLetter сохраняет сообщение, которое не удалось записать, для разбора вручную
+func deadLetter(position kafkaPosition, payload []byte, cause error) {
+	err := retryIngest(func() error {
+		_, err := db.GetDB().Exec(`INSERT INTO dead_letters (kafka_topic, kafka_partition, kafka_offset, payload, error)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT DO NOTHING`,
+			position.Topic, position.Partition, position.Offset, payload, cause.Error())
+		return err
+	})
+	if err != nil {
+		log.Printf("Error saving %s message at offset %d to dead letters: %s", position.Topic, position.Offset, err)
+	}
+}
+
+// Время события: из конверта, у старых сообщений — время записи в Kafka
+func occurredAt(envelope events.Envelope, position kafkaPosition) time.Time {
+	if !envelope.OccurredAt.IsZero() {
+		return envelope.OccurredAt
+	}
+	if !position.Timestamp.IsZero() {
+		return position.Timestamp
 	}
+	return time.Now()
 }
 
-func processUserKafkaMessage(event UserKafkaMessage) {
-	_, err := db.GetDB().Exec("INSERT INTO user_actions (user_id, action, name, email) VALUES ($1, $2, $3, $4)", event.UserID, event.Action, event.Name, event.Email)
+// У старых сообщений нет event_id, дубликаты отсекаются по офсету
+func nullableEventID(envelope events.Envelope) interface{} {
+	if envelope.EventID == "" {
+		return nil
+	}
+	return envelope.EventID
+}
+
+func processUserKafkaMessage(envelope events.Envelope, position kafkaPosition) error {
+	if !envelope.Type.Known() {
+		return nil
+	}
+	event, err := envelope.User()
+	if err != nil {
+		log.Printf("Error decoding %s payload: %s", envelope.Type, err)
+		return nil
+	}
+	if envelope.Type == events.UserDeleted {
+		return processUserDeleted(envelope, event, position)
+	}
+	at := occurredAt(envelope, position)
+
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Событие, пришедшее после удаления, сохраняется без персональных данных
+	erased, err := userErased(tx, event.UserID)
+	if err != nil {
+		return err
+	}
+	if erased {
+		event.Name, event.Email = "", ""
+	}
+
+	result, err := tx.Exec(`INSERT INTO user_actions (event_id, kafka_topic, kafka_partition, kafka_offset, user_id, action, name, email, occurred_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT DO NOTHING`,
+		nullableEventID(envelope), position.Topic, position.Partition, position.Offset, event.UserID, envelope.Type, nullableString(event.Name), nullableString(event.Email), at)
 	if err != nil {
-		log.Printf("Error while adding user action to database: %s", err)
-		return
+		return err
 	}
+	if inserted, _ := result.RowsAffected(); inserted == 0 {
+		log.Printf("Skipping duplicate %s event %s", envelope.Type, envelope.EventID)
+		return nil
+	}
+
+	if err := upsertUserDimension(tx, envelope.Type, event, at); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Текущее состояние пользователя; более старое событие не перетирает более новое,
+// данные удаленного пользователя не восстанавливаются
+func upsertUserDimension(tx *sql.Tx, eventType events.Type, event events.UserPayload, at time.Time) error {
+	var registeredAt interface{}
+	if eventType == events.UserCreated {
+		registeredAt = at
+	}
+	_, err := tx.Exec(`INSERT INTO users (user_id, name, email, registered_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id) DO UPDATE SET
+			name = CASE WHEN users.deleted_at IS NULL AND users.updated_at <= EXCLUDED.updated_at THEN EXCLUDED.name ELSE users.name END,
+			email = CASE WHEN users.deleted_at IS NULL AND users.updated_at <= EXCLUDED.updated_at THEN EXCLUDED.email ELSE users.email END,
+			registered_at = COALESCE(users.registered_at, EXCLUDED.registered_at),
+			updated_at = GREATEST(users.updated_at, EXCLUDED.updated_at)`,
+		event.UserID, nullableString(event.Name), nullableString(event.Email), registeredAt, at)
+	return err
 }
 
-func processProductKafkaMessage(event ProductKafkaMessage) {
-	_, err := db.GetDB().Exec("INSERT INTO product_actions (action, user_id, product_id, category, likes, description, name) VALUES ($1, $2, $3, $4, $5, $6, $7)", event.Action, event.UserID, event.ProductID, event.ProductCategory, event.NumberOfLikes, event.ProductDescription, event.ProductName)
+func processProductKafkaMessage(envelope events.Envelope, position kafkaPosition) error {
+	if !envelope.Type.Known() {
+		return nil
+	}
+	event, err := envelope.Product()
+	if err != nil {
+		log.Printf("Error decoding %s payload: %s", envelope.Type, err)
+		return nil
+	}
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Действия удаленного пользователя не связываются с ним
+	userID := interface{}(event.UserID)
+	if event.UserID != 0 {
+		erased, err := userErased(tx, event.UserID)
+		if err != nil {
+			return err
+		}
+		if erased {
+			userID = nil
+		}
+	}
+
+	result, err := tx.Exec(`INSERT INTO product_actions (event_id, kafka_topic, kafka_partition, kafka_offset, action, user_id, product_id, category, likes, description, name, occurred_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		ON CONFLICT DO NOTHING`,
+		nullableEventID(envelope), position.Topic, position.Partition, position.Offset, envelope.Type, userID, event.ProductID, event.Category, event.Likes, event.Description, event.Name, occurredAt(envelope, position))
 	if err != nil {
-		log.Printf("Error while adding product action to database: %s", err)
-		return
+		return err
+	}
+	if inserted, _ := result.RowsAffected(); inserted == 0 {
+		log.Printf("Skipping duplicate %s event %s", envelope.Type, envelope.EventID)
+		return nil
+	}
+	return tx.Commit()
+}
+
+// Пустые имя и email сохраняются как NULL
+func nullableString(v string) interface{} {
+	if v == "" {
+		return nil
 	}
+	return v
 }
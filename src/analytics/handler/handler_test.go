@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+
+	"analytics/db"
+	"events"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"bad connection", driver.ErrBadConn, true},
+		{"wrapped bad connection", fmt.Errorf("insert: %w", driver.ErrBadConn), true},
+		{"serialization failure", &pq.Error{Code: "40001"}, true},
+		{"deadlock", &pq.Error{Code: "40P01"}, true},
+		{"connection failure", &pq.Error{Code: "08006"}, true},
+		{"admin shutdown", &pq.Error{Code: "57P01"}, true},
+		{"value too long", &pq.Error{Code: "22001"}, false},
+		{"undefined column", &pq.Error{Code: "42703"}, false},
+		{"other error", errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTransient(tt.err); got != tt.want {
+				t.Errorf("isTransient(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryIngest(t *testing.T) {
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   bool
+	}{
+		{"success", []error{nil}, 1, false},
+		{"transient then success", []error{driver.ErrBadConn, nil}, 2, false},
+		{"permanent error is not retried", []error{&pq.Error{Code: "22001"}}, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := retryIngest(func() error {
+				calls++
+				return tt.errs[calls-1]
+			})
+			if calls != tt.wantCalls || (err != nil) != tt.wantErr {
+				t.Errorf("retryIngest = %v after %d calls, want %d calls, error %v", err, calls, tt.wantCalls, tt.wantErr)
+			}
+		})
+	}
+}
+
+// Повторная доставка того же события (тот же event_id или, у старых сообщений,
+// та же позиция в Kafka) не вставляется второй раз: ON CONFLICT DO NOTHING не
+// добавляет строку, и измерение пользователя не обновляется.
+func TestRedeliveryInsertsOnce(t *testing.T) {
+	position := kafkaPosition{Topic: events.TopicUserUpdates, Partition: 0, Offset: 42, Timestamp: time.Now()}
+	tests := []struct {
+		name    string
+		eventID string
+		wantID  driver.Value
+	}{
+		{"same event_id", "0b7e7d1e-8c2c-4d5e-9a59-6f0f3c1f2a10", "0b7e7d1e-8c2c-4d5e-9a59-6f0f3c1f2a10"},
+		{"legacy message at the same offset", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			db.SetDB(conn)
+
+			insert := regexp.QuoteMeta("INSERT INTO user_actions") + "(.|\n)*ON CONFLICT DO NOTHING"
+			args := []driver.Value{tt.wantID, position.Topic, position.Partition, position.Offset, 7, string(events.UserCreated),
+				"Ann", "ann@example.com", sqlmock.AnyArg()}
+			// Пользователь не удален
+			expectNotErased := func() {
+				mock.ExpectQuery(regexp.QuoteMeta("SELECT deleted_at IS NOT NULL FROM users")).WithArgs(7).
+					WillReturnRows(sqlmock.NewRows([]string{"erased"}))
+			}
+			mock.ExpectBegin()
+			expectNotErased()
+			mock.ExpectExec(insert).WithArgs(args...).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users")).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+			mock.ExpectBegin()
+			expectNotErased()
+			mock.ExpectExec(insert).WithArgs(args...).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectRollback()
+
+			payload, err := events.New("users", events.UserCreated, events.UserPayload{UserID: 7, Name: "Ann", Email: "ann@example.com"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			payload.EventID = tt.eventID
+			for i := 0; i < 2; i++ {
+				if err := processUserKafkaMessage(payload, position); err != nil {
+					t.Fatalf("delivery %d: %v", i+1, err)
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
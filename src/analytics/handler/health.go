@@ -0,0 +1,35 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"analytics/db"
+	"health"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// Readiness: проверяем Postgres и оба консьюмера Kafka
+func ready(w http.ResponseWriter, r *http.Request) {
+	health.WriteReadiness(w, r, map[string]health.Check{
+		"postgres": func(ctx context.Context) error {
+			return db.GetDB().PingContext(ctx)
+		},
+		"kafka_user_updates": func(ctx context.Context) error {
+			return checkConsumer(ctx, userUpdatesConsumer.Load(), "user_updates")
+		},
+		"kafka_product_updates": func(ctx context.Context) error {
+			return checkConsumer(ctx, productUpdatesConsumer.Load(), "product_updates")
+		},
+	})
+}
+
+func checkConsumer(ctx context.Context, consumer *kafka.Consumer, topic string) error {
+	if consumer == nil {
+		return errors.New("consumer is not initialized")
+	}
+	_, err := consumer.GetMetadata(&topic, false, health.RemainingMs(ctx))
+	return err
+}
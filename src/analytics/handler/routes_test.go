@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"auth"
+	"auth/access"
+	"auth/access/accesstest"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestRoutePolicies(t *testing.T) {
+	rt := access.NewRouter(http.NewServeMux(), auth.NewJWKSVerifier("http://localhost/jwks.json", auth.NewMemoryRevocationStore()))
+	registerRoutes(rt)
+
+	read := access.Require(access.AnalyticsRead)
+	accesstest.CheckPolicies(t, rt, map[string]access.Policy{
+		"/analytics/products/likes":      read,
+		"/analytics/products/history":    read,
+		"/analytics/categories/top":      read,
+		"/analytics/users/registrations": read,
+		"/analytics/users/active":        read,
+		"/analytics/internal/export":     access.Service(auth.PurposeDataExport),
+		"/health":                        access.Public(),
+		"/ready":                         access.Public(),
+	})
+	accesstest.CheckNoDirectRoutes(t, ".")
+}
+
+// Статистика отдается только с действительным токеном и правом analytics:read
+func TestRoutesRejectWithoutAnalyticsRead(t *testing.T) {
+	signer, err := auth.GenerateSigner("EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign, err := auth.GenerateSigner("EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revocations := auth.NewMemoryRevocationStore()
+	if err := auth.RevokeSession(context.Background(), revocations, "logged-out", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	registerRoutes(access.NewRouter(mux, auth.NewLocalVerifier(signer, revocations)))
+
+	sign := func(signer *auth.Signer, role string, sessionID string) string {
+		token, err := signer.Sign(jwt.MapClaims{auth.ClaimUserID: 1, auth.ClaimRole: role, auth.ClaimSessionID: sessionID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"foreign key", sign(foreign, access.RoleAdmin, "s1"), http.StatusUnauthorized},
+		{"revoked session", sign(signer, access.RoleAdmin, "logged-out"), http.StatusUnauthorized},
+		{"user", sign(signer, access.RoleUser, "s1"), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/analytics/users/active", nil)
+			if tt.token != "" {
+				r.AddCookie(&http.Cookie{Name: access.TokenCookie, Value: tt.token})
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, r)
+			if rec.Code != tt.want {
+				t.Errorf("code = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
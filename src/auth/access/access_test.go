@@ -0,0 +1,186 @@
+package access
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"auth"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func newTestVerifier(t *testing.T) (*auth.Signer, *auth.Verifier) {
+	t.Helper()
+	signer, err := auth.GenerateSigner("RS256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, auth.NewLocalVerifier(signer, auth.NewMemoryRevocationStore())
+}
+
+func tokenFor(t *testing.T, signer *auth.Signer, role string) string {
+	t.Helper()
+	token, err := signer.Sign(jwt.MapClaims{
+		auth.ClaimUserID:    float64(7),
+		auth.ClaimRole:      role,
+		auth.ClaimTokenID:   "jti-" + role,
+		auth.ClaimExpiresAt: time.Now().Add(time.Minute).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestWrap(t *testing.T) {
+	signer, verifier := newTestVerifier(t)
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		if p, found := FromContext(r.Context()); found && p.ID != 7 {
+			t.Errorf("principal id = %d, want 7", p.ID)
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+
+	tests := []struct {
+		name   string
+		policy Policy
+		token  string
+		want   int
+	}{
+		{"public without token", Public(), "", http.StatusOK},
+		{"authenticated without token", Authenticated(), "", http.StatusUnauthorized},
+		{"authenticated with garbage", Authenticated(), "garbage", http.StatusUnauthorized},
+		{"authenticated user", Authenticated(), tokenFor(t, signer, RoleUser), http.StatusOK},
+		{"permission without token", Require(ProductCreate), "", http.StatusUnauthorized},
+		{"permission missing", Require(ProductCreate), tokenFor(t, signer, RoleUser), http.StatusForbidden},
+		{"permission granted", Require(ProductLike), tokenFor(t, signer, RoleUser), http.StatusOK},
+		{"admin permission", Require(AnalyticsRead), tokenFor(t, signer, RoleAdmin), http.StatusOK},
+		{"unknown role", Require(ProductLike), tokenFor(t, signer, "guest"), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.token != "" {
+				r.AddCookie(&http.Cookie{Name: TokenCookie, Value: tt.token})
+			}
+			w := httptest.NewRecorder()
+			Wrap(verifier, tt.policy, ok)(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestWrapRejectsRevokedToken(t *testing.T) {
+	signer, verifier := newTestVerifier(t)
+	token := tokenFor(t, signer, RoleAdmin)
+	claims, err := verifier.Parse(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.RevokeToken(context.Background(), verifier.Revocations(), claims); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: TokenCookie, Value: token})
+	w := httptest.NewRecorder()
+	Wrap(verifier, Require(UserManage), func(w http.ResponseWriter, r *http.Request) {})(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestWrapService(t *testing.T) {
+	signer, verifier := newTestVerifier(t)
+	serviceToken, err := signer.Sign(jwt.MapClaims{
+		auth.ClaimPurpose:   auth.PurposeDataExport,
+		auth.ClaimUserID:    float64(7),
+		auth.ClaimExpiresAt: time.Now().Add(time.Minute).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPurpose, err := signer.Sign(jwt.MapClaims{
+		auth.ClaimPurpose:   "email_verification",
+		auth.ClaimUserID:    float64(7),
+		auth.ClaimExpiresAt: time.Now().Add(time.Minute).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{"without token", "", http.StatusUnauthorized},
+		{"service token", "Bearer " + serviceToken, http.StatusOK},
+		{"other purpose", "Bearer " + otherPurpose, http.StatusUnauthorized},
+		{"user access token", "Bearer " + tokenFor(t, signer, RoleAdmin), http.StatusUnauthorized},
+		{"without bearer prefix", serviceToken, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			Wrap(verifier, Service(auth.PurposeDataExport), func(w http.ResponseWriter, r *http.Request) {
+				if p, _ := FromContext(r.Context()); p.ID != 7 {
+					t.Errorf("principal id = %d, want 7", p.ID)
+				}
+			})(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouterRequiresPolicy(t *testing.T) {
+	rt := NewRouter(http.NewServeMux(), nil)
+	rt.HandleFunc("/public", Public(), func(w http.ResponseWriter, r *http.Request) {})
+
+	mustPanic := func(name string, register func()) {
+		t.Helper()
+		defer func() {
+			if recover() == nil {
+				t.Errorf("%s: expected panic", name)
+			}
+		}()
+		register()
+	}
+	mustPanic("zero policy", func() {
+		rt.HandleFunc("/none", Policy{}, func(w http.ResponseWriter, r *http.Request) {})
+	})
+	mustPanic("protected route without verifier", func() {
+		rt.HandleFunc("/admin", Require(UserManage), func(w http.ResponseWriter, r *http.Request) {})
+	})
+
+	if got := rt.Policies(); len(got) != 1 || got["/public"] != Public() {
+		t.Errorf("policies = %v", got)
+	}
+}
+
+func TestRolePermissions(t *testing.T) {
+	for _, p := range []Permission{ProductCreate, ProductUpdate, ProductDelete, ProductLike, UserManage, AnalyticsRead} {
+		if !RoleHas(RoleAdmin, p) {
+			t.Errorf("admin lacks %s", p)
+		}
+	}
+	for _, p := range []Permission{ProductCreate, ProductUpdate, ProductDelete, UserManage, AnalyticsRead} {
+		if RoleHas(RoleUser, p) {
+			t.Errorf("user has %s", p)
+		}
+	}
+	if RoleHas("", ProductLike) {
+		t.Error("empty role has permissions")
+	}
+}
@@ -0,0 +1,81 @@
+// Package accesstest проверки маршрутов для тестов сервисов
+package accesstest
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"auth/access"
+)
+
+// CheckPolicies сверяет маршруты роутера с ожидаемыми политиками: у каждого
+// зарегистрированного маршрута должна быть ожидаемая политика, и наоборот
+func CheckPolicies(t *testing.T, rt *access.Router, want map[string]access.Policy) {
+	t.Helper()
+	got := rt.Policies()
+	for _, pattern := range sortedKeys(got) {
+		expected, ok := want[pattern]
+		if !ok {
+			t.Errorf("route %s (%s) is not listed in the expected policies", pattern, got[pattern])
+			continue
+		}
+		if got[pattern] != expected {
+			t.Errorf("route %s: policy %s, want %s", pattern, got[pattern], expected)
+		}
+	}
+	for _, pattern := range sortedKeys(want) {
+		if _, ok := got[pattern]; !ok {
+			t.Errorf("route %s is expected but not registered", pattern)
+		}
+	}
+}
+
+// CheckNoDirectRoutes проверяет, что пакет в каталоге dir не регистрирует
+// маршруты через http.Handle/http.HandleFunc в обход роутера
+func CheckNoDirectRoutes(t *testing.T, dir string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("read %s: %v", dir, err)
+	}
+	fset := token.NewFileSet()
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		file, err := parser.ParseFile(fset, filepath.Join(dir, name), nil, 0)
+		if err != nil {
+			t.Fatalf("parse %s: %v", name, err)
+		}
+		ast.Inspect(file, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			if x, ok := sel.X.(*ast.Ident); ok && x.Name == "http" && (sel.Sel.Name == "HandleFunc" || sel.Sel.Name == "Handle") {
+				t.Errorf("%s: route registered with http.%s bypasses the access policy", fset.Position(call.Pos()), sel.Sel.Name)
+			}
+			return true
+		})
+	}
+}
+
+func sortedKeys(policies map[string]access.Policy) []string {
+	keys := make([]string, 0, len(policies))
+	for k := range policies {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,181 @@
+package access
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"auth"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Имя cookie с токеном доступа
+const TokenCookie = "token"
+
+type policyKind int
+
+const (
+	policyPublic policyKind = iota + 1
+	policyAuthenticated
+	policyPermission
+	policyService
+)
+
+// Policy правило доступа к маршруту. Нулевое значение политикой не считается.
+type Policy struct {
+	kind       policyKind
+	permission Permission
+	purpose    string
+}
+
+// Public маршрут доступен без токена
+func Public() Policy {
+	return Policy{kind: policyPublic}
+}
+
+// Authenticated маршрут доступен любому пользователю с действительным токеном
+func Authenticated() Policy {
+	return Policy{kind: policyAuthenticated}
+}
+
+// Require маршрут доступен пользователю, у роли которого есть право
+func Require(permission Permission) Policy {
+	return Policy{kind: policyPermission, permission: permission}
+}
+
+// Service внутренний маршрут для вызовов между сервисами: одноцелевой токен с
+// назначением purpose в заголовке Authorization. Токены доступа пользователей
+// не подходят.
+func Service(purpose string) Policy {
+	return Policy{kind: policyService, purpose: purpose}
+}
+
+func (p Policy) String() string {
+	switch p.kind {
+	case policyPublic:
+		return "public"
+	case policyAuthenticated:
+		return "authenticated"
+	case policyPermission:
+		return string(p.permission)
+	case policyService:
+		return "service:" + p.purpose
+	}
+	return "undefined"
+}
+
+// Principal пользователь, от имени которого выполняется запрос
+type Principal struct {
+	ID            int
+	Name          string
+	Role          string
+	SessionID     string
+	EmailVerified bool
+	Claims        jwt.MapClaims
+}
+
+// Can проверяет право по роли пользователя
+func (p Principal) Can(permission Permission) bool {
+	return RoleHas(p.Role, permission)
+}
+
+// PrincipalFromClaims собирает пользователя из claims токена доступа
+func PrincipalFromClaims(claims jwt.MapClaims) Principal {
+	id, _ := claims[auth.ClaimUserID].(float64)
+	name, _ := claims[auth.ClaimName].(string)
+	role, _ := claims[auth.ClaimRole].(string)
+	sessionID, _ := claims[auth.ClaimSessionID].(string)
+	verified, _ := claims[auth.ClaimEmailVerified].(bool)
+	return Principal{ID: int(id), Name: name, Role: role, SessionID: sessionID, EmailVerified: verified, Claims: claims}
+}
+
+type principalKey struct{}
+
+// FromContext пользователь, проверенный middleware; для публичных маршрутов его нет
+func FromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// Wrap проверяет политику перед вызовом обработчика: без токена отвечает 401,
+// без нужного права — 403. Проверенный пользователь кладется в контекст запроса.
+func Wrap(verifier *auth.Verifier, policy Policy, handler http.HandlerFunc) http.HandlerFunc {
+	if policy.kind == 0 {
+		panic("access: route has no policy")
+	}
+	if policy.kind == policyPublic {
+		return handler
+	}
+	if verifier == nil {
+		panic(fmt.Sprintf("access: policy %s requires a token verifier", policy))
+	}
+	if policy.kind == policyService {
+		return wrapService(verifier, policy.purpose, handler)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(TokenCookie)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		claims, err := verifier.Parse(r.Context(), cookie.Value)
+		if err != nil {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		p := PrincipalFromClaims(claims)
+		if policy.kind == policyPermission && !p.Can(policy.permission) {
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	}
+}
+
+// wrapService проверяет токен вызывающего сервиса; пользователь из токена
+// кладется в контекст запроса
+func wrapService(verifier *auth.Verifier, purpose string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		claims, err := verifier.ParsePurpose(token, purpose)
+		if err != nil {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, PrincipalFromClaims(claims))))
+	}
+}
+
+// Router регистрирует маршруты только вместе с политикой и запоминает их,
+// чтобы тесты могли проверить, что политика есть у каждого маршрута
+type Router struct {
+	mux      *http.ServeMux
+	verifier *auth.Verifier
+	policies map[string]Policy
+}
+
+// NewRouter маршрутизатор поверх mux. verifier может быть nil, если все маршруты публичные.
+func NewRouter(mux *http.ServeMux, verifier *auth.Verifier) *Router {
+	return &Router{mux: mux, verifier: verifier, policies: map[string]Policy{}}
+}
+
+// HandleFunc регистрирует обработчик с политикой доступа
+func (rt *Router) HandleFunc(pattern string, policy Policy, handler http.HandlerFunc) {
+	rt.mux.HandleFunc(pattern, Wrap(rt.verifier, policy, handler))
+	rt.policies[pattern] = policy
+}
+
+// Policies зарегистрированные маршруты и их политики
+func (rt *Router) Policies() map[string]Policy {
+	policies := make(map[string]Policy, len(rt.policies))
+	for pattern, policy := range rt.policies {
+		policies[pattern] = policy
+	}
+	return policies
+}
@@ -0,0 +1,71 @@
+// Package access модель прав и middleware авторизации, общие для всех сервисов.
+// Роль из токена доступа задает набор прав; каждый маршрут регистрируется через
+// Router с явной политикой: публичный, любой вошедший пользователь, конкретное
+// право или внутренний вызов другого сервиса. Маршрут без политики зарегистрировать нельзя.
+package access
+
+import "sort"
+
+// Permission право на действие, имя в виде "ресурс:действие"
+type Permission string
+
+const (
+	ProductCreate Permission = "product:create"
+	ProductUpdate Permission = "product:update"
+	ProductDelete Permission = "product:delete"
+	ProductLike   Permission = "product:like"
+	UserManage    Permission = "user:manage"
+	AnalyticsRead Permission = "analytics:read"
+)
+
+// Роли пользователей
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// rolePermissions права каждой роли; у неизвестной роли прав нет
+var rolePermissions = map[string][]Permission{
+	RoleUser: {
+		ProductLike,
+	},
+	RoleAdmin: {
+		ProductCreate,
+		ProductUpdate,
+		ProductDelete,
+		ProductLike,
+		UserManage,
+		AnalyticsRead,
+	},
+}
+
+// Permissions возвращает права роли
+func Permissions(role string) []Permission {
+	return append([]Permission(nil), rolePermissions[role]...)
+}
+
+// RoleHas проверяет, есть ли у роли право
+func RoleHas(role string, permission Permission) bool {
+	for _, p := range rolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Roles возвращает известные роли
+func Roles() []string {
+	roles := make([]string, 0, len(rolePermissions))
+	for role := range rolePermissions {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// KnownRole проверяет, что роль описана в модели прав
+func KnownRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
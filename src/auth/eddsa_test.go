@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Пример из RFC 8037, приложение A.4
+func TestEdDSARFC8037(t *testing.T) {
+	const (
+		d            = "nWGxne_9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A"
+		x            = "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"
+		signingInput = "eyJhbGciOiJFZERTQSJ9.RXhhbXBsZSBvZiBFZDI1NTE5IHNpZ25pbmc"
+		signature    = "hgyY0il_MGCjP0JzlnLWG1PPOt7-09PGcvMg3AIbQR6dWbhijcNR4ki4iylGjg5BhVsPt9g7sVvpAr_MuM0KAg"
+	)
+	seed, err := base64.RawURLEncoding.DecodeString(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	private := ed25519.NewKeyFromSeed(seed)
+	public, err := JWK{Kty: "OKP", Crv: "Ed25519", X: x}.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := SigningMethodEdDSA.Sign(signingInput, private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != signature {
+		t.Errorf("Sign = %s, want %s", got, signature)
+	}
+	if err := SigningMethodEdDSA.Verify(signingInput, signature, public); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+	if err := SigningMethodEdDSA.Verify(signingInput+"x", signature, public); err != jwt.ErrSignatureInvalid {
+		t.Errorf("Verify of altered input = %v, want %v", err, jwt.ErrSignatureInvalid)
+	}
+}
+
+func TestEdDSAWrongKeyType(t *testing.T) {
+	if _, err := SigningMethodEdDSA.Sign("input", []byte("secret")); err != errEdDSAKey {
+		t.Errorf("Sign error = %v, want %v", err, errEdDSAKey)
+	}
+	if err := SigningMethodEdDSA.Verify("input", "c2ln", []byte("secret")); err != errEdDSAKey {
+		t.Errorf("Verify error = %v, want %v", err, errEdDSAKey)
+	}
+	if method := jwt.GetSigningMethod("EdDSA"); method != SigningMethodEdDSA {
+		t.Errorf("registered method = %v, want EdDSA", method)
+	}
+}
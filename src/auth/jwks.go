@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Как долго набор ключей считается свежим
+	jwksCacheTTL = 10 * time.Minute
+	// Незнакомый kid вызывает повторную загрузку не чаще, чем раз в этот интервал
+	jwksMinRefreshInterval = 30 * time.Second
+	jwksFetchTimeout       = 5 * time.Second
+)
+
+// remoteKeySet открытые ключи, загружаемые с JWKS-эндпоинта сервиса пользователей
+type remoteKeySet struct {
+	url    string
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	// Закрывается, когда завершится текущая загрузка; nil, если загрузки нет
+	fetching chan struct{}
+}
+
+func newRemoteKeySet(url string) *remoteKeySet {
+	return &remoteKeySet{url: url, client: &http.Client{Timeout: jwksFetchTimeout}}
+}
+
+// publicKey ищет ключ в кэше; при устаревшем кэше или незнакомом kid
+// загружает набор заново. Загрузка идет без блокировки: известные ключи в это
+// время отдаются из кэша, а запросы с незнакомым kid ждут ту же загрузку, а не
+// начинают свою. Если загрузка не удалась, используются старые ключи.
+func (s *remoteKeySet) publicKey(kid string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	key, ok := s.keys[kid]
+	age := time.Since(s.fetchedAt)
+	switch {
+	case ok && (age < jwksCacheTTL || s.fetching != nil):
+		s.mu.Unlock()
+		return key, nil
+	case s.fetching != nil:
+		done := s.fetching
+		s.mu.Unlock()
+		<-done
+		return s.cachedKey(kid)
+	case !ok && age < jwksMinRefreshInterval:
+		s.mu.Unlock()
+		return nil, fmt.Errorf("auth: unknown key %q", kid)
+	}
+	done := make(chan struct{})
+	s.fetching = done
+	// Даже неудачная попытка сдвигает время, чтобы не долбить сервис пользователей
+	s.fetchedAt = time.Now()
+	s.mu.Unlock()
+
+	keys, err := s.fetch()
+
+	s.mu.Lock()
+	if err != nil {
+		log.Printf("auth: error fetching JWKS from %s: %v", s.url, err)
+	} else {
+		s.keys = keys
+	}
+	s.fetching = nil
+	s.mu.Unlock()
+	close(done)
+
+	return s.cachedKey(kid)
+}
+
+func (s *remoteKeySet) cachedKey(kid string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key, ok := s.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("auth: unknown key %q", kid)
+}
+
+func (s *remoteKeySet) fetch() (map[string]crypto.PublicKey, error) {
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("received non-200 response status: %s", resp.Status)
+	}
+
+	var set JWKSet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		key, err := jwk.PublicKey()
+		if err != nil {
+			log.Printf("auth: skipping key %q: %v", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+// JWKSHandler отдает открытые ключи подписчика
+func JWKSHandler(signer *Signer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		json.NewEncoder(w).Encode(signer.JWKS())
+	}
+}
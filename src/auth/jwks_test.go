@@ -0,0 +1,196 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// jwksServer отдает JWKS подписчика и считает загрузки; пока gate не закрыт,
+// ответ задерживается
+type jwksServer struct {
+	*httptest.Server
+	signer  atomic.Pointer[Signer]
+	fetches atomic.Int32
+}
+
+func newJWKSServer(t *testing.T, signer *Signer, gate chan struct{}) *jwksServer {
+	s := &jwksServer{}
+	s.signer.Store(signer)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.fetches.Add(1)
+		<-gate
+		JWKSHandler(s.signer.Load())(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func openGate() chan struct{} {
+	gate := make(chan struct{})
+	close(gate)
+	return gate
+}
+
+func TestJWKSHandler(t *testing.T) {
+	rsaSigner := newTestSigner(t, "RS256")
+	edSigner := newTestSigner(t, "EdDSA")
+	signer := &Signer{keys: map[string]signingKey{}, active: rsaSigner.active}
+	for _, s := range []*Signer{rsaSigner, edSigner} {
+		signer.keys[s.active] = s.keys[s.active]
+	}
+
+	rec := httptest.NewRecorder()
+	JWKSHandler(signer)(rec, httptest.NewRequest(http.MethodGet, "/users/.well-known/jwks.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("code = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var set JWKSet
+	if err := json.NewDecoder(rec.Body).Decode(&set); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 2 {
+		t.Fatalf("keys = %+v, want 2", set.Keys)
+	}
+	for _, jwk := range set.Keys {
+		want := signer.keys[jwk.Kid].private.Public()
+		if jwk.Use != "sig" || jwk.Alg != signer.keys[jwk.Kid].method.Alg() {
+			t.Errorf("%s: use %q alg %q", jwk.Kid, jwk.Use, jwk.Alg)
+		}
+		got, err := jwk.PublicKey()
+		if err != nil {
+			t.Fatalf("%s: %v", jwk.Kid, err)
+		}
+		switch want := want.(type) {
+		case *rsa.PublicKey:
+			if !want.Equal(got) {
+				t.Errorf("%s: RSA key does not round-trip", jwk.Kid)
+			}
+		case ed25519.PublicKey:
+			if !want.Equal(got) {
+				t.Errorf("%s: Ed25519 key does not round-trip", jwk.Kid)
+			}
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	JWKSHandler(signer)(rec, httptest.NewRequest(http.MethodPost, "/users/.well-known/jwks.json", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST code = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestJWKSVerifier(t *testing.T) {
+	signer := newTestSigner(t, "EdDSA")
+	server := newJWKSServer(t, signer, openGate())
+	keys := newRemoteKeySet(server.URL)
+	verifier := newVerifier(keys.publicKey, NewMemoryRevocationStore())
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, err := verifier.Parse(ctx, sign(t, signer, jwt.MapClaims{ClaimUserID: 1})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := server.fetches.Load(); n != 1 {
+		t.Errorf("fetches = %d, want 1 (cached)", n)
+	}
+
+	// Незнакомый kid сразу после загрузки не вызывает новую
+	foreign := newTestSigner(t, "EdDSA")
+	if _, err := verifier.Parse(ctx, sign(t, foreign, jwt.MapClaims{ClaimUserID: 1})); err == nil {
+		t.Error("token with unknown kid accepted")
+	}
+	if n := server.fetches.Load(); n != 1 {
+		t.Errorf("fetches = %d, want 1 (unknown kid within the refresh interval)", n)
+	}
+
+	// После ротации новый kid подхватывается повторной загрузкой
+	rotated := newTestSigner(t, "RS256")
+	server.signer.Store(rotated)
+	keys.mu.Lock()
+	keys.fetchedAt = time.Now().Add(-jwksMinRefreshInterval)
+	keys.mu.Unlock()
+	if _, err := verifier.Parse(ctx, sign(t, rotated, jwt.MapClaims{ClaimUserID: 1})); err != nil {
+		t.Errorf("token with rotated key: %v", err)
+	}
+	if n := server.fetches.Load(); n != 2 {
+		t.Errorf("fetches = %d, want 2", n)
+	}
+}
+
+// Загрузка идет без блокировки: известные ключи отдаются из кэша, а
+// одновременные запросы с незнакомым kid ждут одну общую загрузку
+func TestJWKSConcurrentFetch(t *testing.T) {
+	old := newTestSigner(t, "EdDSA")
+	rotated := newTestSigner(t, "EdDSA")
+	gate := make(chan struct{})
+	server := newJWKSServer(t, rotated, gate)
+	keys := newRemoteKeySet(server.URL)
+	// В кэше устаревший набор со старым ключом
+	keys.keys = map[string]crypto.PublicKey{old.active: old.keys[old.active].private.Public()}
+	keys.fetchedAt = time.Now().Add(-jwksCacheTTL)
+
+	// Устаревший кэш: первый запрос начинает загрузку и ждет ответа
+	var wg sync.WaitGroup
+	errs := make(chan error, 11)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := keys.publicKey(old.active)
+		errs <- err
+	}()
+	for server.fetches.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := keys.publicKey(old.active)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("cached key during fetch: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cached key lookup blocked by the fetch")
+	}
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := keys.publicKey(rotated.active)
+			errs <- err
+		}()
+	}
+	close(gate)
+	wg.Wait()
+	close(errs)
+
+	if n := server.fetches.Load(); n != 1 {
+		t.Errorf("fetches = %d, want 1", n)
+	}
+	var failed int
+	for err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	// Первый запрос искал старый ключ, которого в новом наборе уже нет
+	if failed != 1 {
+		t.Errorf("failed lookups = %d, want 1", failed)
+	}
+}
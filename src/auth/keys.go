@@ -0,0 +1,270 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Ключи подписи токенов. Каждый ключ лежит в отдельном PEM-файле <kid>.pem
+// (PKCS#8, RSA или Ed25519). Подписывает активный ключ, а публикуются в JWKS все:
+// при ротации новый ключ добавляется и делается активным, старый удаляется,
+// когда истекут подписанные им токены.
+
+// JWK открытый ключ в формате RFC 7517
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKSet набор открытых ключей для /.well-known/jwks.json
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+type signingKey struct {
+	kid     string
+	method  jwt.SigningMethod
+	private crypto.Signer
+}
+
+// Signer подписывает токены активным ключом
+type Signer struct {
+	keys   map[string]signingKey
+	active string
+}
+
+// LoadSigner читает ключи из каталога dir. activeKid выбирает ключ для подписи;
+// если он пуст, используется последний по имени файла.
+func LoadSigner(dir string, activeKid string) (*Signer, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("auth: no signing keys in %s", dir)
+	}
+	sort.Strings(paths)
+
+	s := &Signer{keys: make(map[string]signingKey)}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		kid := strings.TrimSuffix(filepath.Base(path), ".pem")
+		key, err := parseSigningKey(kid, data)
+		if err != nil {
+			return nil, fmt.Errorf("auth: key %s: %w", path, err)
+		}
+		s.keys[kid] = key
+		s.active = kid
+	}
+	if activeKid != "" {
+		if _, ok := s.keys[activeKid]; !ok {
+			return nil, fmt.Errorf("auth: active key %q not found in %s", activeKid, dir)
+		}
+		s.active = activeKid
+	}
+	return s, nil
+}
+
+// GenerateSigner создает подписчика с одним новым ключом. Токены такого ключа
+// перестают проверяться после перезапуска, поэтому он годится только для
+// локального запуска и тестов.
+func GenerateSigner(alg string) (*Signer, error) {
+	private, err := generateKey(alg)
+	if err != nil {
+		return nil, err
+	}
+	kid, err := NewID()
+	if err != nil {
+		return nil, err
+	}
+	key, err := newSigningKey(kid, private)
+	if err != nil {
+		return nil, err
+	}
+	return &Signer{keys: map[string]signingKey{kid: key}, active: kid}, nil
+}
+
+// EnsureSigningKey создает в каталоге dir ключ с алгоритмом alg, если ключей там
+// еще нет: так постоянный каталог (том) заполняется при первом запуске
+func EnsureSigningKey(dir string, alg string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+	if len(paths) > 0 {
+		return nil
+	}
+
+	private, err := generateKey(alg)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return err
+	}
+	kid, err := NewID()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return os.WriteFile(filepath.Join(dir, kid+".pem"), data, 0o600)
+}
+
+func generateKey(alg string) (crypto.Signer, error) {
+	switch alg {
+	case "EdDSA":
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		return private, err
+	case "RS256", "":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	}
+	return nil, fmt.Errorf("auth: unsupported signing algorithm %q", alg)
+}
+
+// Sign подписывает claims активным ключом и указывает его kid в заголовке
+func (s *Signer) Sign(claims jwt.Claims) (string, error) {
+	key := s.keys[s.active]
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.private)
+}
+
+// JWKS открытые части всех ключей
+func (s *Signer) JWKS() JWKSet {
+	kids := make([]string, 0, len(s.keys))
+	for kid := range s.keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	set := JWKSet{Keys: make([]JWK, 0, len(kids))}
+	for _, kid := range kids {
+		jwk, err := publicJWK(kid, s.keys[kid].private.Public())
+		if err == nil {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set
+}
+
+func (s *Signer) publicKey(kid string) (crypto.PublicKey, error) {
+	key, ok := s.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("auth: unknown key %q", kid)
+	}
+	return key.private.Public(), nil
+}
+
+func parseSigningKey(kid string, data []byte) (signingKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return signingKey{}, errors.New("no PEM block")
+	}
+
+	var parsed interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return signingKey{}, err
+	}
+	private, ok := parsed.(crypto.Signer)
+	if !ok {
+		return signingKey{}, fmt.Errorf("unsupported key type %T", parsed)
+	}
+	return newSigningKey(kid, private)
+}
+
+func newSigningKey(kid string, private crypto.Signer) (signingKey, error) {
+	switch private.(type) {
+	case *rsa.PrivateKey:
+		return signingKey{kid: kid, method: jwt.SigningMethodRS256, private: private}, nil
+	case ed25519.PrivateKey:
+		return signingKey{kid: kid, method: SigningMethodEdDSA, private: private}, nil
+	}
+	return signingKey{}, fmt.Errorf("unsupported key type %T", private)
+}
+
+func publicJWK(kid string, public crypto.PublicKey) (JWK, error) {
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			Kid: kid,
+			Use: "sig",
+			Alg: jwt.SigningMethodRS256.Alg(),
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}, nil
+	case ed25519.PublicKey:
+		return JWK{
+			Kty: "OKP",
+			Kid: kid,
+			Use: "sig",
+			Alg: SigningMethodEdDSA.Alg(),
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(key),
+		}, nil
+	}
+	return JWK{}, fmt.Errorf("unsupported key type %T", public)
+}
+
+// PublicKey восстанавливает открытый ключ из JWK
+func (k JWK) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("auth: unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("auth: invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("auth: unsupported key type %q", k.Kty)
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func writeKey(t *testing.T, dir string, kid string, block *pem.Block) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, kid+".pem"), pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func pkcs8Block(t *testing.T, key interface{}) *pem.Block {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+}
+
+// Каталог с ключами разных форматов: RSA в PKCS#1 и PKCS#8, Ed25519 в PKCS#8
+func keysDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeKey(t, dir, "a-rsa-pkcs1", &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	writeKey(t, dir, "b-rsa-pkcs8", pkcs8Block(t, rsaKey))
+	writeKey(t, dir, "c-ed25519", pkcs8Block(t, edKey))
+	return dir
+}
+
+func TestLoadSignerRoundTrip(t *testing.T) {
+	dir := keysDir(t)
+	for _, kid := range []string{"a-rsa-pkcs1", "b-rsa-pkcs8", "c-ed25519"} {
+		t.Run(kid, func(t *testing.T) {
+			signer, err := LoadSigner(dir, kid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, err := signer.Sign(jwt.MapClaims{ClaimUserID: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims, err := NewLocalVerifier(signer, NewMemoryRevocationStore()).Parse(context.Background(), token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims[ClaimUserID] != float64(1) {
+				t.Errorf("claims = %v", claims)
+			}
+		})
+	}
+}
+
+func TestLoadSignerActiveKey(t *testing.T) {
+	dir := keysDir(t)
+	tests := []struct {
+		name      string
+		activeKid string
+		want      string
+		wantErr   bool
+	}{
+		{"last file by name", "", "c-ed25519", false},
+		{"explicit", "a-rsa-pkcs1", "a-rsa-pkcs1", false},
+		{"unknown", "missing", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := LoadSigner(dir, tt.activeKid)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadSigner error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && signer.active != tt.want {
+				t.Errorf("active = %q, want %q", signer.active, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadSignerRejectsBadDirs(t *testing.T) {
+	empty := t.TempDir()
+	broken := t.TempDir()
+	if err := os.WriteFile(filepath.Join(broken, "bad.pem"), []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for name, dir := range map[string]string{"empty": empty, "broken": broken} {
+		if _, err := LoadSigner(dir, ""); err == nil {
+			t.Errorf("%s: LoadSigner accepted the directory", name)
+		}
+	}
+}
+
+func TestEnsureSigningKey(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keys")
+	if err := EnsureSigningKey(dir, "EdDSA"); err != nil {
+		t.Fatal(err)
+	}
+	first, err := LoadSigner(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.keys[first.active].method != SigningMethodEdDSA {
+		t.Errorf("method = %v, want EdDSA", first.keys[first.active].method.Alg())
+	}
+
+	// Повторный запуск использует тот же ключ
+	if err := EnsureSigningKey(dir, "EdDSA"); err != nil {
+		t.Fatal(err)
+	}
+	second, err := LoadSigner(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(first.JWKS(), second.JWKS()) {
+		t.Errorf("JWKS changed after restart: %+v, want %+v", second.JWKS(), first.JWKS())
+	}
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RevocationStore список отозванных идентификаторов (токенов и сессий).
+// Запись нужна только до истечения срока токена, после этого она удаляется.
+type RevocationStore interface {
+	Revoke(ctx context.Context, id string, until time.Time) error
+	IsRevoked(ctx context.Context, id string) (bool, error)
+}
+
+// RevocationStoreFromEnv возвращает Redis-хранилище, если задан REDIS_URL,
+// иначе хранилище в памяти процесса
+func RevocationStoreFromEnv() RevocationStore {
+	addr := os.Getenv("REDIS_URL")
+	if addr == "" {
+		log.Println("auth: REDIS_URL is not set, revocation list is kept in memory")
+		return NewMemoryRevocationStore()
+	}
+	return NewRedisRevocationStore(redis.NewClient(&redis.Options{Addr: addr}))
+}
+
+// Отозванные идентификаторы в Redis, общие для всех сервисов
+type redisRevocationStore struct {
+	client *redis.Client
+}
+
+func NewRedisRevocationStore(client *redis.Client) RevocationStore {
+	return &redisRevocationStore{client: client}
+}
+
+func (s *redisRevocationStore) Revoke(ctx context.Context, id string, until time.Time) error {
+	ttl := time.Until(until)
+	if ttl <= 0 {
+		return nil
+	}
+	return s.client.Set(ctx, "revoked:"+id, 1, ttl).Err()
+}
+
+func (s *redisRevocationStore) IsRevoked(ctx context.Context, id string) (bool, error) {
+	n, err := s.client.Exists(ctx, "revoked:"+id).Result()
+	return n > 0, err
+}
+
+// Отозванные идентификаторы в памяти процесса: для тестов и локального запуска
+type memoryRevocationStore struct {
+	mu      sync.Mutex
+	revoked map[string]time.Time
+}
+
+func NewMemoryRevocationStore() RevocationStore {
+	return &memoryRevocationStore{revoked: make(map[string]time.Time)}
+}
+
+func (s *memoryRevocationStore) Revoke(ctx context.Context, id string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revoked[id] = until
+	return nil
+}
+
+func (s *memoryRevocationStore) IsRevoked(ctx context.Context, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	until, ok := s.revoked[id]
+	if !ok {
+		return false, nil
+	}
+	if time.Now().After(until) {
+		delete(s.revoked, id)
+		return false, nil
+	}
+	return true, nil
+}
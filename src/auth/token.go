@@ -0,0 +1,197 @@
+// Package auth общий код токенов доступа для сервисов: подпись JWT ключами RS256
+// или EdDSA, публикация открытых ключей (JWKS), проверка токенов и список
+// отозванных токенов и сессий. Секрета, которым можно выпустить токен, у
+// проверяющих сервисов нет.
+//
+// Токен доступа живет недолго и содержит идентификатор токена (jti) и
+// идентификатор сессии (sid). Сессия — это семейство refresh-токенов одного
+// входа; отзыв сессии делает недействительными все её токены доступа.
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Имена claims токена доступа
+const (
+	ClaimUserID    = "id"
+	ClaimName      = "name"
+	ClaimRole      = "role"
+	ClaimTokenID   = "jti"
+	ClaimSessionID = "sid"
+	ClaimExpiresAt = "exp"
+	// Подтвержден ли email; неподтвержденным аккаунтам часть действий недоступна
+	ClaimEmailVerified = "email_verified"
+	// Назначение одноцелевого токена (ссылки из писем); у токена доступа его нет
+	ClaimPurpose = "purpose"
+)
+
+// Назначение токена, с которым users запрашивает у сервисов данные пользователя
+// для выгрузки; id в токене — пользователь, чьи данные выгружаются
+const PurposeDataExport = "data_export"
+
+var (
+	ErrInvalidToken = errors.New("auth: invalid token")
+	ErrRevoked      = errors.New("auth: token revoked")
+)
+
+// Verifier проверяет подпись токена доступа и его отсутствие в списке отозванных.
+// Ключ проверки выбирается по kid из заголовка токена.
+type Verifier struct {
+	keyfunc     jwt.Keyfunc
+	revocations RevocationStore
+}
+
+// NewLocalVerifier проверяет токены ключами подписчика того же процесса
+func NewLocalVerifier(signer *Signer, revocations RevocationStore) *Verifier {
+	return newVerifier(signer.publicKey, revocations)
+}
+
+// NewJWKSVerifier проверяет токены ключами, опубликованными по адресу jwksURL.
+// Секрет подписи сервису не нужен.
+func NewJWKSVerifier(jwksURL string, revocations RevocationStore) *Verifier {
+	return newVerifier(newRemoteKeySet(jwksURL).publicKey, revocations)
+}
+
+func newVerifier(lookup func(kid string) (crypto.PublicKey, error), revocations RevocationStore) *Verifier {
+	return &Verifier{keyfunc: keyfunc(lookup), revocations: revocations}
+}
+
+// RemoteKeyfunc проверяет только подпись токена ключами, опубликованными по адресу
+// jwksURL, например ID-токенов провайдера OpenID Connect. Claims проверяет вызывающий.
+func RemoteKeyfunc(jwksURL string) jwt.Keyfunc {
+	return keyfunc(newRemoteKeySet(jwksURL).publicKey)
+}
+
+// keyfunc выбирает ключ по kid из заголовка токена
+func keyfunc(lookup func(kid string) (crypto.PublicKey, error)) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			return nil, errors.New("auth: token has no kid")
+		}
+		key, err := lookup(kid)
+		if err != nil {
+			return nil, err
+		}
+		// Алгоритм из заголовка должен соответствовать типу ключа
+		if expected := algorithmFor(key); token.Method.Alg() != expected {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key, nil
+	}
+}
+
+func algorithmFor(key crypto.PublicKey) string {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256.Alg()
+	case ed25519.PublicKey:
+		return SigningMethodEdDSA.Alg()
+	}
+	return ""
+}
+
+// Parse проверяет токен доступа и возвращает его claims.
+// Одноцелевые токены из писем токенами доступа не считаются.
+func (v *Verifier) Parse(ctx context.Context, tokenString string) (jwt.MapClaims, error) {
+	claims, err := v.parseSigned(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := claims[ClaimPurpose]; ok {
+		return nil, ErrInvalidToken
+	}
+
+	for _, id := range []string{tokenKey(claims), sessionKey(claims)} {
+		if id == "" {
+			continue
+		}
+		revoked, err := v.revocations.IsRevoked(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, ErrRevoked
+		}
+	}
+	return claims, nil
+}
+
+// ParsePurpose проверяет одноцелевой токен с заданным назначением
+func (v *Verifier) ParsePurpose(tokenString string, purpose string) (jwt.MapClaims, error) {
+	claims, err := v.parseSigned(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if p, _ := claims[ClaimPurpose].(string); p != purpose {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+func (v *Verifier) parseSigned(tokenString string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, v.keyfunc)
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// Revocations хранилище отозванных идентификаторов, с которым работает Verifier
+func (v *Verifier) Revocations() RevocationStore {
+	return v.revocations
+}
+
+// RevokeToken отзывает один токен доступа до истечения его срока
+func RevokeToken(ctx context.Context, store RevocationStore, claims jwt.MapClaims) error {
+	id := tokenKey(claims)
+	if id == "" {
+		return nil
+	}
+	exp, _ := claims[ClaimExpiresAt].(float64)
+	return store.Revoke(ctx, id, time.Unix(int64(exp), 0))
+}
+
+// RevokeSession отзывает все токены доступа сессии. until — самый поздний срок
+// жизни токена, выданного в этой сессии.
+func RevokeSession(ctx context.Context, store RevocationStore, sessionID string, until time.Time) error {
+	return store.Revoke(ctx, "session:"+sessionID, until)
+}
+
+// NewID случайный идентификатор для jti, сессий и refresh-токенов
+func NewID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+func tokenKey(claims jwt.MapClaims) string {
+	if jti, _ := claims[ClaimTokenID].(string); jti != "" {
+		return "token:" + jti
+	}
+	return ""
+}
+
+func sessionKey(claims jwt.MapClaims) string {
+	if sid, _ := claims[ClaimSessionID].(string); sid != "" {
+		return "session:" + sid
+	}
+	return ""
+}
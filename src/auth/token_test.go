@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func newTestSigner(t *testing.T, alg string) *Signer {
+	t.Helper()
+	signer, err := GenerateSigner(alg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func sign(t *testing.T, signer *Signer, claims jwt.MapClaims) string {
+	t.Helper()
+	token, err := signer.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestVerifierParseRejectsRevoked(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryRevocationStore()
+	signer := newTestSigner(t, "EdDSA")
+	verifier := NewLocalVerifier(signer, store)
+	exp := time.Now().Add(time.Hour)
+
+	revokedToken := jwt.MapClaims{ClaimUserID: 1, ClaimTokenID: "t1", ClaimSessionID: "s1", ClaimExpiresAt: float64(exp.Unix())}
+	if err := RevokeToken(ctx, store, revokedToken); err != nil {
+		t.Fatal(err)
+	}
+	if err := RevokeSession(ctx, store, "s2", exp); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"valid", sign(t, signer, jwt.MapClaims{ClaimTokenID: "t2", ClaimSessionID: "s1", ClaimExpiresAt: exp.Unix()}), nil},
+		{"revoked jti", sign(t, signer, revokedToken), ErrRevoked},
+		{"revoked sid", sign(t, signer, jwt.MapClaims{ClaimTokenID: "t3", ClaimSessionID: "s2", ClaimExpiresAt: exp.Unix()}), ErrRevoked},
+		{"legacy token without jti and sid", sign(t, signer, jwt.MapClaims{ClaimUserID: 1}), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := verifier.Parse(ctx, tt.token)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Parse error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifierParseRejectsForeignTokens(t *testing.T) {
+	signer := newTestSigner(t, "RS256")
+	verifier := NewLocalVerifier(signer, NewMemoryRevocationStore())
+
+	// Подмена алгоритма: HS256 с открытым ключом RSA вместо секрета
+	hs256 := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{ClaimUserID: 1})
+	hs256.Header["kid"] = signer.active
+	public, err := x509.MarshalPKIXPublicKey(signer.keys[signer.active].private.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	confused, err := hs256.SignedString(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"other key", sign(t, newTestSigner(t, "RS256"), jwt.MapClaims{ClaimUserID: 1})},
+		{"HS256 with the public key", confused},
+		{"expired", sign(t, signer, jwt.MapClaims{ClaimUserID: 1, ClaimExpiresAt: time.Now().Add(-time.Minute).Unix()})},
+		{"unsigned", func() string {
+			token, err := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{ClaimUserID: 1}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return token
+		}()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := verifier.Parse(context.Background(), tt.token); err == nil {
+				t.Error("Parse accepted the token")
+			}
+		})
+	}
+}
+
+func TestMemoryRevocationExpires(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryRevocationStore()
+	if err := store.Revoke(ctx, "token:old", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if revoked, _ := store.IsRevoked(ctx, "token:old"); revoked {
+		t.Error("expired revocation is still active")
+	}
+}
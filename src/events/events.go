@@ -0,0 +1,287 @@
+// Package events описывает общую схему событий в топиках user_updates,
+// product_updates и user_erasure.
+//
+// Каждое событие передается в конверте Envelope: идентификатор события, тип,
+// версия схемы, время возникновения и имя сервиса-продюсера. Полезная нагрузка
+// зависит от типа события.
+//
+// Правила совместимости:
+//   - в рамках одной версии схемы допускаются только добавления необязательных
+//     полей; консьюмеры игнорируют незнакомые поля;
+//   - удаление или изменение смысла поля требует увеличения SchemaVersion;
+//     Decode отклоняет события с версией новее, чем известна консьюмеру;
+//   - незнакомые типы событий консьюмеры пропускают;
+//   - сообщения старого формата (без конверта, с полем action) Decode
+//     переводит в текущую версию схемы.
+package events
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SchemaVersion текущая версия схемы событий
+const SchemaVersion = 1
+
+const (
+	TopicUserUpdates    = "user_updates"
+	TopicProductUpdates = "product_updates"
+	// Подтверждения сервисов об удалении данных пользователя
+	TopicUserErasure = "user_erasure"
+)
+
+// Type тип события
+type Type string
+
+const (
+	UserCreated              Type = "user.created"
+	UserUpdated              Type = "user.updated"
+	UserPasswordChanged      Type = "user.password_changed"
+	UserEmailVerified        Type = "user.email_verified"
+	UserEmailChangeRequested Type = "user.email_change_requested"
+	UserEmailChanged         Type = "user.email_changed"
+	UserRoleChanged          Type = "user.role_changed"
+	UserSuspended            Type = "user.suspended"
+	UserUnsuspended          Type = "user.unsuspended"
+	UserSessionsRevoked      Type = "user.sessions_revoked"
+	UserLocked               Type = "user.locked"
+	UserUnlocked             Type = "user.unlocked"
+	UserDeleted              Type = "user.deleted"
+
+	ProductCreated Type = "product.created"
+	ProductUpdated Type = "product.updated"
+	ProductDeleted Type = "product.deleted"
+	ProductLiked   Type = "product.liked"
+	ProductUnliked Type = "product.unliked"
+
+	UserErasureCompleted Type = "user.erasure_completed"
+	UserErasureFailed    Type = "user.erasure_failed"
+)
+
+var topics = map[Type]string{
+	UserCreated:              TopicUserUpdates,
+	UserUpdated:              TopicUserUpdates,
+	UserPasswordChanged:      TopicUserUpdates,
+	UserEmailVerified:        TopicUserUpdates,
+	UserEmailChangeRequested: TopicUserUpdates,
+	UserEmailChanged:         TopicUserUpdates,
+	UserRoleChanged:          TopicUserUpdates,
+	UserSuspended:            TopicUserUpdates,
+	UserUnsuspended:          TopicUserUpdates,
+	UserSessionsRevoked:      TopicUserUpdates,
+	UserLocked:               TopicUserUpdates,
+	UserUnlocked:             TopicUserUpdates,
+	UserDeleted:              TopicUserUpdates,
+
+	ProductCreated: TopicProductUpdates,
+	ProductUpdated: TopicProductUpdates,
+	ProductDeleted: TopicProductUpdates,
+	ProductLiked:   TopicProductUpdates,
+	ProductUnliked: TopicProductUpdates,
+
+	UserErasureCompleted: TopicUserErasure,
+	UserErasureFailed:    TopicUserErasure,
+}
+
+// Topic возвращает топик, в который публикуется событие данного типа
+func (t Type) Topic() string {
+	return topics[t]
+}
+
+// Known сообщает, описан ли тип в этой версии схемы
+func (t Type) Known() bool {
+	_, ok := topics[t]
+	return ok
+}
+
+var (
+	ErrUnknownType        = errors.New("events: unknown event type")
+	ErrUnsupportedVersion = errors.New("events: unsupported schema version")
+	ErrPayloadMismatch    = errors.New("events: payload does not match event type")
+)
+
+// Envelope конверт события
+type Envelope struct {
+	EventID    string          `json:"event_id"`
+	Type       Type            `json:"type"`
+	Version    int             `json:"schema_version"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	Producer   string          `json:"producer"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// Статусы учетной записи в UserPayload.Status
+const (
+	UserStatusPending   = "pending" // email еще не подтвержден
+	UserStatusActive    = "active"
+	UserStatusSuspended = "suspended"
+)
+
+// UserPayload нагрузка событий user.*. Email — текущий подтвержденный адрес,
+// PendingEmail — новый адрес, ожидающий подтверждения. ActorID — администратор,
+// выполнивший действие, если это не сам пользователь. LockedUntil и Reason
+// есть у событий временной блокировки входа user.locked и user.unlocked.
+// У user.deleted заполнены только UserID и DeletionID: персональных данных
+// удаленного пользователя в событии нет.
+type UserPayload struct {
+	UserID       int        `json:"user_id"`
+	Email        string     `json:"email"`
+	Name         string     `json:"name"`
+	Status       string     `json:"status,omitempty"`
+	PendingEmail string     `json:"pending_email,omitempty"`
+	Role         string     `json:"role,omitempty"`
+	ActorID      int        `json:"actor_id,omitempty"`
+	LockedUntil  *time.Time `json:"locked_until,omitempty"`
+	Reason       string     `json:"reason,omitempty"`
+	DeletionID   string     `json:"deletion_id,omitempty"`
+}
+
+// ProductPayload нагрузка событий product.*; UserID — автор действия
+type ProductPayload struct {
+	ProductID   int    `json:"product_id"`
+	UserID      int    `json:"user_id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Category    string `json:"category"`
+	Likes       int    `json:"likes"`
+}
+
+// ErasurePayload подтверждение сервиса Service, что данные пользователя по
+// удалению DeletionID стерты (user.erasure_completed) или что это не удалось
+// (user.erasure_failed, причина в Error)
+type ErasurePayload struct {
+	DeletionID string `json:"deletion_id"`
+	UserID     int    `json:"user_id"`
+	Service    string `json:"service"`
+	Error      string `json:"error,omitempty"`
+}
+
+// New создает конверт нового события
+func New(producer string, t Type, payload interface{}) (Envelope, error) {
+	if !t.Known() {
+		return Envelope{}, fmt.Errorf("%w: %q", ErrUnknownType, t)
+	}
+	if err := checkPayload(t, payload); err != nil {
+		return Envelope{}, err
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return Envelope{}, err
+	}
+	id, err := newEventID()
+	if err != nil {
+		return Envelope{}, err
+	}
+	return Envelope{
+		EventID:    id,
+		Type:       t,
+		Version:    SchemaVersion,
+		OccurredAt: time.Now().UTC(),
+		Producer:   producer,
+		Payload:    raw,
+	}, nil
+}
+
+// Encode сериализует конверт для отправки в Kafka
+func (e Envelope) Encode() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// Decode разбирает сообщение из Kafka и проверяет совместимость версии
+func Decode(data []byte) (Envelope, error) {
+	var e Envelope
+	if err := json.Unmarshal(data, &e); err != nil {
+		return Envelope{}, err
+	}
+	if e.Type == "" {
+		return decodeLegacy(data)
+	}
+	if e.Version < 1 || e.Version > SchemaVersion {
+		return Envelope{}, fmt.Errorf("%w: %d", ErrUnsupportedVersion, e.Version)
+	}
+	return e, nil
+}
+
+// User возвращает нагрузку события user.*
+func (e Envelope) User() (UserPayload, error) {
+	var p UserPayload
+	if e.Type.Topic() != TopicUserUpdates {
+		return p, fmt.Errorf("%w: %q", ErrPayloadMismatch, e.Type)
+	}
+	err := json.Unmarshal(e.Payload, &p)
+	return p, err
+}
+
+// Product возвращает нагрузку события product.*
+func (e Envelope) Product() (ProductPayload, error) {
+	var p ProductPayload
+	if e.Type.Topic() != TopicProductUpdates {
+		return p, fmt.Errorf("%w: %q", ErrPayloadMismatch, e.Type)
+	}
+	err := json.Unmarshal(e.Payload, &p)
+	return p, err
+}
+
+// Erasure возвращает нагрузку события user.erasure_*
+func (e Envelope) Erasure() (ErasurePayload, error) {
+	var p ErasurePayload
+	if e.Type.Topic() != TopicUserErasure {
+		return p, fmt.Errorf("%w: %q", ErrPayloadMismatch, e.Type)
+	}
+	err := json.Unmarshal(e.Payload, &p)
+	return p, err
+}
+
+// Key ключ сущности, к которой относится событие: "user:<id>" или "product:<id>".
+// События с одним ключом публикуются по порядку и попадают в одну партицию.
+func (e Envelope) Key() string {
+	var ids struct {
+		UserID    int `json:"user_id"`
+		ProductID int `json:"product_id"`
+	}
+	json.Unmarshal(e.Payload, &ids)
+	if e.Type.Topic() == TopicProductUpdates {
+		return ProductKey(ids.ProductID)
+	}
+	return UserKey(ids.UserID)
+}
+
+// UserKey ключ событий пользователя
+func UserKey(userID int) string {
+	return fmt.Sprintf("user:%d", userID)
+}
+
+// ProductKey ключ событий продукта
+func ProductKey(productID int) string {
+	return fmt.Sprintf("product:%d", productID)
+}
+
+func checkPayload(t Type, payload interface{}) error {
+	var ok bool
+	switch t.Topic() {
+	case TopicUserUpdates:
+		_, ok = payload.(UserPayload)
+	case TopicProductUpdates:
+		_, ok = payload.(ProductPayload)
+	case TopicUserErasure:
+		_, ok = payload.(ErasurePayload)
+	}
+	if !ok {
+		return fmt.Errorf("%w: %q got %T", ErrPayloadMismatch, t, payload)
+	}
+	return nil
+}
+
+// newEventID генерирует UUID v4
+func newEventID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
@@ -0,0 +1,147 @@
+package events
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestDecodeVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		wantErr error
+	}{
+		{"current", SchemaVersion, nil},
+		{"zero", 0, ErrUnsupportedVersion},
+		{"newer than known", SchemaVersion + 1, ErrUnsupportedVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := fmt.Sprintf(`{"event_id":"1","type":"user.created","schema_version":%d,"payload":{"user_id":1}}`, tt.version)
+			_, err := Decode([]byte(data))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Decode error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecodeLegacy(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		wantType  Type
+		wantErr   error
+		productID int
+	}{
+		{"new user", `{"action":"new user","user_id":3,"email":"a@example.com","name":"A"}`, UserCreated, nil, 0},
+		{"update user info", `{"action":"update user info","user_id":3}`, UserUpdated, nil, 0},
+		{"product info update", `{"action":"product info update","product_id":5}`, ProductUpdated, nil, 5},
+		{"like with string product_id", `{"action":"like","user_id":3,"product_id":"42"}`, ProductLiked, nil, 42},
+		{"unlike", `{"action":"unlike","user_id":3,"product_id":7}`, ProductUnliked, nil, 7},
+		{"unknown action", `{"action":"something else"}`, "", ErrUnknownType, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := Decode([]byte(tt.data))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Decode error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if e.Type != tt.wantType || e.Version != SchemaVersion {
+				t.Errorf("Decode = %s v%d, want %s v%d", e.Type, e.Version, tt.wantType, SchemaVersion)
+			}
+			if e.Type.Topic() != TopicProductUpdates {
+				return
+			}
+			p, err := e.Product()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.ProductID != tt.productID {
+				t.Errorf("product_id = %d, want %d", p.ProductID, tt.productID)
+			}
+		})
+	}
+}
+
+func TestPayloadMismatch(t *testing.T) {
+	user, err := New("users", UserCreated, UserPayload{UserID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	product, err := New("products", ProductLiked, ProductPayload{ProductID: 2, UserID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{"Product of user event", func() error { _, err := user.Product(); return err }},
+		{"User of product event", func() error { _, err := product.User(); return err }},
+		{"Erasure of user event", func() error { _, err := user.Erasure(); return err }},
+		{"New with wrong payload", func() error { _, err := New("users", UserCreated, ProductPayload{}); return err }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.call(); !errors.Is(err, ErrPayloadMismatch) {
+				t.Errorf("error = %v, want %v", err, ErrPayloadMismatch)
+			}
+		})
+	}
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		t       Type
+		payload interface{}
+		key     string
+	}{
+		{"user", UserUpdated, UserPayload{UserID: 7, Email: "new@example.com", Name: "N"}, "user:7"},
+		{"product", ProductUpdated, ProductPayload{ProductID: 9, UserID: 7, Name: "Book", Category: "books", Likes: 3}, "product:9"},
+		{"erasure", UserErasureFailed, ErasurePayload{DeletionID: "d1", UserID: 7, Service: "products", Error: "boom"}, "user:7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := New("test", tt.t, tt.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := e.Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Decode(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.EventID != e.EventID || got.Type != e.Type || got.Producer != "test" || !got.OccurredAt.Equal(e.OccurredAt) {
+				t.Errorf("Decode = %+v, want %+v", got, e)
+			}
+			if got.Key() != tt.key {
+				t.Errorf("Key = %q, want %q", got.Key(), tt.key)
+			}
+
+			var payload interface{}
+			switch tt.t.Topic() {
+			case TopicUserUpdates:
+				payload, err = got.User()
+			case TopicProductUpdates:
+				payload, err = got.Product()
+			case TopicUserErasure:
+				payload, err = got.Erasure()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if payload != tt.payload {
+				t.Errorf("payload = %+v, want %+v", payload, tt.payload)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// Сообщения до введения конверта: плоский JSON с текстовым полем action.
+// Они могут оставаться в топиках и в outbox, поэтому Decode их поддерживает.
+type legacyMessage struct {
+	Action             string          `json:"action"`
+	UserID             int             `json:"user_id"`
+	Email              string          `json:"email"`
+	Name               string          `json:"name"`
+	ProductID          json.RawMessage `json:"product_id"`
+	ProductCategory    string          `json:"product_category"`
+	NumberOfLikes      int             `json:"number_of_likes"`
+	ProductDescription string          `json:"description"`
+}
+
+var legacyActions = map[string]Type{
+	"new user":            UserCreated,
+	"update user info":    UserUpdated,
+	"product created":     ProductCreated,
+	"product updated":     ProductUpdated,
+	"product info update": ProductUpdated,
+	"product deleted":     ProductDeleted,
+	"like":                ProductLiked,
+	"unlike":              ProductUnliked,
+}
+
+func decodeLegacy(data []byte) (Envelope, error) {
+	var m legacyMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return Envelope{}, err
+	}
+	t, ok := legacyActions[m.Action]
+	if !ok {
+		return Envelope{}, fmt.Errorf("%w: legacy action %q", ErrUnknownType, m.Action)
+	}
+
+	var payload interface{}
+	if t.Topic() == TopicUserUpdates {
+		payload = UserPayload{UserID: m.UserID, Email: m.Email, Name: m.Name}
+	} else {
+		productID, err := legacyProductID(m.ProductID)
+		if err != nil {
+			return Envelope{}, err
+		}
+		payload = ProductPayload{
+			ProductID:   productID,
+			UserID:      m.UserID,
+			Name:        m.Name,
+			Description: m.ProductDescription,
+			Category:    m.ProductCategory,
+			Likes:       m.NumberOfLikes,
+		}
+	}
+
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return Envelope{}, err
+	}
+	// У старых сообщений нет ни ID, ни времени: консьюмеры должны быть к этому готовы
+	return Envelope{Type: t, Version: SchemaVersion, Payload: raw}, nil
+}
+
+// В старом формате product_id передавался строкой
+func legacyProductID(raw json.RawMessage) (int, error) {
+	if len(raw) == 0 {
+		return 0, nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return strconv.Atoi(s)
+	}
+	var id int
+	err := json.Unmarshal(raw, &id)
+	return id, err
+}
@@ -0,0 +1,112 @@
+// Package health эндпоинты /health и /ready, общие для всех сервисов.
+//
+// /health (liveness) отвечает, пока процесс обслуживает HTTP. /ready (readiness)
+// проверяет зависимости сервиса: проверки выполняются параллельно с общим сроком
+// CheckTimeout, поэтому ответ не дольше самой медленной проверки и не дольше срока.
+// Если хотя бы одна зависимость недоступна, ответ 503.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// CheckTimeout общий срок всех проверок readiness
+const CheckTimeout = 2 * time.Second
+
+// Check проверяет одну зависимость; должен завершиться к сроку ctx
+type Check func(ctx context.Context) error
+
+type DependencyStatus struct {
+	Status    string `json:"status"`
+	LatencyMs int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+type ReadinessResponse struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]DependencyStatus `json:"dependencies"`
+}
+
+// Live обработчик liveness: процесс жив и обслуживает HTTP
+func Live(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// WriteReadiness выполняет проверки и пишет ответ readiness
+func WriteReadiness(w http.ResponseWriter, r *http.Request, checks map[string]Check) {
+	response := Run(r.Context(), checks)
+
+	w.Header().Set("Content-Type", "application/json")
+	if response.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Run выполняет проверки параллельно. Проверка, не уложившаяся в срок,
+// считается недоступной; ее горутина завершится сама, результат отбрасывается.
+func Run(parent context.Context, checks map[string]Check) ReadinessResponse {
+	ctx, cancel := context.WithTimeout(parent, CheckTimeout)
+	defer cancel()
+
+	type result struct {
+		name   string
+		status DependencyStatus
+	}
+	// Буфер на все проверки, чтобы опоздавшие не блокировались на отправке
+	results := make(chan result, len(checks))
+	start := time.Now()
+	for name, check := range checks {
+		go func(name string, check Check) {
+			results <- result{name, status(check(ctx), start)}
+		}(name, check)
+	}
+
+	response := ReadinessResponse{Status: "ok", Dependencies: make(map[string]DependencyStatus, len(checks))}
+collect:
+	for range checks {
+		select {
+		case res := <-results:
+			response.Dependencies[res.name] = res.status
+		case <-ctx.Done():
+			break collect
+		}
+	}
+	for name := range checks {
+		if _, ok := response.Dependencies[name]; !ok {
+			response.Dependencies[name] = status(ctx.Err(), start)
+		}
+	}
+	for _, dependency := range response.Dependencies {
+		if dependency.Status != "ok" {
+			response.Status = "unavailable"
+		}
+	}
+	return response
+}
+
+func status(err error, start time.Time) DependencyStatus {
+	s := DependencyStatus{Status: "ok", LatencyMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		s.Status = "down"
+		s.Error = err.Error()
+	}
+	return s
+}
+
+// RemainingMs сколько миллисекунд осталось до срока ctx; для клиентов, которые
+// принимают таймаут числом, а не контекстом (метаданные Kafka)
+func RemainingMs(ctx context.Context) int {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return int(CheckTimeout.Milliseconds())
+	}
+	if ms := time.Until(deadline).Milliseconds(); ms > 0 {
+		return int(ms)
+	}
+	return 1
+}
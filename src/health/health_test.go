@@ -0,0 +1,75 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	ok := func(ctx context.Context) error { return nil }
+	failing := func(ctx context.Context) error { return errors.New("connection refused") }
+	hanging := func(ctx context.Context) error {
+		time.Sleep(CheckTimeout + time.Second)
+		return nil
+	}
+
+	tests := []struct {
+		name   string
+		checks map[string]Check
+		status string
+		down   []string
+	}{
+		{"all ok", map[string]Check{"postgres": ok, "redis": ok}, "ok", nil},
+		{"one down", map[string]Check{"postgres": ok, "kafka": failing}, "unavailable", []string{"kafka"}},
+		{"deadline", map[string]Check{"postgres": ok, "kafka": hanging}, "unavailable", []string{"kafka"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			response := Run(context.Background(), tt.checks)
+			if elapsed := time.Since(start); elapsed > CheckTimeout+500*time.Millisecond {
+				t.Errorf("Run took %v, want at most %v", elapsed, CheckTimeout)
+			}
+			if response.Status != tt.status {
+				t.Errorf("status = %q, want %q", response.Status, tt.status)
+			}
+			if len(response.Dependencies) != len(tt.checks) {
+				t.Errorf("dependencies = %v, want %d entries", response.Dependencies, len(tt.checks))
+			}
+			for _, name := range tt.down {
+				if d := response.Dependencies[name]; d.Status != "down" || d.Error == "" {
+					t.Errorf("%s = %+v, want down with error", name, d)
+				}
+			}
+		})
+	}
+}
+
+func TestRunIsConcurrent(t *testing.T) {
+	slow := func(ctx context.Context) error {
+		time.Sleep(300 * time.Millisecond)
+		return nil
+	}
+	start := time.Now()
+	response := Run(context.Background(), map[string]Check{"a": slow, "b": slow, "c": slow})
+	if elapsed := time.Since(start); elapsed > 800*time.Millisecond {
+		t.Errorf("Run took %v, checks are not concurrent", elapsed)
+	}
+	if response.Status != "ok" {
+		t.Errorf("status = %q, want ok", response.Status)
+	}
+}
+
+func TestWriteReadinessStatusCode(t *testing.T) {
+	rec := httptest.NewRecorder()
+	WriteReadiness(rec, httptest.NewRequest(http.MethodGet, "/ready", nil), map[string]Check{
+		"postgres": func(ctx context.Context) error { return errors.New("down") },
+	})
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("code = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
@@ -18,28 +18,205 @@ CREATE TABLE users (
     name VARCHAR(100),
     email VARCHAR(100) UNIQUE NOT NULL,
     pass VARCHAR(255),
-    role VARCHAR(50)
+    role VARCHAR(50),
+    -- NULL, пока email не подтвержден
+    email_verified_at TIMESTAMPTZ,
+    -- Новый email, ожидающий подтверждения
+    pending_email VARCHAR(100),
+    -- Заблокированный аккаунт не может войти
+    suspended_at TIMESTAMPTZ,
+    -- Вход временно заблокирован после серии неудачных попыток
+    locked_until TIMESTAMPTZ
 );
 
-INSERT INTO users (name, email, pass, role) VALUES
-('admin', 'admin@site.com', '$2a$10$K5VW.PoACy52RYwBABqjPu.RECC7Ln5BS4xO9pMnPUi8atgIDtkue', 'admin');
+-- Адреса хранятся в нижнем регистре; индекс не дает завести второй аккаунт
+-- на тот же адрес в другом регистре и обслуживает поиск по lower(email)
+CREATE UNIQUE INDEX users_email_lower_idx ON users (lower(email));
+
+CREATE INDEX users_name_idx ON users (lower(name));
+
+INSERT INTO users (name, email, pass, role, email_verified_at) VALUES
+('admin', 'admin@site.com', '$2a$10$K5VW.PoACy52RYwBABqjPu.RECC7Ln5BS4xO9pMnPUi8atgIDtkue', 'admin', now());
+
+-- Transactional outbox: события для Kafka, записанные в одной транзакции с изменением данных.
+-- aggregate_key — ключ сущности события (user:<id>, product:<id>): события одного ключа
+-- публикуются строго по порядку id
+CREATE TABLE outbox (
+    id BIGSERIAL PRIMARY KEY,
+    topic VARCHAR(100) NOT NULL,
+    aggregate_key VARCHAR(100) NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    delivered_at TIMESTAMPTZ,
+    last_error TEXT
+);
+
+CREATE INDEX outbox_pending_idx ON outbox (next_attempt_at) WHERE delivered_at IS NULL;
+CREATE INDEX outbox_key_pending_idx ON outbox (aggregate_key, id) WHERE delivered_at IS NULL;
+
+-- Сессии: одна запись на вход с устройством и IP. expires_at продлевается
+-- вместе с refresh-токеном, last_seen_at — при каждом обновлении токена доступа.
+CREATE TABLE sessions (
+    id VARCHAR(64) PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    user_agent TEXT NOT NULL DEFAULT '',
+    ip VARCHAR(45) NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_seen_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX sessions_user_idx ON sessions (user_id);
+
+-- Refresh-токены хранятся в виде SHA-256; family_id объединяет токены одного входа (сессию)
+CREATE TABLE refresh_tokens (
+    id BIGSERIAL PRIMARY KEY,
+    token_hash CHAR(64) UNIQUE NOT NULL,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    family_id VARCHAR(64) NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX refresh_tokens_family_idx ON refresh_tokens (family_id);
+
+-- Одноразовые токены сброса пароля, хранятся в виде SHA-256
+CREATE TABLE password_reset_tokens (
+    id BIGSERIAL PRIMARY KEY,
+    token_hash CHAR(64) UNIQUE NOT NULL,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ
+);
+
+CREATE INDEX password_reset_tokens_user_idx ON password_reset_tokens (user_id);
+
+-- Внешние учетные записи OpenID Connect, связанные с пользователем.
+-- Пользователь, созданный при входе через провайдера, может не иметь пароля.
+CREATE TABLE user_identities (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    provider VARCHAR(50) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(100),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_login_at TIMESTAMPTZ,
+    UNIQUE (provider, subject)
+);
+
+CREATE INDEX user_identities_user_idx ON user_identities (user_id);
+
+-- Секрет TOTP; 2FA включена, когда confirmed_at задан.
+-- last_used_step не дает использовать один код дважды.
+CREATE TABLE user_totp (
+    user_id INT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    secret VARCHAR(64) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    confirmed_at TIMESTAMPTZ,
+    last_used_step BIGINT
+);
+
+-- Одноразовые коды восстановления, хранятся только SHA-256
+CREATE TABLE recovery_codes (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash CHAR(64) NOT NULL,
+    used_at TIMESTAMPTZ
+);
+
+CREATE INDEX recovery_codes_user_idx ON recovery_codes (user_id);
+
+-- Удаление аккаунта: сага по сервисам. user_id без внешнего ключа: строка
+-- пользователя удаляется сразу, а запись о ходе удаления остается.
+CREATE TABLE account_deletions (
+    id VARCHAR(64) PRIMARY KEY,
+    user_id INT NOT NULL,
+    requested_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    completed_at TIMESTAMPTZ
+);
+
+-- Шаг саги: стирание данных в одном сервисе (pending, failed, done)
+CREATE TABLE account_deletion_steps (
+    deletion_id VARCHAR(64) NOT NULL REFERENCES account_deletions(id) ON DELETE CASCADE,
+    service VARCHAR(50) NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    attempts INT NOT NULL DEFAULT 1,
+    next_attempt_at TIMESTAMPTZ NOT NULL,
+    last_error TEXT,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    completed_at TIMESTAMPTZ,
+    PRIMARY KEY (deletion_id, service)
+);
+
+CREATE INDEX account_deletion_steps_retry_idx ON account_deletion_steps (next_attempt_at) WHERE status <> 'done';
+
+-- Выгрузки персональных данных. Архив хранится до expires_at, затем удаляется;
+-- незавершенная выгрузка у пользователя одна.
+CREATE TABLE data_exports (
+    id VARCHAR(64) PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    status VARCHAR(20) NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_error TEXT,
+    archive BYTEA,
+    requested_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    completed_at TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX data_exports_active_idx ON data_exports (user_id) WHERE status IN ('pending', 'running');
+CREATE INDEX data_exports_expiry_idx ON data_exports (expires_at) WHERE status = 'ready';
 
 \connect products_db;
 
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
 CREATE TABLE products (
     id SERIAL PRIMARY KEY,
-    name VARCHAR(100),
+    name VARCHAR(100) NOT NULL DEFAULT '',
     description VARCHAR(100),
-    price VARCHAR(50),
+    -- Целое число, чтобы фильтровать и сортировать по цене
+    price INT NOT NULL DEFAULT 0,
     category VARCHAR(50),
-    likes INT
+    likes INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    -- Лексемы названия, категории и описания для полнотекстового поиска;
+    -- пересчитываются сервисом при добавлении и изменении продукта
+    search_vector TSVECTOR NOT NULL DEFAULT ''
 );
 
+-- Каталог: пагинация по курсору (поле сортировки, id), с фильтром по категории и без
+CREATE INDEX products_likes_idx ON products (likes, id);
+CREATE INDEX products_price_idx ON products (price, id);
+CREATE INDEX products_name_idx ON products (name, id);
+CREATE INDEX products_created_idx ON products (created_at, id);
+CREATE INDEX products_category_likes_idx ON products (category, likes, id);
+CREATE INDEX products_category_price_idx ON products (category, price, id);
+CREATE INDEX products_category_name_idx ON products (category, name, id);
+CREATE INDEX products_category_created_idx ON products (category, created_at, id);
+
+-- Поиск: лексемы и триграммы названия для нечетких совпадений и подсказок
+CREATE INDEX products_search_idx ON products USING GIN (search_vector);
+CREATE INDEX products_name_trgm_idx ON products USING GIN (lower(name) gin_trgm_ops);
+
 INSERT INTO products (name, description, price, category, likes) VALUES
 ('Продукт 1', 'cool product 1', '10', 'c1', 10),
 ('Продукт 2', 'cool product 2', '20', 'c2', 20),
 ('Продукт 3', 'cool product 3', '30', 'c3', 30);
 
+-- То же выражение, что searchVectorExpr в products/handler/search.go
+UPDATE products SET search_vector =
+    setweight(to_tsvector('russian', COALESCE(name, '')), 'A') ||
+    setweight(to_tsvector('russian', COALESCE(category, '')), 'B') ||
+    setweight(to_tsvector('russian', COALESCE(description, '')), 'C');
+
 CREATE TABLE likes (
     id SERIAL PRIMARY KEY,
     user_id INT NOT NULL,
@@ -47,6 +224,24 @@ CREATE TABLE likes (
     CONSTRAINT unique_like UNIQUE (user_id, product_id)
 );
 
+-- Transactional outbox: события для Kafka, записанные в одной транзакции с изменением данных.
+-- aggregate_key — ключ сущности события (user:<id>, product:<id>): события одного ключа
+-- публикуются строго по порядку id
+CREATE TABLE outbox (
+    id BIGSERIAL PRIMARY KEY,
+    topic VARCHAR(100) NOT NULL,
+    aggregate_key VARCHAR(100) NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    delivered_at TIMESTAMPTZ,
+    last_error TEXT
+);
+
+CREATE INDEX outbox_pending_idx ON outbox (next_attempt_at) WHERE delivered_at IS NULL;
+CREATE INDEX outbox_key_pending_idx ON outbox (aggregate_key, id) WHERE delivered_at IS NULL;
+
 \connect recommends_db;
 
 CREATE TABLE products (
@@ -59,41 +254,109 @@ CREATE TABLE likes (
     id SERIAL PRIMARY KEY,
     user_id INT NOT NULL,
     product_id INT NOT NULL,
-    FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE
+    FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE,
+    CONSTRAINT unique_like UNIQUE (user_id, product_id)
+);
+
+CREATE INDEX likes_product_idx ON likes (product_id);
+
+-- Матрица совместных лайков для item-to-item рекомендаций, хранится в обе стороны
+CREATE TABLE product_cooccurrence (
+    product_a INT NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    product_b INT NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    common_likes INT NOT NULL,
+    PRIMARY KEY (product_a, product_b)
 );
 
+-- Ранжированный список рекомендаций для пары (пользователь, продукт), rank с 1
 CREATE TABLE recommendations (
     user_id INT,
     product_id INT,
-    recommendation1 INT,
-    recommendation2 INT,
-    recommendation3 INT,
-    PRIMARY KEY (user_id, product_id)
+    rank INT,
+    recommended_id INT NOT NULL,
+    score DOUBLE PRECISION NOT NULL DEFAULT 0,
+    reason VARCHAR(100) NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, product_id, rank)
 );
 
+CREATE INDEX recommendations_recommended_idx ON recommendations (recommended_id);
+
+-- Удаленные пользователи: их лайки, пришедшие после стирания, пропускаются
+CREATE TABLE erased_users (
+    user_id INT PRIMARY KEY,
+    erased_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Копия каталога products_db, дальше поддерживается событиями из product_updates
 INSERT INTO products (id, category, likes) VALUES
-(3, 'c3', 30),
-(2, 'c2', 22),
-(4, 'c4', 0),
-(1, 'c1', 9);
+(1, 'c1', 10),
+(2, 'c2', 20),
+(3, 'c3', 30);
 
 \connect analytics_db;
 
+-- Журналы событий: только добавление. Повторная доставка отсекается
+-- по event_id и по позиции сообщения в Kafka.
 CREATE TABLE user_actions (
-    id SERIAL PRIMARY KEY,
+    id BIGSERIAL PRIMARY KEY,
+    event_id UUID UNIQUE,
+    kafka_topic VARCHAR(100) NOT NULL,
+    kafka_partition INT NOT NULL,
+    kafka_offset BIGINT NOT NULL,
     user_id INT,
     action VARCHAR(100),
     name VARCHAR(100),
-    email VARCHAR(100) UNIQUE NOT NULL
+    email VARCHAR(100),
+    occurred_at TIMESTAMPTZ NOT NULL,
+    ingested_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT user_actions_kafka_position UNIQUE (kafka_topic, kafka_partition, kafka_offset)
 );
 
+CREATE INDEX user_actions_user_occurred_idx ON user_actions (user_id, occurred_at);
+
 CREATE TABLE product_actions (
-    id SERIAL PRIMARY KEY,
+    id BIGSERIAL PRIMARY KEY,
+    event_id UUID UNIQUE,
+    kafka_topic VARCHAR(100) NOT NULL,
+    kafka_partition INT NOT NULL,
+    kafka_offset BIGINT NOT NULL,
     product_id INT,
     user_id INT,
     name VARCHAR(100),
     description VARCHAR(100),
     action VARCHAR(50),
     category VARCHAR(50),
-    likes INT
+    likes INT,
+    occurred_at TIMESTAMPTZ NOT NULL,
+    ingested_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT product_actions_kafka_position UNIQUE (kafka_topic, kafka_partition, kafka_offset)
+);
+
+CREATE INDEX product_actions_occurred_idx ON product_actions (occurred_at);
+CREATE INDEX product_actions_product_occurred_idx ON product_actions (product_id, occurred_at);
+
+-- Сообщения, которые не удалось разобрать или записать без повторов
+CREATE TABLE dead_letters (
+    id BIGSERIAL PRIMARY KEY,
+    kafka_topic VARCHAR(100) NOT NULL,
+    kafka_partition INT NOT NULL,
+    kafka_offset BIGINT NOT NULL,
+    payload BYTEA NOT NULL,
+    error TEXT NOT NULL,
+    failed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT dead_letters_kafka_position UNIQUE (kafka_topic, kafka_partition, kafka_offset)
 );
+
+-- Текущее состояние пользователей, собирается из user_actions
+CREATE TABLE users (
+    user_id INT PRIMARY KEY,
+    name VARCHAR(100),
+    email VARCHAR(100),
+    registered_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ NOT NULL,
+    -- Пользователь удален, имя и email стерты
+    deleted_at TIMESTAMPTZ
+);
+
+CREATE INDEX users_registered_idx ON users (registered_at);
@@ -0,0 +1,11 @@
+module outbox
+
+go 1.23.1
+
+require github.com/confluentinc/confluent-kafka-go v1.9.2
+
+require github.com/DATA-DOG/go-sqlmock v1.5.2
+
+require events v0.0.0
+
+replace events => ../events
@@ -0,0 +1,200 @@
+// Package outbox transactional outbox для сервисов, публикующих события.
+//
+// События пишутся в таблицу outbox в той же транзакции, что и бизнес-изменение,
+// а Relay публикует их в Kafka. Строка помечается доставленной только по
+// delivery report, поэтому доставка at-least-once.
+//
+// Порядок: у каждой строки есть ключ сущности (Envelope.Key). Relay забирает
+// только самое раннее недоставленное событие каждого ключа, поэтому событие,
+// ожидающее повтора после ошибки, задерживает следующие события той же сущности,
+// а не пропускает их вперед. Ключ же становится ключом сообщения Kafka, и события
+// одной сущности попадают в одну партицию.
+package outbox
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"events"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+const (
+	pollInterval    = time.Second
+	batchSize       = 100
+	lease           = 30 * time.Second // на это время выбранные строки скрыты от других relay
+	deliveryTimeout = 10 * time.Second
+	maxBackoff      = 5 * time.Minute
+	retention       = 7 * 24 * time.Hour
+	cleanupInterval = time.Hour
+)
+
+// Producer часть *kafka.Producer, которой пользуется Relay
+type Producer interface {
+	Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error
+}
+
+type event struct {
+	ID      int64
+	Topic   string
+	Key     string
+	Payload []byte
+}
+
+// Enqueue сохраняет событие сервиса producer в outbox в рамках переданной транзакции
+func Enqueue(tx *sql.Tx, producer string, eventType events.Type, payload interface{}) error {
+	envelope, err := events.New(producer, eventType, payload)
+	if err != nil {
+		return err
+	}
+	data, err := envelope.Encode()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO outbox (topic, aggregate_key, payload) VALUES ($1, $2, $3)",
+		eventType.Topic(), envelope.Key(), data)
+	return err
+}
+
+// Relay публикует события из таблицы outbox базы db
+type Relay struct {
+	db       *sql.DB
+	producer Producer
+}
+
+func NewRelay(db *sql.DB, producer Producer) *Relay {
+	return &Relay{db: db, producer: producer}
+}
+
+// Run бесконечно публикует накопившиеся события
+func (r *Relay) Run() {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	lastCleanup := time.Now()
+	for range ticker.C {
+		for r.relayBatch() == batchSize {
+			// Очередь не пуста, забираем следующую пачку сразу
+		}
+		if time.Since(lastCleanup) > cleanupInterval {
+			r.cleanup()
+			lastCleanup = time.Now()
+		}
+	}
+}
+
+// relayBatch публикует одну пачку событий и возвращает её размер
+func (r *Relay) relayBatch() int {
+	batch, err := r.claim()
+	if err != nil {
+		log.Printf("Outbox: error claiming events: %v", err)
+		return 0
+	}
+	if len(batch) == 0 {
+		return 0
+	}
+
+	deliveryChan := make(chan kafka.Event, len(batch))
+	pending := 0
+	for _, e := range batch {
+		topic := e.Topic
+		err := r.producer.Produce(&kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+			Key:            []byte(e.Key),
+			Value:          e.Payload,
+			Opaque:         e.ID,
+		}, deliveryChan)
+		if err != nil {
+			r.markFailed(e.ID, err)
+			continue
+		}
+		pending++
+	}
+
+	timeout := time.After(deliveryTimeout)
+	for pending > 0 {
+		select {
+		case ev := <-deliveryChan:
+			m, ok := ev.(*kafka.Message)
+			if !ok {
+				continue
+			}
+			pending--
+			id, _ := m.Opaque.(int64)
+			if m.TopicPartition.Error != nil {
+				r.markFailed(id, m.TopicPartition.Error)
+			} else {
+				r.markDelivered(id)
+			}
+		case <-timeout:
+			// Неподтвержденные строки вернутся в работу после истечения аренды
+			log.Printf("Outbox: %d delivery reports timed out", pending)
+			return len(batch)
+		}
+	}
+	return len(batch)
+}
+
+// claim забирает пачку недоставленных событий, продлевая их аренду. Из каждого
+// ключа берется только самое раннее недоставленное событие: пока оно не доставлено
+// (в том числе пока ждет повтора или арендовано другим relay), следующие ждут.
+func (r *Relay) claim() ([]event, error) {
+	rows, err := r.db.Query(`UPDATE outbox SET next_attempt_at = now() + $1 * interval '1 second'
+		WHERE id IN (
+			SELECT o.id FROM outbox o
+			WHERE o.delivered_at IS NULL AND o.next_attempt_at <= now()
+				AND NOT EXISTS (
+					SELECT 1 FROM outbox earlier
+					WHERE earlier.aggregate_key = o.aggregate_key AND earlier.delivered_at IS NULL AND earlier.id < o.id
+				)
+			ORDER BY o.id
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, topic, aggregate_key, payload`, lease.Seconds(), batchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []event
+	for rows.Next() {
+		var e event
+		if err := rows.Scan(&e.ID, &e.Topic, &e.Key, &e.Payload); err != nil {
+			return nil, err
+		}
+		batch = append(batch, e)
+	}
+	return batch, rows.Err()
+}
+
+func (r *Relay) markDelivered(id int64) {
+	_, err := r.db.Exec("UPDATE outbox SET delivered_at = now(), last_error = NULL WHERE id = $1", id)
+	if err != nil {
+		log.Printf("Outbox: error marking event %d delivered: %v", id, err)
+	}
+}
+
+// markFailed откладывает повтор с экспоненциальной задержкой
+func (r *Relay) markFailed(id int64, cause error) {
+	if cause == nil {
+		cause = errors.New("unknown delivery error")
+	}
+	_, err := r.db.Exec(`UPDATE outbox SET attempts = attempts + 1, last_error = $2,
+		next_attempt_at = now() + LEAST(power(2, attempts), $3) * interval '1 second'
+		WHERE id = $1`, id, cause.Error(), maxBackoff.Seconds())
+	if err != nil {
+		log.Printf("Outbox: error rescheduling event %d: %v", id, err)
+	}
+	log.Printf("Outbox: delivery of event %d failed: %v", id, cause)
+}
+
+func (r *Relay) cleanup() {
+	_, err := r.db.Exec("DELETE FROM outbox WHERE delivered_at < now() - $1 * interval '1 second'", retention.Seconds())
+	if err != nil {
+		log.Printf("Outbox: error cleaning up delivered events: %v", err)
+	}
+}
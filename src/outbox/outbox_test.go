@@ -0,0 +1,161 @@
+package outbox
+
+import (
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"testing"
+
+	"events"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// fakeProducer сразу отвечает delivery report; ошибки доставки и вызова Produce
+// задаются по ключу сообщения
+type fakeProducer struct {
+	produced   []*kafka.Message
+	failReport map[string]error
+	failCall   map[string]error
+}
+
+func (p *fakeProducer) Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error {
+	if err := p.failCall[string(msg.Key)]; err != nil {
+		return err
+	}
+	p.produced = append(p.produced, msg)
+	report := *msg
+	report.TopicPartition.Error = p.failReport[string(msg.Key)]
+	deliveryChan <- &report
+	return nil
+}
+
+// envelopeOf проверяет, что аргумент запроса — закодированный конверт события типа t
+type envelopeOf events.Type
+
+func (want envelopeOf) Match(v driver.Value) bool {
+	data, ok := v.([]byte)
+	if !ok {
+		return false
+	}
+	e, err := events.Decode(data)
+	return err == nil && e.Type == events.Type(want) && e.Producer == "users"
+}
+
+func TestEnqueue(t *testing.T) {
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO outbox (topic, aggregate_key, payload)")).
+		WithArgs(events.TopicUserUpdates, "user:7", envelopeOf(events.UserCreated)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	tx, err := conn.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Enqueue(tx, "users", events.UserCreated, events.UserPayload{UserID: 7}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClaimTakesOldestPendingEventPerKey(t *testing.T) {
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Аренда продлевается на lease, из каждого ключа берется только событие без
+	// более ранних недоставленных, строки чужих relay пропускаются
+	mock.ExpectQuery(`UPDATE outbox SET next_attempt_at = now\(\) \+ \$1 \* interval '1 second'(.|\n)*` +
+		`NOT EXISTS(.|\n)*earlier\.aggregate_key = o\.aggregate_key AND earlier\.delivered_at IS NULL AND earlier\.id < o\.id(.|\n)*` +
+		`ORDER BY o\.id(.|\n)*FOR UPDATE SKIP LOCKED`).
+		WithArgs(lease.Seconds(), batchSize).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "topic", "aggregate_key", "payload"}).
+			AddRow(1, "user_updates", "user:1", []byte(`{}`)).
+			AddRow(4, "product_updates", "product:2", []byte(`{}`)))
+
+	batch, err := NewRelay(conn, nil).claim()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch) != 2 || batch[0].ID != 1 || batch[1].Key != "product:2" {
+		t.Errorf("claim = %+v", batch)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRelayBatch(t *testing.T) {
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	mock.ExpectQuery("UPDATE outbox SET next_attempt_at").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "topic", "aggregate_key", "payload"}).
+			AddRow(1, "user_updates", "user:1", []byte(`{"n":1}`)).
+			AddRow(2, "product_updates", "product:2", []byte(`{"n":2}`)).
+			AddRow(3, "product_updates", "product:3", []byte(`{"n":3}`)))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE outbox SET delivered_at = now(), last_error = NULL WHERE id = $1")).
+		WithArgs(int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// Повтор откладывается с экспоненциальной задержкой, но не дольше maxBackoff
+	backoff := regexp.QuoteMeta("next_attempt_at = now() + LEAST(power(2, attempts), $3) * interval '1 second'")
+	mock.ExpectExec(backoff).
+		WithArgs(int64(2), "broker down", maxBackoff.Seconds()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(backoff).
+		WithArgs(int64(3), "queue full", maxBackoff.Seconds()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	producer := &fakeProducer{
+		failReport: map[string]error{"product:2": errors.New("broker down")},
+		failCall:   map[string]error{"product:3": errors.New("queue full")},
+	}
+	if n := NewRelay(conn, producer).relayBatch(); n != 3 {
+		t.Errorf("relayBatch = %d, want 3", n)
+	}
+	if len(producer.produced) != 2 {
+		t.Fatalf("produced %d messages, want 2", len(producer.produced))
+	}
+	for i, key := range []string{"user:1", "product:2"} {
+		m := producer.produced[i]
+		if string(m.Key) != key || *m.TopicPartition.Topic == "" {
+			t.Errorf("message %d = key %q topic %q, want key %q", i, m.Key, *m.TopicPartition.Topic, key)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRelayBatchEmpty(t *testing.T) {
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	mock.ExpectQuery("UPDATE outbox SET next_attempt_at").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "topic", "aggregate_key", "payload"}))
+	if n := NewRelay(conn, &fakeProducer{}).relayBatch(); n != 0 {
+		t.Errorf("relayBatch = %d, want 0", n)
+	}
+}
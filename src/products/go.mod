@@ -8,3 +8,23 @@ require (
 )
 
 require github.com/confluentinc/confluent-kafka-go v1.9.2
+
+require (
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/go-redis/redis/v8 v8.11.5 // indirect
+)
+
+require (
+	auth v0.0.0
+	events v0.0.0
+	health v0.0.0
+	outbox v0.0.0
+)
+
+replace (
+	auth => ../auth
+	events => ../events
+	health => ../health
+	outbox => ../outbox
+)
@@ -0,0 +1,255 @@
+package phandler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"products/db"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Каталог: постраничный список продуктов с фильтрами по категории и цене.
+// Пагинация по курсору (keyset): курсор хранит значение поля сортировки и id
+// последнего продукта страницы, поэтому вставки и удаления между запросами не
+// сдвигают страницы. Для каждой сортировки есть индекс (поле, id) и (category, поле, id).
+
+const (
+	catalogDefaultLimit = 20
+	catalogMaxLimit     = 100
+)
+
+// catalogSort поле сортировки; cast — тип значения из курсора для сравнения в SQL
+type catalogSort struct {
+	column string
+	cast   string
+	desc   bool
+}
+
+var catalogSorts = map[string]catalogSort{
+	"likes":      {column: "likes", cast: "int", desc: true},
+	"price":      {column: "price", cast: "int"},
+	"price_desc": {column: "price", cast: "int", desc: true},
+	"name":       {column: "name", cast: "text"},
+	"newest":     {column: "created_at", cast: "timestamptz", desc: true},
+}
+
+const catalogDefaultSort = "likes"
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// CatalogQuery параметры списка; nil у цены — без ограничения
+type CatalogQuery struct {
+	Category string
+	MinPrice *int
+	MaxPrice *int
+	Sort     string
+	Limit    int
+	Cursor   *catalogCursor
+}
+
+// catalogCursor последний продукт предыдущей страницы; курсор действует только для своей сортировки
+type catalogCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    int    `json:"id"`
+}
+
+type CatalogPage struct {
+	Items      []Product `json:"items"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// parseCatalogQuery читает category, min_price, max_price, sort, limit и cursor
+func parseCatalogQuery(values url.Values) (CatalogQuery, error) {
+	q := CatalogQuery{
+		Category: strings.TrimSpace(values.Get("category")),
+		Sort:     values.Get("sort"),
+		Limit:    catalogDefaultLimit,
+	}
+	if q.Sort == "" {
+		q.Sort = catalogDefaultSort
+	}
+	if _, ok := catalogSorts[q.Sort]; !ok {
+		return q, fmt.Errorf("unknown sort %q", q.Sort)
+	}
+
+	for _, bound := range []struct {
+		name   string
+		target **int
+	}{{"min_price", &q.MinPrice}, {"max_price", &q.MaxPrice}} {
+		v := values.Get(bound.name)
+		if v == "" {
+			continue
+		}
+		price, err := strconv.Atoi(v)
+		if err != nil || price < 0 {
+			return q, fmt.Errorf("invalid %s", bound.name)
+		}
+		*bound.target = &price
+	}
+	if q.MinPrice != nil && q.MaxPrice != nil && *q.MinPrice > *q.MaxPrice {
+		return q, errors.New("min_price is greater than max_price")
+	}
+
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > catalogMaxLimit {
+			return q, fmt.Errorf("limit must be between 1 and %d", catalogMaxLimit)
+		}
+		q.Limit = limit
+	}
+
+	if v := values.Get("cursor"); v != "" {
+		cursor, err := decodeCatalogCursor(v)
+		if err != nil || cursor.Sort != q.Sort {
+			return q, errInvalidCursor
+		}
+		q.Cursor = &cursor
+	}
+	return q, nil
+}
+
+func encodeCatalogCursor(c catalogCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCatalogCursor(s string) (catalogCursor, error) {
+	var c catalogCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// catalogSQL запрос страницы; выбирается на одну строку больше, чтобы понять, есть ли следующая
+func catalogSQL(q CatalogQuery) (string, []interface{}) {
+	sort := catalogSorts[q.Sort]
+	var where []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if q.Category != "" {
+		where = append(where, "category = "+arg(q.Category))
+	}
+	if q.MinPrice != nil {
+		where = append(where, "price >= "+arg(*q.MinPrice))
+	}
+	if q.MaxPrice != nil {
+		where = append(where, "price <= "+arg(*q.MaxPrice))
+	}
+	direction, op := "ASC", ">"
+	if sort.desc {
+		direction, op = "DESC", "<"
+	}
+	if q.Cursor != nil {
+		where = append(where, fmt.Sprintf("(%s, id) %s (%s::%s, %s)", sort.column, op, arg(q.Cursor.Value), sort.cast, arg(q.Cursor.ID)))
+	}
+
+	query := "SELECT id, name, COALESCE(description, ''), price, COALESCE(category, ''), likes, created_at FROM products"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT %s", sort.column, direction, direction, arg(q.Limit+1))
+	return query, args
+}
+
+// cursorValue значение поля сортировки продукта в виде, который примет SQL-приведение
+func cursorValue(sort string, p Product) string {
+	switch catalogSorts[sort].column {
+	case "likes":
+		return strconv.Itoa(p.Likes)
+	case "price":
+		return strconv.Itoa(p.Price)
+	case "name":
+		return p.Name
+	default:
+		return p.CreatedAt.Format(time.RFC3339Nano)
+	}
+}
+
+func listCatalog(q CatalogQuery) (CatalogPage, error) {
+	page := CatalogPage{Items: []Product{}}
+	query, args := catalogSQL(q)
+	rows, err := db.GetDB().Query(query, args...)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p Product
+		if err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.Price, &p.Category, &p.Likes, &p.CreatedAt); err != nil {
+			return page, err
+		}
+		page.Items = append(page.Items, p)
+	}
+	if err := rows.Err(); err != nil {
+		return page, err
+	}
+
+	if len(page.Items) > q.Limit {
+		page.Items = page.Items[:q.Limit]
+		last := page.Items[len(page.Items)-1]
+		page.NextCursor = encodeCatalogCursor(catalogCursor{Sort: q.Sort, Value: cursorValue(q.Sort, last), ID: last.ID})
+	}
+	return page, nil
+}
+
+// catalogCategories категории для фильтра на странице каталога
+func catalogCategories() ([]string, error) {
+	rows, err := db.GetDB().Query("SELECT DISTINCT category FROM products WHERE category IS NOT NULL AND category <> '' ORDER BY category")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var categories []string
+	for rows.Next() {
+		var category string
+		if err := rows.Scan(&category); err != nil {
+			return nil, err
+		}
+		categories = append(categories, category)
+	}
+	return categories, rows.Err()
+}
+
+// JSON-версия каталога
+func listProducts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := parseCatalogQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := listCatalog(q)
+	if err != nil {
+		http.Error(w, "Could not list products", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// parsePrice цена продукта из формы: целое неотрицательное число
+func parsePrice(v string) (int, error) {
+	price, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || price < 0 {
+		return 0, errors.New("invalid price")
+	}
+	return price, nil
+}
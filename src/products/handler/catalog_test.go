@@ -0,0 +1,87 @@
+package phandler
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCatalogQuery(t *testing.T) {
+	q, err := parseCatalogQuery(url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Sort != catalogDefaultSort || q.Limit != catalogDefaultLimit || q.MinPrice != nil || q.Cursor != nil {
+		t.Errorf("defaults = %+v", q)
+	}
+
+	cursor := encodeCatalogCursor(catalogCursor{Sort: "price", Value: "20", ID: 2})
+	q, err = parseCatalogQuery(url.Values{
+		"category":  {"c1"},
+		"min_price": {"10"},
+		"max_price": {"30"},
+		"sort":      {"price"},
+		"limit":     {"5"},
+		"cursor":    {cursor},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Category != "c1" || *q.MinPrice != 10 || *q.MaxPrice != 30 || q.Limit != 5 || *q.Cursor != (catalogCursor{Sort: "price", Value: "20", ID: 2}) {
+		t.Errorf("query = %+v", q)
+	}
+
+	for name, values := range map[string]url.Values{
+		"unknown sort":          {"sort": {"random"}},
+		"negative price":        {"min_price": {"-1"}},
+		"price is not a number": {"max_price": {"ten"}},
+		"inverted range":        {"min_price": {"30"}, "max_price": {"10"}},
+		"limit too large":       {"limit": {"1000"}},
+		"garbage cursor":        {"cursor": {"!!!"}},
+		"cursor of other sort":  {"sort": {"name"}, "cursor": {cursor}},
+	} {
+		if _, err := parseCatalogQuery(values); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestCatalogSQL(t *testing.T) {
+	minPrice := 10
+	query, args := catalogSQL(CatalogQuery{
+		Category: "c1",
+		MinPrice: &minPrice,
+		Sort:     "newest",
+		Limit:    20,
+		Cursor:   &catalogCursor{Sort: "newest", Value: "2024-01-02T03:04:05Z", ID: 7},
+	})
+	want := "SELECT id, name, COALESCE(description, ''), price, COALESCE(category, ''), likes, created_at FROM products" +
+		" WHERE category = $1 AND price >= $2 AND (created_at, id) < ($3::timestamptz, $4)" +
+		" ORDER BY created_at DESC, id DESC LIMIT $5"
+	if query != want {
+		t.Errorf("query =\n%s\nwant\n%s", query, want)
+	}
+	if wantArgs := []interface{}{"c1", 10, "2024-01-02T03:04:05Z", 7, 21}; !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("args = %v, want %v", args, wantArgs)
+	}
+
+	query, _ = catalogSQL(CatalogQuery{Sort: "name", Limit: 5})
+	if want := "SELECT id, name, COALESCE(description, ''), price, COALESCE(category, ''), likes, created_at FROM products ORDER BY name ASC, id ASC LIMIT $1"; query != want {
+		t.Errorf("query = %s", query)
+	}
+}
+
+func TestCursorValue(t *testing.T) {
+	p := Product{Name: "Продукт 1", Price: 10, Likes: 3, CreatedAt: time.Date(2024, 1, 2, 3, 4, 5, 600000000, time.UTC)}
+	for sort, want := range map[string]string{
+		"likes":      "3",
+		"price_desc": "10",
+		"name":       "Продукт 1",
+		"newest":     "2024-01-02T03:04:05.6Z",
+	} {
+		if got := cursorValue(sort, p); got != want {
+			t.Errorf("%s: cursor value = %q, want %q", sort, got, want)
+		}
+	}
+}
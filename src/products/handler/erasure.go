@@ -0,0 +1,109 @@
+package phandler
+
+import (
+	"log"
+	"os"
+	"sync/atomic"
+
+	"events"
+	"products/db"
+
+	kafka "github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// Стирание данных удаленного пользователя по событию user.deleted: его лайки
+// удаляются, счетчики лайков продуктов уменьшаются, а еще не опубликованные
+// product.liked и product.unliked от него убираются из outbox, чтобы не вернуть
+// лайки в recommendations и analytics. Подтверждение пишется в outbox в той же
+// транзакции. Повторное событие ничего не удаляет и просто
+// подтверждается еще раз. Если стереть не удалось, в outbox отдельной транзакцией
+// пишется user.erasure_failed с причиной, и users повторит удаление с задержкой.
+// Если не удалось записать и его, users опубликует событие заново по таймауту.
+
+// Текущий консьюмер user_updates, нужен для проверки готовности
+var userUpdatesConsumer atomic.Pointer[kafka.Consumer]
+
+func runUserUpdatesConsumer() {
+	consumer, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers": os.Getenv("KAFKA_BROKER"),
+		"group.id":          "products_user_updates",
+		"auto.offset.reset": "earliest",
+	})
+	if err != nil {
+		log.Fatalf("Ошибка создания консьюмера: %v", err)
+	}
+	defer consumer.Close()
+	userUpdatesConsumer.Store(consumer)
+	defer userUpdatesConsumer.Store(nil)
+
+	consumer.SubscribeTopics([]string{events.TopicUserUpdates}, nil)
+
+	for {
+		msg, err := consumer.ReadMessage(-1)
+		if err != nil {
+			log.Printf("Error while consuming message: %s", err)
+			continue
+		}
+		envelope, err := events.Decode(msg.Value)
+		if err != nil {
+			log.Printf("Error decoding message: %s", err)
+			continue
+		}
+		if envelope.Type != events.UserDeleted {
+			continue
+		}
+		event, err := envelope.User()
+		if err != nil {
+			log.Printf("Error decoding %s payload: %s", envelope.Type, err)
+			continue
+		}
+		if err := eraseUser(event.UserID, event.DeletionID); err != nil {
+			log.Printf("Error erasing user %d: %v", event.UserID, err)
+			if err := reportErasureFailure(event.UserID, event.DeletionID, err); err != nil {
+				log.Printf("Error reporting erasure failure for user %d: %v", event.UserID, err)
+			}
+			continue
+		}
+		log.Printf("User %d erased", event.UserID)
+	}
+}
+
+func eraseUser(userID int, deletionID string) error {
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`WITH removed AS (DELETE FROM likes WHERE user_id = $1 RETURNING product_id)
+		UPDATE products SET likes = likes - 1 WHERE id IN (SELECT product_id FROM removed)`, userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM outbox WHERE delivered_at IS NULL AND topic = $1
+		AND payload->>'type' IN ($2, $3) AND (payload->'payload'->>'user_id')::int = $4`,
+		events.TopicProductUpdates, events.ProductLiked, events.ProductUnliked, userID)
+	if err != nil {
+		return err
+	}
+	ack := events.ErasurePayload{DeletionID: deletionID, UserID: userID, Service: eventProducer}
+	if err := enqueueEvent(tx, events.UserErasureCompleted, ack); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// reportErasureFailure сообщает users, что стереть данные не удалось
+func reportErasureFailure(userID int, deletionID string, cause error) error {
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ack := events.ErasurePayload{DeletionID: deletionID, UserID: userID, Service: eventProducer, Error: cause.Error()}
+	if err := enqueueEvent(tx, events.UserErasureFailed, ack); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,55 @@
+package phandler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"auth/access"
+	"products/db"
+)
+
+// Данные пользователя для выгрузки по запросу users; пользователь — из токена сервиса
+type UserDataExport struct {
+	UserID int            `json:"user_id"`
+	Likes  []LikedProduct `json:"likes"`
+}
+
+// LikedProduct лайк пользователя; название и категория пусты, если продукт удален
+type LikedProduct struct {
+	ProductID int    `json:"product_id"`
+	Name      string `json:"name"`
+	Category  string `json:"category"`
+}
+
+func exportUserData(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	p, _ := access.FromContext(r.Context())
+	export := UserDataExport{UserID: p.ID, Likes: []LikedProduct{}}
+
+	rows, err := db.GetDB().Query(`SELECT l.product_id, COALESCE(p.name, ''), COALESCE(p.category, '')
+		FROM likes l LEFT JOIN products p ON p.id = l.product_id
+		WHERE l.user_id = $1 ORDER BY l.id`, p.ID)
+	if err != nil {
+		http.Error(w, "Could not export user data", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var like LikedProduct
+		if err := rows.Scan(&like.ProductID, &like.Name, &like.Category); err != nil {
+			http.Error(w, "Could not export user data", http.StatusInternalServerError)
+			return
+		}
+		export.Likes = append(export.Likes, like)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Could not export user data", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(export)
+}
@@ -1,27 +1,39 @@
 package phandler
 
 import (
+	"auth"
+	"auth/access"
 	"bytes"
 	"database/sql"
 	"encoding/json"
+	"events"
 	"fmt"
+	"health"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"outbox"
 	"products/db"
 	"strconv"
 	"text/template"
+	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
-	"github.com/dgrijalva/jwt-go"
 )
 
-var userUpdateTopic = "product_updates"
+// Имя сервиса в конверте событий
+const eventProducer = "products"
+
+var userUpdateTopic = events.TopicProductUpdates
 
 var producer *kafka.Producer
 
-var jwtSecret = []byte("secret")
+// Открытые ключи для проверки токенов публикует сервис пользователей
+const defaultJWKSURL = "http://user-service:9999/users/.well-known/jwks.json"
+
+var verifier *auth.Verifier
 
 type Recommendation struct {
 	Name string `json:"name"`
@@ -33,12 +45,13 @@ type ResFromRecommendation struct {
 }
 
 type Product struct {
-	ID          int    `json:"id"`
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	Price       int    `json:"price"`
-	Category    string `json:"category"`
-	Likes       int    `json:"likes"`
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Price       int       `json:"price"`
+	Category    string    `json:"category"`
+	Likes       int       `json:"likes"`
+	CreatedAt   time.Time `json:"created_at"`
 }
 type EditedProduct struct {
 	Name        string `json:"name"`
@@ -53,71 +66,56 @@ type Like struct {
 	ProductID int `json:"product_id"`
 }
 
-type KafkaMessage struct {
-	Action             string `json:"action"`
-	UserID             int    `json:"user_id"`
-	ProductID          string `json:"product_id"`
-	ProductCategory    string `json:"product_category"`
-	NumberOfLikes      int    `json:"number_of_likes"`
-	ProductDescription string `json:"description"`
-	ProductName        string `json:"name"`
-}
-
-func getFromJWT(str string, w http.ResponseWriter, r *http.Request) interface{} {
-	cookie, err := r.Cookie("token")
-	if err != nil || cookie == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return false
-	}
-
-	tokenString := cookie.Value
-	claims, err := parseJWT(tokenString)
-	if err != nil {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
-		return false
-	}
-	return claims[str]
-}
-
-// Проверка прав администратора
-func isAdmin(w http.ResponseWriter, r *http.Request) bool {
-	role := getFromJWT("role", w, r)
-	return role == "admin"
+// Пользователь запроса; маршрут должен быть защищен политикой, иначе вернется нулевой Principal
+func currentPrincipal(r *http.Request) access.Principal {
+	p, _ := access.FromContext(r.Context())
+	return p
 }
 
-// Парсинг JWT токена
-func parseJWT(tokenString string) (jwt.MapClaims, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return jwtSecret, nil
-	})
-
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		return claims, nil
+func jwksURL() string {
+	if url := os.Getenv("JWKS_URL"); url != "" {
+		return url
 	}
-	return nil, err
+	return defaultJWKSURL
 }
 
 // Страница администратора
 func adminPage(w http.ResponseWriter, r *http.Request) {
-	if isAdmin(w, r) {
-		tmpl := template.Must(template.ParseFiles("templates/admin.html"))
-		tmpl.Execute(w, nil)
-	} else {
-		http.Error(w, "Access denied", http.StatusForbidden)
-	}
+	tmpl := template.Must(template.ParseFiles("templates/admin.html"))
+	tmpl.Execute(w, nil)
 }
 
-// Начальная страница с продуктами
+// Начальная страница: рекомендации и каталог с фильтрами
 func productsPage(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
 	}
-	top3, _ := getTop3Recommendation()
-	responce := fromResToRecs(top3)
+	query, err := parseCatalogQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := listCatalog(query)
+	if err != nil {
+		http.Error(w, "Could not list products", http.StatusInternalServerError)
+		return
+	}
+	categories, err := catalogCategories()
+	if err != nil {
+		http.Error(w, "Could not list products", http.StatusInternalServerError)
+		return
+	}
+	// Ссылка на следующую страницу сохраняет фильтры и сортировку
+	var nextURL string
+	if page.NextCursor != "" {
+		next := r.URL.Query()
+		next.Set("cursor", page.NextCursor)
+		nextURL = "/products?" + next.Encode()
+	}
+
+	top, _ := getTopRecommendations(topRecommendationsLimit)
+	responce := fromResToRecs(top)
 	tmpl, err := template.ParseFiles("templates/products.html")
 	if err != nil {
 		http.Error(w, "Could not load template", http.StatusInternalServerError)
@@ -126,8 +124,18 @@ func productsPage(w http.ResponseWriter, r *http.Request) {
 	// Создаем структуру для передачи данных в шаблон
 	data := struct {
 		Recommendations []Recommendation
+		Products        []Product
+		Categories      []string
+		Filter          url.Values
+		Sort            string
+		NextURL         string
 	}{
 		Recommendations: responce,
+		Products:        page.Items,
+		Categories:      categories,
+		Filter:          r.URL.Query(),
+		Sort:            query.Sort,
+		NextURL:         nextURL,
 	}
 
 	// Выполняем шаблон с данными о продукте и рекомендациями
@@ -149,8 +157,9 @@ func getProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Проверяем, является ли пользователь администратором
-	isAdmin := isAdmin(w, r)
+	// Кнопки изменения и удаления показываются только тем, у кого есть права
+	user := currentPrincipal(r)
+	isAdmin := user.Can(access.ProductUpdate) || user.Can(access.ProductDelete)
 
 	// Загружаем HTML-шаблон
 	tmpl, err := template.ParseFiles("templates/product.html")
@@ -159,7 +168,7 @@ func getProduct(w http.ResponseWriter, r *http.Request) {
 		return // Завершаем выполнение функции после отправки ошибки
 	}
 
-	userID := int(getFromJWT("id", w, r).(float64))
+	userID := user.ID
 	recommendations, err := getRecommendations(userID, product.ID)
 
 	if err != nil {
@@ -198,10 +207,8 @@ func getProduct(w http.ResponseWriter, r *http.Request) {
 */
 
 func addProductPage(w http.ResponseWriter, r *http.Request) {
-	if isAdmin(w, r) {
-		tmpl := template.Must(template.ParseFiles("templates/add_product.html"))
-		tmpl.Execute(w, nil)
-	}
+	tmpl := template.Must(template.ParseFiles("templates/add_product.html"))
+	tmpl.Execute(w, nil)
 }
 
 func addProduct(w http.ResponseWriter, r *http.Request) {
@@ -214,13 +221,50 @@ func addProduct(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	_, err := db.GetDB().Exec("INSERT INTO products (name, description, price, category, likes) VALUES ($1, $2, $3, $4, $5)",
-		product.Name, product.Description, product.Price, product.Category, product.Likes)
+	price, err := parsePrice(product.Price)
+	if err != nil {
+		http.Error(w, "Invalid price", http.StatusBadRequest)
+		return
+	}
+	tx, err := db.GetDB().Begin()
 	if err != nil {
 		http.Error(w, "Could not create product", http.StatusInternalServerError)
 		return
 	}
-	json.NewEncoder(w).Encode(map[string]interface{}{"name": product.Name, "description": product.Description, "price": product.Price, "category": product.Category, "likes": product.Likes})
+	defer tx.Rollback()
+
+	var productID int
+	err = tx.QueryRow("INSERT INTO products (name, description, price, category, likes) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		product.Name, product.Description, price, product.Category, product.Likes).Scan(&productID)
+	if err != nil {
+		http.Error(w, "Could not create product", http.StatusInternalServerError)
+		return
+	}
+	// Продукт сразу доступен в поиске
+	if err := updateSearchVector(tx, productID); err != nil {
+		http.Error(w, "Could not create product", http.StatusInternalServerError)
+		return
+	}
+
+	msg := events.ProductPayload{
+
+		UserID:      currentPrincipal(r).ID,
+		ProductID:   productID,
+		Category:    product.Category,
+		Name:        product.Name,
+		Description: product.Description,
+		Likes:       product.Likes,
+	}
+	if err := enqueueEvent(tx, events.ProductCreated, msg); err != nil {
+		http.Error(w, "Could not create product", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Could not create product", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": productID, "name": product.Name, "description": product.Description, "price": price, "category": product.Category, "likes": product.Likes})
 }
 
 /*
@@ -242,20 +286,42 @@ func deleteProduct(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing product ID", http.StatusBadRequest)
 		return
 	}
-	// Удаляем товар из базы данных
-	result, err := db.GetDB().Exec("DELETE FROM products WHERE id = $1", id)
+	tx, err := db.GetDB().Begin()
 	if err != nil {
 		http.Error(w, "Could not delete product", http.StatusInternalServerError)
 		return
 	}
-	// Проверяем, было ли удалено хоть одно значение
-	rowsAffected, err := result.RowsAffected()
+	defer tx.Rollback()
+
+	// Удаляем товар из базы данных, забирая его данные для события
+	var name, description, category string
+	var likes int
+	err = tx.QueryRow("DELETE FROM products WHERE id = $1 RETURNING name, description, category, likes", id).Scan(&name, &description, &category, &likes)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Could not check affected rows", http.StatusInternalServerError)
+		http.Error(w, "Could not delete product", http.StatusInternalServerError)
 		return
 	}
-	if rowsAffected == 0 {
-		http.Error(w, "Product not found", http.StatusNotFound)
+
+	productID, _ := strconv.Atoi(id)
+	msg := events.ProductPayload{
+
+		UserID:      currentPrincipal(r).ID,
+		ProductID:   productID,
+		Category:    category,
+		Name:        name,
+		Description: description,
+		Likes:       likes,
+	}
+	if err := enqueueEvent(tx, events.ProductDeleted, msg); err != nil {
+		http.Error(w, "Could not delete product", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Could not delete product", http.StatusInternalServerError)
 		return
 	}
 }
@@ -309,32 +375,54 @@ func updateProduct(w http.ResponseWriter, r *http.Request) {
 	// Получаем данные из формы
 	name := r.FormValue("name")
 	description := r.FormValue("description")
-	price := r.FormValue("price")
+	price, err := parsePrice(r.FormValue("price"))
+	if err != nil {
+		http.Error(w, "Invalid price", http.StatusBadRequest)
+		return
+	}
 	category := r.FormValue("category")
 	likes := r.FormValue("likes")
 
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		http.Error(w, "Could not update product", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
 	// Обновляем информацию о товаре в базе данных
-	_, err := db.GetDB().Exec("UPDATE products SET name = $1, description = $2, price = $3, category = $4, likes = $5 WHERE id = $6",
+	_, err = tx.Exec("UPDATE products SET name = $1, description = $2, price = $3, category = $4, likes = $5 WHERE id = $6",
 		name, description, price, category, likes, id)
 
 	if err != nil {
 		http.Error(w, "Could not update product", http.StatusInternalServerError)
 		return
 	}
+	if err := updateSearchVector(tx, id); err != nil {
+		http.Error(w, "Could not update product", http.StatusInternalServerError)
+		return
+	}
 
 	likes_int, _ := strconv.Atoi(likes)
-	userID := int(getFromJWT("id", w, r).(float64))
-	msg := KafkaMessage{
-
-		UserID:             userID,
-		ProductID:          id,
-		Action:             "product info update",
-		ProductCategory:    category,
-		ProductName:        name,
-		ProductDescription: description,
-		NumberOfLikes:      likes_int,
+	userID := currentPrincipal(r).ID
+	productID, _ := strconv.Atoi(id)
+	msg := events.ProductPayload{
+
+		UserID:      userID,
+		ProductID:   productID,
+		Category:    category,
+		Name:        name,
+		Description: description,
+		Likes:       likes_int,
+	}
+	if err := enqueueEvent(tx, events.ProductUpdated, msg); err != nil {
+		http.Error(w, "Could not update product", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Could not update product", http.StatusInternalServerError)
+		return
 	}
-	sendToKafka(msg)
 
 	// Успешное обновление
 	http.Redirect(w, r, "/products/product?id="+id, http.StatusSeeOther)
@@ -349,9 +437,13 @@ func updateProduct(w http.ResponseWriter, r *http.Request) {
 */
 
 func toggleLike(w http.ResponseWriter, r *http.Request) {
-	// Получаем токен из куки
-
-	userID := int(getFromJWT("id", w, r).(float64)) // Преобразование user_id в int
+	user := currentPrincipal(r)
+	// Ставить лайки могут только пользователи с подтвержденным email
+	if !user.EmailVerified {
+		http.Error(w, "Email is not verified", http.StatusForbidden)
+		return
+	}
+	userID := user.ID
 
 	// Получаем product_id из параметров запроса
 	productID := r.URL.Query().Get("id")
@@ -387,77 +479,80 @@ func isLiked(userID int, productID string) bool {
 }
 
 func addLike(userID int, productID string) error {
-	_, err := db.GetDB().Exec("INSERT INTO likes (user_id, product_id) VALUES ($1, $2)", userID, productID)
-	if err != nil {
-		return err
-	}
-	_, err = db.GetDB().Exec("UPDATE products SET likes = likes + 1 WHERE id = $1", productID)
-	if err != nil {
-		return err
-	}
-	var name, category, description string
-	var likes, id int
-	err = db.GetDB().QueryRow("SELECT id, name, category, description, likes FROM products WHERE id = $1", productID).Scan(&id, &name, &category, &description, &likes)
-	if err == sql.ErrNoRows {
-		return err
-	}
-	msg := KafkaMessage{
-
-		UserID:             userID,
-		ProductID:          productID,
-		Action:             "like",
-		ProductCategory:    category,
-		ProductName:        name,
-		ProductDescription: description,
-		NumberOfLikes:      likes,
-	}
-	sendToKafka(msg)
-	return nil
+	return changeLike(userID, productID, events.ProductLiked,
+		"INSERT INTO likes (user_id, product_id) VALUES ($1, $2)",
+		"UPDATE products SET likes = likes + 1 WHERE id = $1")
 }
 
 func removeLike(userID int, productID string) error {
-	_, err := db.GetDB().Exec("DELETE FROM likes WHERE user_id = $1 AND product_id = $2", userID, productID)
+	return changeLike(userID, productID, events.ProductUnliked,
+		"DELETE FROM likes WHERE user_id = $1 AND product_id = $2",
+		"UPDATE products SET likes = likes - 1 WHERE id = $1")
+}
+
+// Изменение лайка, счетчика и событие в outbox в одной транзакции
+func changeLike(userID int, productID string, eventType events.Type, likeQuery, counterQuery string) error {
+	tx, err := db.GetDB().Begin()
 	if err != nil {
 		return err
 	}
-	_, err = db.GetDB().Exec("UPDATE products SET likes = likes - 1 WHERE id = $1", productID)
-	if err != nil {
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(likeQuery, userID, productID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(counterQuery, productID); err != nil {
 		return err
 	}
 	var name, category, description string
 	var likes, id int
-	err = db.GetDB().QueryRow("SELECT id, name, category, description, likes FROM products WHERE id = $1", productID).Scan(&id, &name, &category, &description, &likes)
-	if err == sql.ErrNoRows {
+	err = tx.QueryRow("SELECT id, name, category, description, likes FROM products WHERE id = $1", productID).Scan(&id, &name, &category, &description, &likes)
+	if err != nil {
 		return err
 	}
-	msg := KafkaMessage{
+	msg := events.ProductPayload{
 
-		UserID:             userID,
-		ProductID:          productID,
-		Action:             "unlike",
-		ProductCategory:    category,
-		ProductName:        name,
-		ProductDescription: description,
-		NumberOfLikes:      likes,
+		UserID:      userID,
+		ProductID:   id,
+		Category:    category,
+		Name:        name,
+		Description: description,
+		Likes:       likes,
 	}
-	sendToKafka(msg)
-	return nil
+	if err := enqueueEvent(tx, eventType, msg); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 // Инициализация маршрутов
 func InitializeRoutes() {
 	initKafka()
 	db.Connect()
-	http.HandleFunc("/products/product/", getProduct)                 // Получение продукта по ID
-	http.HandleFunc("/products/admin/add", addProductPage)            // Добавление нового продукта (требует админских прав)
-	http.HandleFunc("/products/admin", adminPage)                     // Админка
-	http.HandleFunc("/products/admin/add/submit", addProduct)         // Post запрос на добавление продукта
-	http.HandleFunc("/products/product/delete", deleteProduct)        // delete запрос для удаления продукта
-	http.HandleFunc("/products/product/update", updateProductPage)    // Для отображения формы обновления товара
-	http.HandleFunc("/products/product/update/submit", updateProduct) // Подтверждаем изменения информации о товаре
-	http.HandleFunc("/products/product/like", toggleLike)             // Для обработки обновления товара (POST)
-	http.HandleFunc("/products", productsPage)
+	go outbox.NewRelay(db.GetDB(), producer).Run()
+	go runUserUpdatesConsumer()
+	verifier = auth.NewJWKSVerifier(jwksURL(), auth.RevocationStoreFromEnv())
+	registerRoutes(access.NewRouter(http.DefaultServeMux, verifier))
+}
 
+// registerRoutes маршруты сервиса; у каждого маршрута явная политика доступа
+func registerRoutes(rt *access.Router) {
+	rt.HandleFunc("/products/product/", access.Authenticated(), getProduct)                               // Получение продукта по ID
+	rt.HandleFunc("/products/admin/add", access.Require(access.ProductCreate), addProductPage)            // Добавление нового продукта
+	rt.HandleFunc("/products/admin", access.Require(access.ProductCreate), adminPage)                     // Админка
+	rt.HandleFunc("/products/admin/add/submit", access.Require(access.ProductCreate), addProduct)         // Post запрос на добавление продукта
+	rt.HandleFunc("/products/product/delete", access.Require(access.ProductDelete), deleteProduct)        // delete запрос для удаления продукта
+	rt.HandleFunc("/products/product/update", access.Require(access.ProductUpdate), updateProductPage)    // Для отображения формы обновления товара
+	rt.HandleFunc("/products/product/update/submit", access.Require(access.ProductUpdate), updateProduct) // Подтверждаем изменения информации о товаре
+	rt.HandleFunc("/products/product/like", access.Require(access.ProductLike), toggleLike)               // Для обработки обновления товара (POST)
+	rt.HandleFunc("/products", access.Public(), productsPage)
+	rt.HandleFunc("/products/list", access.Public(), listProducts)                                     // JSON-версия каталога
+	rt.HandleFunc("/products/search", access.Public(), searchProductsHandler)                          // Полнотекстовый поиск
+	rt.HandleFunc("/products/suggest", access.Public(), suggestProductsHandler)                        // Подсказки для строки поиска
+	rt.HandleFunc("/products/internal/export", access.Service(auth.PurposeDataExport), exportUserData) // Данные пользователя для выгрузки, вызывает users
+
+	rt.HandleFunc("/health", access.Public(), health.Live)
+	rt.HandleFunc("/ready", access.Public(), ready)
 }
 
 // kafka
@@ -470,24 +565,20 @@ func initKafka() {
 	}
 }
 
-func sendToKafka(msg KafkaMessage) {
-	jsonMsg, err := json.Marshal(msg)
-	if err != nil {
-		log.Fatalf("Ошибка при сериализации в JSON: %v", err)
-	}
-	producer.Produce(&kafka.Message{
-		TopicPartition: kafka.TopicPartition{Topic: &userUpdateTopic, Partition: kafka.PartitionAny},
-		Value:          []byte(jsonMsg),
-	}, nil)
-}
-
 // Рекомендации
 
+// Сколько рекомендаций запрашивается для страницы продукта и для главной
+const (
+	productRecommendationsLimit = 10
+	topRecommendationsLimit     = 10
+)
+
 func getRecommendations(userId int, productId int) ([]Recommendation, error) {
 	// Создаем объект для отправки в теле запроса
 	requestBody := map[string]int{
 		"user_id":    userId,
 		"product_id": productId,
+		"limit":      productRecommendationsLimit,
 	}
 
 	// Преобразуем объект в JSON
@@ -522,9 +613,9 @@ func getRecommendations(userId int, productId int) ([]Recommendation, error) {
 	return fromResToRecs(result), nil
 }
 
-func getTop3Recommendation() ([]ResFromRecommendation, error) {
+func getTopRecommendations(limit int) ([]ResFromRecommendation, error) {
 	// Выполняем GET запрос к API
-	resp, err := http.Get("http://recommendation-service:6666/recommendations/top3")
+	resp, err := http.Get(fmt.Sprintf("http://recommendation-service:6666/recommendations/top?limit=%d", limit))
 	if err != nil {
 		return nil, fmt.Errorf("failed to make request: %w", err)
 	}
@@ -550,15 +641,19 @@ func getTop3Recommendation() ([]ResFromRecommendation, error) {
 	return recommendations, nil
 }
 
+// fromResToRecs подставляет названия продуктов; продукты, которых уже нет в каталоге, пропускаются
 func fromResToRecs(data []ResFromRecommendation) []Recommendation {
-	res := make([]Recommendation, 3)
-	for i, rec := range data {
-		err := db.GetDB().QueryRow("SELECT name FROM products WHERE id = $1", rec.ID).Scan(&res[i].Name)
-		if err == sql.ErrNoRows {
-			return nil
+	res := make([]Recommendation, 0, len(data))
+	for _, rec := range data {
+		var name string
+		err := db.GetDB().QueryRow("SELECT name FROM products WHERE id = $1", rec.ID).Scan(&name)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				log.Printf("Error getting recommended product %d: %v", rec.ID, err)
+			}
+			continue
 		}
-		res[i].Url = fmt.Sprintf("/products/product?id=%d", rec.ID)
-
+		res = append(res, Recommendation{Name: name, Url: fmt.Sprintf("/products/product?id=%d", rec.ID)})
 	}
 	return res
 }
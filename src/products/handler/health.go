@@ -0,0 +1,36 @@
+package phandler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"events"
+	"health"
+	"products/db"
+)
+
+// Readiness: проверяем Postgres, продюсер Kafka и консьюмер user_updates
+func ready(w http.ResponseWriter, r *http.Request) {
+	health.WriteReadiness(w, r, map[string]health.Check{
+		"postgres": func(ctx context.Context) error {
+			return db.GetDB().PingContext(ctx)
+		},
+		"kafka": func(ctx context.Context) error {
+			if producer == nil {
+				return errors.New("producer is not initialized")
+			}
+			_, err := producer.GetMetadata(&userUpdateTopic, false, health.RemainingMs(ctx))
+			return err
+		},
+		"kafka_user_updates": func(ctx context.Context) error {
+			consumer := userUpdatesConsumer.Load()
+			if consumer == nil {
+				return errors.New("consumer is not initialized")
+			}
+			topic := events.TopicUserUpdates
+			_, err := consumer.GetMetadata(&topic, false, health.RemainingMs(ctx))
+			return err
+		},
+	})
+}
@@ -0,0 +1,79 @@
+package phandler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"auth"
+	"auth/access"
+	"auth/access/accesstest"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestRoutePolicies(t *testing.T) {
+	rt := access.NewRouter(http.NewServeMux(), auth.NewJWKSVerifier("http://localhost/jwks.json", auth.NewMemoryRevocationStore()))
+	registerRoutes(rt)
+
+	accesstest.CheckPolicies(t, rt, map[string]access.Policy{
+		"/products/product/":              access.Authenticated(),
+		"/products/admin/add":             access.Require(access.ProductCreate),
+		"/products/admin":                 access.Require(access.ProductCreate),
+		"/products/admin/add/submit":      access.Require(access.ProductCreate),
+		"/products/product/delete":        access.Require(access.ProductDelete),
+		"/products/product/update":        access.Require(access.ProductUpdate),
+		"/products/product/update/submit": access.Require(access.ProductUpdate),
+		"/products/product/like":          access.Require(access.ProductLike),
+		"/products":                       access.Public(),
+		"/products/list":                  access.Public(),
+		"/products/search":                access.Public(),
+		"/products/suggest":               access.Public(),
+		"/products/internal/export":       access.Service(auth.PurposeDataExport),
+		"/health":                         access.Public(),
+		"/ready":                          access.Public(),
+	})
+	accesstest.CheckNoDirectRoutes(t, ".")
+}
+
+// Токены сессии, завершенной в сервисе пользователей, отклоняются по общему списку отзыва
+func TestRevokedSessionRejected(t *testing.T) {
+	signer, err := auth.GenerateSigner("EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revocations := auth.NewMemoryRevocationStore()
+	mux := http.NewServeMux()
+	registerRoutes(access.NewRouter(mux, auth.NewLocalVerifier(signer, revocations)))
+
+	token, err := signer.Sign(jwt.MapClaims{
+		auth.ClaimUserID:    1,
+		auth.ClaimRole:      access.RoleAdmin,
+		auth.ClaimTokenID:   "t1",
+		auth.ClaimSessionID: "s1",
+		auth.ClaimExpiresAt: time.Now().Add(time.Minute).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := func() int {
+		// GET отклоняется обработчиком до обращения к БД, если токен принят
+		r := httptest.NewRequest(http.MethodGet, "/products/product/delete", nil)
+		r.AddCookie(&http.Cookie{Name: access.TokenCookie, Value: token})
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := request(); code != http.StatusMethodNotAllowed {
+		t.Fatalf("before revocation: status %d, want %d", code, http.StatusMethodNotAllowed)
+	}
+	if err := auth.RevokeSession(context.Background(), revocations, "s1", time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if code := request(); code != http.StatusUnauthorized {
+		t.Fatalf("after revocation: status %d, want %d", code, http.StatusUnauthorized)
+	}
+}
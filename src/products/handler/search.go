@@ -0,0 +1,252 @@
+package phandler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"products/db"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Полнотекстовый поиск по каталогу. search_vector хранит лексемы названия,
+// категории и описания в конфигурации russian (с весами A, B, C) и пересчитывается
+// в той же транзакции, что и изменение продукта. Опечатки в названии находит
+// pg_trgm: запрос сравнивается со словами названия через word_similarity.
+
+// Вектор продукта; то же выражение заполняет начальные данные в create_databases.sql
+const searchVectorExpr = `setweight(to_tsvector('russian', COALESCE(name, '')), 'A') ||
+	setweight(to_tsvector('russian', COALESCE(category, '')), 'B') ||
+	setweight(to_tsvector('russian', COALESCE(description, '')), 'C')`
+
+const (
+	searchDefaultLimit  = 20
+	searchMaxLimit      = 50
+	searchMaxOffset     = 1000
+	suggestDefaultLimit = 5
+	suggestMaxLimit     = 10
+	searchMaxQueryRunes = 100
+
+	// Порог word_similarity для нечетких совпадений; по умолчанию в pg_trgm 0.6,
+	// этого мало для опечаток в коротких словах
+	searchFuzzyThreshold = 0.4
+	// Вес нечеткого совпадения названия относительно ранга полнотекстового поиска
+	searchFuzzyWeight = 0.5
+)
+
+// Границы подсветки из ts_headline. Символы из области для частного использования
+// не встречаются в тексте, поэтому текст можно экранировать, а затем заменить их на <mark>.
+const (
+	highlightStart = "\uE000"
+	highlightStop  = "\uE001"
+)
+
+var errEmptySearchQuery = errors.New("query is empty")
+
+// SearchQuery параметры поиска: q, category, limit, offset
+type SearchQuery struct {
+	Text     string
+	Category string
+	Limit    int
+	Offset   int
+}
+
+// SearchResult продукт с рангом и HTML-фрагментами, где совпадения обернуты в <mark>
+type SearchResult struct {
+	Product
+	Rank          float64 `json:"rank"`
+	NameHighlight string  `json:"name_highlight"`
+	Snippet       string  `json:"snippet"`
+}
+
+type Suggestion struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// updateSearchVector пересчитывает поисковый вектор продукта в транзакции его изменения
+func updateSearchVector(tx *sql.Tx, productID interface{}) error {
+	_, err := tx.Exec("UPDATE products SET search_vector = "+searchVectorExpr+" WHERE id = $1", productID)
+	return err
+}
+
+func parseSearchText(values url.Values) (string, error) {
+	text := strings.TrimSpace(values.Get("q"))
+	if text == "" {
+		return "", errEmptySearchQuery
+	}
+	if utf8.RuneCountInString(text) > searchMaxQueryRunes {
+		return "", fmt.Errorf("query is longer than %d characters", searchMaxQueryRunes)
+	}
+	return text, nil
+}
+
+// parseBoundedInt читает необязательный целый параметр из диапазона [lo, hi]
+func parseBoundedInt(values url.Values, name string, fallback, lo, hi int) (int, error) {
+	v := values.Get(name)
+	if v == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < lo || n > hi {
+		return 0, fmt.Errorf("%s must be between %d and %d", name, lo, hi)
+	}
+	return n, nil
+}
+
+func parseSearchQuery(values url.Values) (SearchQuery, error) {
+	q := SearchQuery{Category: strings.TrimSpace(values.Get("category"))}
+	var err error
+	if q.Text, err = parseSearchText(values); err != nil {
+		return q, err
+	}
+	if q.Limit, err = parseBoundedInt(values, "limit", searchDefaultLimit, 1, searchMaxLimit); err != nil {
+		return q, err
+	}
+	if q.Offset, err = parseBoundedInt(values, "offset", 0, 0, searchMaxOffset); err != nil {
+		return q, err
+	}
+	return q, nil
+}
+
+// highlightHTML экранирует фрагмент из ts_headline и превращает границы совпадений в <mark>
+func highlightHTML(fragment string) string {
+	escaped := html.EscapeString(fragment)
+	escaped = strings.ReplaceAll(escaped, highlightStart, "<mark>")
+	return strings.ReplaceAll(escaped, highlightStop, "</mark>")
+}
+
+// likePrefix шаблон LIKE для поиска по началу строки; спецсимволы запроса экранируются
+func likePrefix(text string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return replacer.Replace(strings.ToLower(text)) + "%"
+}
+
+// withFuzzyThreshold выполняет запросы в транзакции с порогом нечеткого совпадения
+func withFuzzyThreshold(fn func(tx *sql.Tx) error) error {
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(fmt.Sprintf("SET LOCAL pg_trgm.word_similarity_threshold = %g", searchFuzzyThreshold)); err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// searchProducts ищет по лексемам (с учетом морфологии) и по похожести названия.
+// Ранг — ts_rank_cd по весам полей плюс взвешенная похожесть названия.
+func searchProducts(q SearchQuery) ([]SearchResult, error) {
+	results := []SearchResult{}
+	nameOptions := fmt.Sprintf(`StartSel="%s", StopSel="%s", HighlightAll=true`, highlightStart, highlightStop)
+	snippetOptions := fmt.Sprintf(`StartSel="%s", StopSel="%s", MaxWords=20, MinWords=5, MaxFragments=2`, highlightStart, highlightStop)
+
+	err := withFuzzyThreshold(func(tx *sql.Tx) error {
+		rows, err := tx.Query(`WITH q AS (SELECT websearch_to_tsquery('russian', $1) AS query, lower($1) AS text)
+			SELECT p.id, p.name, COALESCE(p.description, ''), p.price, COALESCE(p.category, ''), p.likes, p.created_at,
+				ts_rank_cd(p.search_vector, q.query) + $2 * word_similarity(q.text, lower(p.name)) AS rank,
+				ts_headline('russian', p.name, q.query, $3),
+				ts_headline('russian', COALESCE(p.description, ''), q.query, $4)
+			FROM products p, q
+			WHERE (p.search_vector @@ q.query OR q.text <% lower(p.name))
+				AND ($5 = '' OR p.category = $5)
+			ORDER BY rank DESC, p.likes DESC, p.id
+			LIMIT $6 OFFSET $7`,
+			q.Text, searchFuzzyWeight, nameOptions, snippetOptions, q.Category, q.Limit, q.Offset)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var r SearchResult
+			var name, snippet string
+			if err := rows.Scan(&r.ID, &r.Name, &r.Description, &r.Price, &r.Category, &r.Likes, &r.CreatedAt, &r.Rank, &name, &snippet); err != nil {
+				return err
+			}
+			r.NameHighlight = highlightHTML(name)
+			r.Snippet = highlightHTML(snippet)
+			results = append(results, r)
+		}
+		return rows.Err()
+	})
+	return results, err
+}
+
+// suggestProducts подсказки для автодополнения: сначала названия, начинающиеся
+// с введенного текста, затем похожие; внутри групп — по популярности
+func suggestProducts(text string, limit int) ([]Suggestion, error) {
+	suggestions := []Suggestion{}
+	err := withFuzzyThreshold(func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT id, name FROM products
+			WHERE lower(name) LIKE $1 OR lower($2) <% lower(name)
+			ORDER BY lower(name) LIKE $1 DESC, word_similarity(lower($2), lower(name)) DESC, likes DESC, id
+			LIMIT $3`, likePrefix(text), text, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var s Suggestion
+			if err := rows.Scan(&s.ID, &s.Name); err != nil {
+				return err
+			}
+			suggestions = append(suggestions, s)
+		}
+		return rows.Err()
+	})
+	return suggestions, err
+}
+
+// Поиск продуктов
+func searchProductsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := parseSearchQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	results, err := searchProducts(q)
+	if err != nil {
+		http.Error(w, "Could not search products", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"items": results})
+}
+
+// Подсказки для строки поиска
+func suggestProductsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	text, err := parseSearchText(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := parseBoundedInt(r.URL.Query(), "limit", suggestDefaultLimit, 1, suggestMaxLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	suggestions, err := suggestProducts(text, limit)
+	if err != nil {
+		http.Error(w, "Could not load suggestions", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"items": suggestions})
+}
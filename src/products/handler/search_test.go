@@ -0,0 +1,53 @@
+package phandler
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	q, err := parseSearchQuery(url.Values{"q": {"  продукты  "}, "category": {"c1"}, "limit": {"5"}, "offset": {"10"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q != (SearchQuery{Text: "продукты", Category: "c1", Limit: 5, Offset: 10}) {
+		t.Errorf("query = %+v", q)
+	}
+
+	q, err = parseSearchQuery(url.Values{"q": {"продукт"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Limit != searchDefaultLimit || q.Offset != 0 {
+		t.Errorf("defaults = %+v", q)
+	}
+
+	long := make([]rune, searchMaxQueryRunes+1)
+	for i := range long {
+		long[i] = 'я'
+	}
+	for name, values := range map[string]url.Values{
+		"empty query":     {"q": {"   "}},
+		"long query":      {"q": {string(long)}},
+		"zero limit":      {"q": {"a"}, "limit": {"0"}},
+		"limit too large": {"q": {"a"}, "limit": {"51"}},
+		"negative offset": {"q": {"a"}, "offset": {"-1"}},
+	} {
+		if _, err := parseSearchQuery(values); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestHighlightHTML(t *testing.T) {
+	got := highlightHTML("Новый " + highlightStart + "продукт" + highlightStop + " <b>&</b>")
+	if want := "Новый <mark>продукт</mark> &lt;b&gt;&amp;&lt;/b&gt;"; got != want {
+		t.Errorf("highlight = %q, want %q", got, want)
+	}
+}
+
+func TestLikePrefix(t *testing.T) {
+	if got := likePrefix(`Про_100%\`); got != `про\_100\%\\%` {
+		t.Errorf("prefix = %q", got)
+	}
+}
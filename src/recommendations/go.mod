@@ -4,10 +4,28 @@ go 1.23.1
 
 require github.com/confluentinc/confluent-kafka-go v1.9.2
 
-require github.com/lib/pq v1.10.9
+require (
+	github.com/DATA-DOG/go-sqlmock v1.5.2
+	github.com/alicebob/miniredis/v2 v2.35.0
+	github.com/go-redis/redis/v8 v8.11.5
+	github.com/lib/pq v1.10.9
+)
 
 require (
 	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/dgrijalva/jwt-go v3.2.0+incompatible // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
-	github.com/go-redis/redis/v8 v8.11.5 // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
+)
+
+require (
+	auth v0.0.0
+	events v0.0.0
+	health v0.0.0
+)
+
+replace (
+	auth => ../auth
+	events => ../events
+	health => ../health
 )
@@ -0,0 +1,272 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"recommendations/db"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/lib/pq"
+)
+
+// Кэш рекомендаций в Redis. Ключ включает версии пользователя и продукта страницы:
+// чтобы сбросить все записи пользователя или продукта, достаточно увеличить
+// соответствующую версию, старые ключи просто доживают TTL. Кэш всегда строится
+// из сохраненных в БД списков, поэтому инвалидация удаляет строки в recommendations
+// и поднимает версии пользователей удаленных строк — так сбрасываются и списки,
+// зависящие от категории, без отдельной версии категории и без запроса к БД при чтении.
+
+const cacheTTL = 10 * time.Minute
+
+// Топ залайканных продуктов кэшируется ненадолго: очки в нем — число лайков,
+// а версия топа поднимается, только когда лайк меняет порядок продуктов
+const topCacheTTL = time.Minute
+
+const topVersionKey = "recommendations:version:top"
+
+func userVersionKey(userID int) string {
+	return fmt.Sprintf("recommendations:version:user:%d", userID)
+}
+
+func productVersionKey(productID int) string {
+	return fmt.Sprintf("recommendations:version:product:%d", productID)
+}
+
+// versionsOf читает версии; отсутствующая версия — "0"
+func versionsOf(keys ...string) ([]string, error) {
+	versions, err := redisClient.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	v := make([]string, len(versions))
+	for i, version := range versions {
+		v[i] = "0"
+		if s, ok := version.(string); ok {
+			v[i] = s
+		}
+	}
+	return v, nil
+}
+
+// cacheKey собирает ключ записи с текущими версиями
+func cacheKey(userID int, productID int) (string, error) {
+	v, err := versionsOf(userVersionKey(userID), productVersionKey(productID))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("recommendations:%d:%d:%s.%s", userID, productID, v[0], v[1]), nil
+}
+
+func cacheRecommendations(userID int, productID int, recommendations []RecommendationResponce) {
+	key, err := cacheKey(userID, productID)
+	if err != nil {
+		log.Printf("Error building cache key: %v", err)
+		return
+	}
+	recommendationsJSON, err := json.Marshal(recommendations)
+	if err == nil {
+		redisClient.Set(ctx, key, recommendationsJSON, cacheTTL)
+	}
+}
+
+func getRecommendationsFromCache(userID int, productID int) ([]RecommendationResponce, error) {
+	key, err := cacheKey(userID, productID)
+	if err != nil {
+		return nil, err
+	}
+	return readCachedRecommendations(key)
+}
+
+// readCachedRecommendations запись кэша; nil, если ее нет
+func readCachedRecommendations(key string) ([]RecommendationResponce, error) {
+	cachedRecommendations, err := redisClient.Get(ctx, key).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var response []RecommendationResponce
+	if err := json.Unmarshal([]byte(cachedRecommendations), &response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// bumpCacheVersions делает недействительными все записи кэша перечисленных
+// пользователей и продуктов
+func bumpCacheVersions(userIDs []int, productIDs []int) {
+	pipe := redisClient.Pipeline()
+	for _, id := range userIDs {
+		pipe.Incr(ctx, userVersionKey(id))
+	}
+	for _, id := range productIDs {
+		pipe.Incr(ctx, productVersionKey(id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Error bumping cache versions: %v", err)
+	}
+}
+
+// topCacheKey ключ первых n продуктов топа с текущей версией
+func topCacheKey(n int) (string, error) {
+	v, err := versionsOf(topVersionKey)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("recommendations:top:%d:%s", n, v[0]), nil
+}
+
+func cacheTopLiked(n int, recommendations []RecommendationResponce) {
+	key, err := topCacheKey(n)
+	if err != nil {
+		log.Printf("Error building cache key: %v", err)
+		return
+	}
+	recommendationsJSON, err := json.Marshal(recommendations)
+	if err == nil {
+		redisClient.Set(ctx, key, recommendationsJSON, topCacheTTL)
+	}
+}
+
+func getTopLikedFromCache(n int) ([]RecommendationResponce, error) {
+	key, err := topCacheKey(n)
+	if err != nil {
+		return nil, err
+	}
+	return readCachedRecommendations(key)
+}
+
+func bumpTopVersion() {
+	if err := redisClient.Incr(ctx, topVersionKey).Err(); err != nil {
+		log.Printf("Error bumping cache versions: %v", err)
+	}
+}
+
+// Удаляет сохраненные рекомендации, на которые могло повлиять изменение продукта:
+// те, где он уже рекомендован, те, что построены на странице продукта из затронутой
+// категории, и те, что построены для пользователей, лайкавших эту категорию.
+// Удаленные строки пересчитываются при следующем запросе. Сбрасывается и кэш топа.
+func invalidateRecommendations(productID int, categories []string) {
+	rows, err := db.GetDB().Query(`WITH deleted AS (
+			DELETE FROM recommendations r
+			WHERE (r.user_id, r.product_id) IN (SELECT user_id, product_id FROM recommendations WHERE recommended_id = $1)
+				OR r.product_id IN (SELECT id FROM products WHERE category = ANY($2))
+				OR r.user_id IN (SELECT l.user_id FROM likes l JOIN products p ON p.id = l.product_id WHERE p.category = ANY($2))
+			RETURNING r.user_id
+		)
+		SELECT DISTINCT user_id FROM deleted`, productID, pq.Array(categories))
+	if err != nil {
+		log.Printf("Error invalidating recommendations: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	var userIDs []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			log.Printf("Error reading invalidated recommendation: %v", err)
+			return
+		}
+		userIDs = append(userIDs, userID)
+	}
+
+	bumpCacheVersions(userIDs, []int{productID})
+	bumpTopVersion()
+}
+
+// invalidateAfterLikeChange сбрасывает рекомендации после лайка или анлайка:
+// все списки самого пользователя и страницы продуктов, у которых поменялись
+// совместные лайки с этим продуктом. Если лайк переставил продукт внутри
+// категории, сбрасывается и всё, что зависит от этой категории, и кэш топа;
+// если порядок поменялся только в общем топе — только кэш топа.
+// Если для страницы, на которой поставлен лайк, был список, он сразу пересчитывается.
+func invalidateAfterLikeChange(userID int, productID int, category string, shift rankingShift) {
+	hadRecommendation := isRecommendationInDB(userID, productID)
+
+	productIDs := []int{productID}
+	rows, err := db.GetDB().Query("SELECT product_id FROM likes WHERE user_id = $1 AND product_id <> $2", userID, productID)
+	if err != nil {
+		log.Printf("Error getting liked products: %v", err)
+		return
+	}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			log.Printf("Error getting liked products: %v", err)
+			return
+		}
+		productIDs = append(productIDs, id)
+	}
+	rows.Close()
+
+	_, err = db.GetDB().Exec("DELETE FROM recommendations WHERE user_id = $1 OR product_id = ANY($2)", userID, idArray(productIDs))
+	if err != nil {
+		log.Printf("Error invalidating recommendations: %v", err)
+		return
+	}
+	bumpCacheVersions([]int{userID}, productIDs)
+
+	if shift.category {
+		invalidateRecommendations(productID, []string{category})
+	} else if shift.top {
+		bumpTopVersion()
+	}
+	if hadRecommendation {
+		updateRecommendationInDB(userID, productID)
+	}
+}
+
+// rankingShift какие списки затрагивает новое число лайков продукта
+type rankingShift struct {
+	category bool // порядок внутри категории
+	top      bool // порядок в общем топе
+}
+
+// likesRankingShifted проверяет до сохранения нового числа лайков, обгонит ли продукт
+// соседа или уступит ему — в своей категории и в общем топе. Общий топ кэшируется
+// не глубже maxStoredRecommendations, поэтому перестановки ниже этой границы его не меняют.
+func likesRankingShifted(productID int, category string, likes int) rankingShift {
+	changed := rankingShift{category: true, top: true}
+
+	var oldLikes int
+	var oldCategory string
+	err := db.GetDB().QueryRow("SELECT likes, category FROM products WHERE id = $1", productID).Scan(&oldLikes, &oldCategory)
+	if err != nil {
+		// Новый продукт или ошибка чтения: считаем, что порядок изменился
+		return changed
+	}
+	if oldCategory != category {
+		return changed
+	}
+	if oldLikes == likes {
+		return rankingShift{}
+	}
+
+	low, high := oldLikes, likes
+	if low > high {
+		low, high = high, low
+	}
+	var crossedInCategory, crossed bool
+	var above int
+	err = db.GetDB().QueryRow(`SELECT
+			COALESCE(bool_or(likes BETWEEN $3 AND $4 AND category = $1), false),
+			COALESCE(bool_or(likes BETWEEN $3 AND $4), false),
+			COUNT(*) FILTER (WHERE likes > $4)
+		FROM products WHERE id <> $2`,
+		category, productID, low, high).Scan(&crossedInCategory, &crossed, &above)
+	if err != nil {
+		return changed
+	}
+	// above — сколько продуктов выше продукта даже с большим из двух значений;
+	// если их не меньше глубины топа, продукт вне топа до и после изменения
+	return rankingShift{
+		category: crossedInCategory,
+		top:      crossed && above < maxStoredRecommendations,
+	}
+}
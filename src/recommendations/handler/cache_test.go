@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"events"
+	"recommendations/db"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// useMiniredis подменяет Redis на время теста
+func useMiniredis(t *testing.T) *miniredis.Miniredis {
+	mr := miniredis.RunT(t)
+	previous := redisClient
+	redisClient = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		redisClient.Close()
+		redisClient = previous
+	})
+	return mr
+}
+
+func useSQLMock(t *testing.T) sqlmock.Sqlmock {
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	db.SetDB(conn)
+	return mock
+}
+
+func TestCacheKeysFollowVersions(t *testing.T) {
+	useMiniredis(t)
+
+	key, err := cacheKey(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "recommendations:1:2:0.0" {
+		t.Errorf("cacheKey = %q, want recommendations:1:2:0.0", key)
+	}
+
+	cached := []RecommendationResponce{{ProductID: 3}}
+	cacheRecommendations(1, 2, cached)
+	cacheRecommendations(4, 5, cached)
+	if got, err := getRecommendationsFromCache(1, 2); err != nil || len(got) != 1 || got[0].ProductID != 3 {
+		t.Fatalf("getRecommendationsFromCache = %v, %v, want cached list", got, err)
+	}
+
+	// Версия пользователя сбрасывает только его записи, версия продукта — записи страницы
+	bumpCacheVersions([]int{1}, []int{5})
+	if key, _ := cacheKey(1, 2); key != "recommendations:1:2:1.0" {
+		t.Errorf("cacheKey after bump = %q, want recommendations:1:2:1.0", key)
+	}
+	for _, page := range [][2]int{{1, 2}, {4, 5}} {
+		if got, err := getRecommendationsFromCache(page[0], page[1]); err != nil || got != nil {
+			t.Errorf("user %d product %d: cache = %v, %v, want miss", page[0], page[1], got, err)
+		}
+	}
+	if key, _ := cacheKey(4, 2); key != "recommendations:4:2:0.0" {
+		t.Errorf("unrelated cacheKey = %q, want recommendations:4:2:0.0", key)
+	}
+}
+
+func TestTopCacheVersion(t *testing.T) {
+	useMiniredis(t)
+
+	cacheTopLiked(3, []RecommendationResponce{{ProductID: 1}})
+	if got, err := getTopLikedFromCache(3); err != nil || len(got) != 1 {
+		t.Fatalf("getTopLikedFromCache = %v, %v, want cached top", got, err)
+	}
+	if got, _ := getTopLikedFromCache(5); got != nil {
+		t.Errorf("top of another depth = %v, want miss", got)
+	}
+	bumpTopVersion()
+	if got, _ := getTopLikedFromCache(3); got != nil {
+		t.Errorf("top after bump = %v, want miss", got)
+	}
+}
+
+func TestLikesRankingShifted(t *testing.T) {
+	const current = "SELECT likes, category FROM products WHERE id = $1"
+	const neighbours = "FROM products WHERE id <> $2"
+
+	tests := []struct {
+		name      string
+		old       *sqlmock.Rows
+		likes     int
+		crossed   []driver.Value // в категории, в общем топе, сколько продуктов выше; nil — запроса нет
+		wantShift rankingShift
+	}{
+		{"new product", nil, 1, nil, rankingShift{category: true, top: true}},
+		{"category changed", sqlmock.NewRows([]string{"likes", "category"}).AddRow(5, "games"), 5, nil, rankingShift{category: true, top: true}},
+		{"same likes", sqlmock.NewRows([]string{"likes", "category"}).AddRow(5, "books"), 5, nil, rankingShift{}},
+		{"overtakes a neighbour in the category", sqlmock.NewRows([]string{"likes", "category"}).AddRow(5, "books"), 6, []driver.Value{true, true, 0}, rankingShift{category: true, top: true}},
+		{"overtakes another category in the top", sqlmock.NewRows([]string{"likes", "category"}).AddRow(5, "books"), 6, []driver.Value{false, true, 2}, rankingShift{top: true}},
+		{"crosses below the top boundary", sqlmock.NewRows([]string{"likes", "category"}).AddRow(5, "books"), 4, []driver.Value{false, true, maxStoredRecommendations}, rankingShift{}},
+		{"crosses nobody", sqlmock.NewRows([]string{"likes", "category"}).AddRow(5, "books"), 6, []driver.Value{false, false, 0}, rankingShift{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := useSQLMock(t)
+			q := mock.ExpectQuery(regexp.QuoteMeta(current)).WithArgs(7)
+			if tt.old == nil {
+				q.WillReturnError(sql.ErrNoRows)
+			} else {
+				q.WillReturnRows(tt.old)
+			}
+			if tt.crossed != nil {
+				low, high := 5, tt.likes
+				if low > high {
+					low, high = high, low
+				}
+				mock.ExpectQuery(regexp.QuoteMeta(neighbours)).WithArgs("books", 7, low, high).
+					WillReturnRows(sqlmock.NewRows([]string{"in_category", "crossed", "above"}).AddRow(tt.crossed...))
+			}
+
+			if got := likesRankingShifted(7, "books", tt.likes); got != tt.wantShift {
+				t.Errorf("likesRankingShifted = %+v, want %+v", got, tt.wantShift)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// Обновление продукта сбрасывает рекомендации, только если поменялись категория или лайки
+func TestProductUpsertInvalidation(t *testing.T) {
+	const current = "SELECT category, likes FROM products WHERE id = $1"
+	const upsert = "INSERT INTO products (id, category, likes)"
+	const invalidate = "WITH deleted AS"
+
+	tests := []struct {
+		name           string
+		oldCategory    string
+		oldLikes       int
+		wantCategories string // массив категорий, как его передает pq
+	}{
+		{"renamed only", "books", 3, ""},
+		{"likes changed", "books", 2, `{"books"}`},
+		{"category changed", "games", 3, `{"books","games"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr := useMiniredis(t)
+			mock := useSQLMock(t)
+			mock.ExpectQuery(regexp.QuoteMeta(current)).WithArgs(7).
+				WillReturnRows(sqlmock.NewRows([]string{"category", "likes"}).AddRow(tt.oldCategory, tt.oldLikes))
+			mock.ExpectExec(regexp.QuoteMeta(upsert)).WithArgs(7, "books", 3).WillReturnResult(sqlmock.NewResult(0, 1))
+			if tt.wantCategories != "" {
+				mock.ExpectQuery(regexp.QuoteMeta(invalidate)).WithArgs(7, tt.wantCategories).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(11))
+			}
+
+			processProductUpsert(events.ProductPayload{ProductID: 7, Name: "Renamed", Category: "books", Likes: 3})
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+			invalidated := tt.wantCategories != ""
+			for _, key := range []string{userVersionKey(11), productVersionKey(7), topVersionKey} {
+				if mr.Exists(key) != invalidated {
+					t.Errorf("%s bumped = %v, want %v", key, mr.Exists(key), invalidated)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"events"
+	"recommendations/db"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// Стирание данных удаленного пользователя по событию user.deleted: лайки и
+// совместные лайки, сохраненные рекомендации и все его ключи в Redis. Счетчики
+// лайков продуктов уменьшаются так же, как в products. Результат подтверждается
+// в топик user_erasure; повторное событие ничего не удаляет и подтверждается снова.
+//
+// Лайки приходят в product_updates, а user.deleted — в user_updates, и порядок
+// между топиками не гарантирован. Поэтому пользователь запоминается в
+// erased_users, и его лайки и анлайки, пришедшие после стирания, пропускаются.
+
+// Имя сервиса в конверте событий и в подтверждениях удаления
+const eventProducer = "recommendations"
+
+const ackDeliveryTimeout = 10 * time.Second
+
+var ackProducer *kafka.Producer
+
+func initAckProducer() {
+	var err error
+	ackProducer, err = kafka.NewProducer(&kafka.ConfigMap{"bootstrap.servers": os.Getenv("KAFKA_BROKER")})
+	if err != nil {
+		log.Fatalf("Не удалось создать продюсер: %s", err)
+	}
+}
+
+func processUserDeleted(envelope events.Envelope) {
+	event, err := envelope.User()
+	if err != nil {
+		log.Printf("Error decoding %s payload: %s", envelope.Type, err)
+		return
+	}
+	eraseErr := eraseUser(event.UserID)
+	if eraseErr != nil {
+		log.Printf("Error erasing user %d: %v", event.UserID, eraseErr)
+	} else {
+		log.Printf("User %d erased", event.UserID)
+	}
+	// Без подтверждения users опубликует событие заново
+	if err := publishErasureAck(event, eraseErr); err != nil {
+		log.Printf("Error acknowledging erasure %s: %v", event.DeletionID, err)
+	}
+}
+
+func eraseUser(userID int) error {
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT INTO erased_users (user_id) VALUES ($1) ON CONFLICT DO NOTHING", userID); err != nil {
+		return err
+	}
+	rows, err := tx.Query("SELECT p.id, p.category FROM likes l JOIN products p ON p.id = l.product_id WHERE l.user_id = $1", userID)
+	if err != nil {
+		return err
+	}
+	var liked []int
+	categories := map[int]string{}
+	for rows.Next() {
+		var id int
+		var category string
+		if err := rows.Scan(&id, &category); err != nil {
+			rows.Close()
+			return err
+		}
+		liked = append(liked, id)
+		categories[id] = category
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Каждая пара лайкнутых пользователем продуктов теряет один совместный лайк
+	_, err = tx.Exec("UPDATE product_cooccurrence SET common_likes = common_likes - 1 WHERE product_a = ANY($1) AND product_b = ANY($1)", idArray(liked))
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM product_cooccurrence WHERE common_likes <= 0 AND product_a = ANY($1)", idArray(liked)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE products SET likes = GREATEST(likes - 1, 0) WHERE id = ANY($1)", idArray(liked)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM likes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM recommendations WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// Топы категорий и похожие продукты для остальных пользователей изменились
+	for _, id := range liked {
+		invalidateRecommendations(id, []string{categories[id]})
+	}
+	return purgeUserCache(userID)
+}
+
+// skipErasedUser сообщает, что лайк или анлайк от удаленного пользователя нужно пропустить
+func skipErasedUser(event events.ProductPayload) bool {
+	var erased bool
+	err := db.GetDB().QueryRow("SELECT EXISTS (SELECT 1 FROM erased_users WHERE user_id = $1)", event.UserID).Scan(&erased)
+	if err != nil {
+		log.Printf("Error checking erasure of user %d: %v", event.UserID, err)
+		return true
+	}
+	if erased {
+		log.Printf("Skipping like change of erased user %d for product %d", event.UserID, event.ProductID)
+	}
+	return erased
+}
+
+// purgeUserCache удаляет ключи пользователя в Redis. Смены версии недостаточно:
+// старые записи дожили бы до TTL, а у счетчиков запросов TTL нет.
+func purgeUserCache(userID int) error {
+	patterns := []string{
+		fmt.Sprintf("recommendations:%d:*", userID),
+		fmt.Sprintf("request_count:%d:*", userID),
+	}
+	keys := []string{userVersionKey(userID)}
+	for _, pattern := range patterns {
+		iter := redisClient.Scan(ctx, 0, pattern, 100).Iterator()
+		for iter.Next(ctx) {
+			keys = append(keys, iter.Val())
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+	}
+	return redisClient.Del(ctx, keys...).Err()
+}
+
+// publishErasureAck сообщает users об успехе или ошибке и ждет подтверждения доставки
+func publishErasureAck(event events.UserPayload, eraseErr error) error {
+	eventType := events.UserErasureCompleted
+	ack := events.ErasurePayload{DeletionID: event.DeletionID, UserID: event.UserID, Service: eventProducer}
+	if eraseErr != nil {
+		eventType = events.UserErasureFailed
+		ack.Error = eraseErr.Error()
+	}
+	envelope, err := events.New(eventProducer, eventType, ack)
+	if err != nil {
+		return err
+	}
+	data, err := envelope.Encode()
+	if err != nil {
+		return err
+	}
+
+	topic := eventType.Topic()
+	deliveryChan := make(chan kafka.Event, 1)
+	err = ackProducer.Produce(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Value:          data,
+	}, deliveryChan)
+	if err != nil {
+		return err
+	}
+	select {
+	case e := <-deliveryChan:
+		if m, ok := e.(*kafka.Message); ok {
+			return m.TopicPartition.Error
+		}
+		return nil
+	case <-time.After(ackDeliveryTimeout):
+		return errors.New("delivery report timed out")
+	}
+}
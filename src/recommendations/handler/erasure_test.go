@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"bytes"
+	"events"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// Лайк, опубликованный до удаления, может прийти в product_updates уже после
+// user.deleted из user_updates: он не должен вернуть стертые данные
+func TestLikeAfterErasureIsSkipped(t *testing.T) {
+	for _, eventType := range []events.Type{events.ProductLiked, events.ProductUnliked} {
+		t.Run(string(eventType), func(t *testing.T) {
+			useMiniredis(t)
+			mock := useSQLMock(t)
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+			mock.ExpectBegin()
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO erased_users")).WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT p.id, p.category FROM likes")).WithArgs(7).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "category"}))
+			mock.ExpectExec(regexp.QuoteMeta("UPDATE product_cooccurrence")).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec(regexp.QuoteMeta("DELETE FROM product_cooccurrence")).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec(regexp.QuoteMeta("UPDATE products SET likes")).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec(regexp.QuoteMeta("DELETE FROM likes WHERE user_id = $1")).WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec(regexp.QuoteMeta("DELETE FROM recommendations WHERE user_id = $1")).WithArgs(7).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectCommit()
+			if err := eraseUser(7); err != nil {
+				t.Fatal(err)
+			}
+
+			// Дальше проверки стирания запросов быть не должно
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS (SELECT 1 FROM erased_users")).WithArgs(7).
+				WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+			envelope, err := events.New("products", eventType, events.ProductPayload{ProductID: 3, UserID: 7, Category: "books", Likes: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			processKafkaMessage(envelope)
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+			if !strings.Contains(logs.String(), "Skipping like change of erased user 7") || strings.Contains(logs.String(), "Error") {
+				t.Errorf("log = %q, want the event skipped without further queries", logs.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"auth/access"
+	"recommendations/db"
+)
+
+// Данные пользователя для выгрузки по запросу users; пользователь — из токена сервиса.
+// Кэш в Redis не выгружается: он повторяет сохраненные рекомендации.
+type UserDataExport struct {
+	UserID          int                    `json:"user_id"`
+	Likes           []ExportedLike         `json:"likes"`
+	Recommendations []StoredRecommendation `json:"recommendations"`
+}
+
+type ExportedLike struct {
+	ProductID int    `json:"product_id"`
+	Category  string `json:"category"`
+}
+
+// StoredRecommendation строка сохраненного списка для страницы продукта ProductID
+type StoredRecommendation struct {
+	ProductID     int       `json:"product_id"`
+	Rank          int       `json:"rank"`
+	RecommendedID int       `json:"recommended_id"`
+	Score         float64   `json:"score"`
+	Reason        string    `json:"reason"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+func exportUserData(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	p, _ := access.FromContext(r.Context())
+	export, err := loadUserData(p.ID)
+	if err != nil {
+		http.Error(w, "Could not export user data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(export)
+}
+
+func loadUserData(userID int) (UserDataExport, error) {
+	export := UserDataExport{UserID: userID, Likes: []ExportedLike{}, Recommendations: []StoredRecommendation{}}
+
+	rows, err := db.GetDB().Query(`SELECT l.product_id, COALESCE(p.category, '')
+		FROM likes l LEFT JOIN products p ON p.id = l.product_id
+		WHERE l.user_id = $1 ORDER BY l.id`, userID)
+	if err != nil {
+		return export, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var like ExportedLike
+		if err := rows.Scan(&like.ProductID, &like.Category); err != nil {
+			return export, err
+		}
+		export.Likes = append(export.Likes, like)
+	}
+	if err := rows.Err(); err != nil {
+		return export, err
+	}
+
+	rows, err = db.GetDB().Query(`SELECT product_id, rank, recommended_id, score, reason, created_at
+		FROM recommendations WHERE user_id = $1 ORDER BY product_id, rank`, userID)
+	if err != nil {
+		return export, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rec StoredRecommendation
+		if err := rows.Scan(&rec.ProductID, &rec.Rank, &rec.RecommendedID, &rec.Score, &rec.Reason, &rec.CreatedAt); err != nil {
+			return export, err
+		}
+		export.Recommendations = append(export.Recommendations, rec)
+	}
+	return export, rows.Err()
+}
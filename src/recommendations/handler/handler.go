@@ -1,16 +1,20 @@
 package handler
 
 import (
+	"auth"
+	"auth/access"
 	"context"
 	"database/sql"
 	"encoding/json"
+	"events"
 	"fmt"
+	"health"
 	"log"
 	"net/http"
 	"os"
 	"recommendations/db"
 	"strconv"
-	"time"
+	"sync/atomic"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/go-redis/redis/v8"
@@ -26,15 +30,8 @@ var redisClient = redis.NewClient(&redis.Options{
 // Порог для кеширования
 const cacheThreshold = 5
 
-type KafkaMessage struct {
-	Action             string `json:"action"`
-	UserID             int    `json:"user_id"`
-	ProductID          string `json:"product_id"`
-	ProductCategory    string `json:"product_category"`
-	NumberOfLikes      int    `json:"number_of_likes"`
-	ProductDescription string `json:"description"`
-	ProductName        string `json:"name"`
-}
+// Текущий консьюмер product_updates, нужен для проверки готовности
+var kafkaConsumer atomic.Pointer[kafka.Consumer]
 
 type Product struct {
 	ID       int
@@ -43,12 +40,18 @@ type Product struct {
 }
 
 type RecommendationRequest struct {
-	UserID    int `json:"user_id"`
-	ProductID int `json:"product_id"`
+	UserID    int    `json:"user_id"`
+	ProductID int    `json:"product_id"`
+	Strategy  string `json:"strategy,omitempty"` // имя стратегии или цепочка "a,b"; пусто — из конфигурации
+	Exclude   []int  `json:"exclude,omitempty"`
+	Limit     int    `json:"limit,omitempty"`  // размер страницы, по умолчанию defaultRecommendationsLimit
+	Offset    int    `json:"offset,omitempty"` // сколько первых рекомендаций пропустить
 }
 
 type RecommendationResponce struct {
-	ProductID int `json:"id"`
+	ProductID int     `json:"id"`
+	Score     float64 `json:"score,omitempty"`
+	Reason    string  `json:"reason,omitempty"`
 }
 
 func recommend(w http.ResponseWriter, r *http.Request) {
@@ -62,6 +65,27 @@ func recommend(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	if err := normalizePage(&req.Limit, &req.Offset); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Явно выбранная стратегия считается на лету, мимо БД и кэша:
+	// они хранят результат стратегии из конфигурации
+	if req.Strategy != "" || len(req.Exclude) > 0 {
+		strategy, err := ResolveStrategy(req.Strategy)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		recommendations, err := recommendWith(strategy, req.UserID, req.ProductID, req.Exclude, req.Offset+req.Limit)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting recommendations: %v", err), http.StatusInternalServerError)
+			return
+		}
+		sendResponse(w, paginate(convertRecommendations(recommendations), req.Limit, req.Offset))
+		return
+	}
 
 	response, err := getRecommendationsFromCache(req.UserID, req.ProductID)
 	if err != nil {
@@ -69,7 +93,7 @@ func recommend(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if response != nil {
-		sendResponse(w, response)
+		sendResponse(w, paginate(response, req.Limit, req.Offset))
 		return
 	}
 
@@ -93,40 +117,47 @@ func recommend(w http.ResponseWriter, r *http.Request) {
 		cacheRecommendations(req.UserID, req.ProductID, response)
 	}
 
-	sendResponse(w, response)
+	sendResponse(w, paginate(response, req.Limit, req.Offset))
 }
 
-func convertRecommendations(recommendations []Product) []RecommendationResponce {
-	response := make([]RecommendationResponce, len(recommendations))
-	for i, product := range recommendations {
-		response[i].ProductID = product.ID
+// normalizePage подставляет размер страницы по умолчанию и проверяет границы.
+// Дальше maxStoredRecommendations рекомендации не рассчитываются.
+func normalizePage(limit *int, offset *int) error {
+	if *limit == 0 {
+		*limit = defaultRecommendationsLimit
 	}
-	return response
-}
-
-func cacheRecommendations(userID int, productID int, recommendations []RecommendationResponce) {
-	cacheKey := fmt.Sprintf("recommendations:%d:%d", userID, productID)
-	recommendationsJSON, err := json.Marshal(recommendations)
-	if err == nil {
-		redisClient.Set(ctx, cacheKey, recommendationsJSON, 10*time.Minute)
+	if *limit < 0 || *offset < 0 {
+		return fmt.Errorf("limit and offset must not be negative")
 	}
+	if *limit > maxStoredRecommendations {
+		*limit = maxStoredRecommendations
+	}
+	if *offset > maxStoredRecommendations {
+		*offset = maxStoredRecommendations
+	}
+	if *offset+*limit > maxStoredRecommendations {
+		*limit = maxStoredRecommendations - *offset
+	}
+	return nil
 }
 
-func getRecommendationsFromCache(userID int, productID int) ([]RecommendationResponce, error) {
-	cacheKey := fmt.Sprintf("recommendations:%d:%d", userID, productID)
-	cachedRecommendations, err := redisClient.Get(ctx, cacheKey).Result()
-	if err != nil {
-		if err == redis.Nil {
-			return nil, nil
-		}
-		return nil, err
+func paginate(recommendations []RecommendationResponce, limit int, offset int) []RecommendationResponce {
+	if offset >= len(recommendations) {
+		return []RecommendationResponce{}
+	}
+	end := offset + limit
+	if end > len(recommendations) {
+		end = len(recommendations)
 	}
+	return recommendations[offset:end]
+}
 
-	var response []RecommendationResponce
-	if err := json.Unmarshal([]byte(cachedRecommendations), &response); err != nil {
-		return nil, err
+func convertRecommendations(recommendations []Candidate) []RecommendationResponce {
+	response := make([]RecommendationResponce, len(recommendations))
+	for i, candidate := range recommendations {
+		response[i] = RecommendationResponce{ProductID: candidate.ID, Score: candidate.Score, Reason: candidate.Reason}
 	}
-	return response, nil
+	return response
 }
 
 func incrementRequestCount(userID int, productID int) {
@@ -157,55 +188,30 @@ func sendResponse(w http.ResponseWriter, response []RecommendationResponce) {
 	}
 }
 
-func getRecommendations(userID int, productID int) ([]Product, error) {
-	liked, err := isProductLikedByUser(userID, productID)
+const (
+	// Размер страницы, если клиент не указал limit
+	defaultRecommendationsLimit = 3
+	// Сколько рекомендаций рассчитывается и хранится для пары (пользователь, продукт)
+	maxStoredRecommendations = 50
+)
+
+// getRecommendations подбирает полный ранжированный список стратегией из конфигурации
+func getRecommendations(userID int, productID int) ([]Candidate, error) {
+	strategy, err := ResolveStrategy("")
 	if err != nil {
 		return nil, err
 	}
-
-	var result []Product
-	if liked {
-		result, err = getRecommendationsForLikedProduct(productID)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		result, err = getRecommendationsForUnlikedProduct(userID)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	// Если количество рекомендаций меньше 3, добавляем топ залайканные продукты
-	if len(result) < 3 {
-		topLikedProducts, err := getTopLikedProducts()
-		if err != nil {
-			return nil, err
-		}
-
-		// Добавляем недостающие продукты из топа
-		for _, product := range topLikedProducts {
-			// Проверяем, чтобы не добавлять дубликаты
-			if len(result) >= 3 {
-				break
-			}
-			// Проверяем, что продукт не уже в результатах
-			if !containsProduct(result, product) {
-				result = append(result, product)
-			}
-		}
-	}
-
-	return result, nil
+	return recommendWith(strategy, userID, productID, nil, maxStoredRecommendations)
 }
 
-func containsProduct(products []Product, product Product) bool {
-	for _, p := range products {
-		if p.ID == product.ID {
-			return true
-		}
-	}
-	return false
+// recommendWith подбирает рекомендации заданной стратегией; текущий продукт не рекомендуется
+func recommendWith(strategy Strategy, userID int, productID int, exclude []int, limit int) ([]Candidate, error) {
+	return strategy.Recommend(StrategyRequest{
+		UserID:    userID,
+		ProductID: productID,
+		Limit:     limit,
+		Exclude:   append([]int{productID}, exclude...),
+	})
 }
 
 func isProductLikedByUser(userID int, productID int) (bool, error) {
@@ -214,60 +220,19 @@ func isProductLikedByUser(userID int, productID int) (bool, error) {
 	return liked, err
 }
 
-func getRecommendationsForLikedProduct(productID int) ([]Product, error) {
-	category, err := getProductCategory(productID)
-	if err != nil {
-		return nil, err
-	}
-
-	recommendations, err := getTopProductsByCategory(category)
-	if err != nil {
-		return nil, err
-	}
-
-	if len(recommendations) == 0 {
-		return getTopLikedProducts()
-	}
-
-	return recommendations, nil
-}
-
 func getProductCategory(productID int) (string, error) {
 	var category string
 	err := db.GetDB().QueryRow("SELECT category FROM products WHERE id = $1", productID).Scan(&category)
 	return category, err
 }
 
-func getTopProductsByCategory(category string) ([]Product, error) {
-	rows, err := db.GetDB().Query("SELECT id, category, likes FROM products WHERE category = $1 ORDER BY likes DESC LIMIT 3", category)
+func getTopProductsByCategory(category string, limit int, exclude []int) ([]Product, error) {
+	rows, err := db.GetDB().Query("SELECT id, category, likes FROM products WHERE category = $1 AND NOT (id = ANY($3)) ORDER BY likes DESC LIMIT $2", category, limit, idArray(exclude))
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-
-	var products []Product
-	for rows.Next() {
-		var p Product
-		if err := rows.Scan(&p.ID, &p.Category, &p.Likes); err != nil {
-			return nil, err
-		}
-		products = append(products, p)
-	}
-
-	return products, nil
-}
-
-func getRecommendationsForUnlikedProduct(userID int) ([]Product, error) {
-	categories, err := getLikedCategoriesByUser(userID)
-	if err != nil {
-		return nil, err
-	}
-
-	if len(categories) == 0 {
-		return getTopLikedProducts()
-	}
-
-	return getProductsFromLikedCategories(categories)
+	return scanProducts(rows)
 }
 
 func getLikedCategoriesByUser(userID int) ([]string, error) {
@@ -290,44 +255,34 @@ func getLikedCategoriesByUser(userID int) ([]string, error) {
 	return categories, nil
 }
 
-func getProductsFromLikedCategories(categories []string) ([]Product, error) {
+func getProductsFromLikedCategories(categories []string, limit int, exclude []int) ([]Product, error) {
 	var recommendations []Product
 
 	for _, category := range categories {
-		rows, err := db.GetDB().Query("SELECT id, category, likes FROM products WHERE category = $1 ORDER BY likes DESC LIMIT 3", category)
+		products, err := getTopProductsByCategory(category, limit-len(recommendations), exclude)
 		if err != nil {
 			return nil, err
 		}
-		defer rows.Close()
-
-		for rows.Next() {
-			var p Product
-			if err := rows.Scan(&p.ID, &p.Category, &p.Likes); err != nil {
-				return nil, err
-			}
-			recommendations = append(recommendations, p)
-			if len(recommendations) >= 3 { // Ограничиваем до 3 рекомендаций
-				return recommendations[:3], nil
-			}
+		recommendations = append(recommendations, products...)
+		if len(recommendations) >= limit {
+			return recommendations[:limit], nil
 		}
 	}
 
-	// Если все равно меньше 3 рекомендаций:
-	if len(recommendations) > 3 {
-		return recommendations[:3], nil
-	}
 	return recommendations, nil
 }
 
-func getTopLikedProducts() ([]Product, error) {
-	var products []Product
-
-	rows, err := db.GetDB().Query("SELECT id, category, likes FROM products ORDER BY likes DESC LIMIT 3")
+func getTopLikedProducts(limit int, exclude []int) ([]Product, error) {
+	rows, err := db.GetDB().Query("SELECT id, category, likes FROM products WHERE NOT (id = ANY($2)) ORDER BY likes DESC LIMIT $1", limit, idArray(exclude))
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
+	return scanProducts(rows)
+}
 
+func scanProducts(rows *sql.Rows) ([]Product, error) {
+	var products []Product
 	for rows.Next() {
 		var p Product
 		if err := rows.Scan(&p.ID, &p.Category, &p.Likes); err != nil {
@@ -335,32 +290,86 @@ func getTopLikedProducts() ([]Product, error) {
 		}
 		products = append(products, p)
 	}
-
-	return products, nil
+	return products, rows.Err()
 }
 
 func top3(w http.ResponseWriter, r *http.Request) {
-	recommendations, err := getTopLikedProducts()
+	writeTopLiked(w, 3, 0)
+}
+
+// Самые залайканные продукты с пагинацией: /recommendations/top?limit=&offset=
+func topLiked(w http.ResponseWriter, r *http.Request) {
+	limit, err := queryInt(r, "limit")
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error getting recommendations: %v", err), http.StatusInternalServerError)
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+	offset, err := queryInt(r, "offset")
+	if err != nil {
+		http.Error(w, "Invalid offset", http.StatusBadRequest)
+		return
+	}
+	if err := normalizePage(&limit, &offset); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	writeTopLiked(w, limit, offset)
+}
 
-	top3 := make([]RecommendationResponce, 3)
+func writeTopLiked(w http.ResponseWriter, limit int, offset int) {
+	response, err := getTopLikedFromCache(offset + limit)
+	if err != nil {
+		log.Printf("Error getting top products from cache: %v", err)
+	}
+	if response == nil {
+		recommendations, err := getTopLikedProducts(offset+limit, nil)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting recommendations: %v", err), http.StatusInternalServerError)
+			return
+		}
+		response = convertRecommendations(toCandidates(recommendations, "most liked overall"))
+		cacheTopLiked(offset+limit, response)
+	}
+	sendResponse(w, paginate(response, limit, offset))
+}
 
-	for i, id := range recommendations {
-		top3[i].ProductID = id.ID
+func queryInt(r *http.Request, name string) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return 0, nil
 	}
-	if err := json.NewEncoder(w).Encode(top3); err != nil {
-		http.Error(w, "Error encoding response", http.StatusInternalServerError)
-		return
+	return strconv.Atoi(v)
+}
+
+// Открытые ключи для проверки токенов публикует сервис пользователей
+const defaultJWKSURL = "http://user-service:9999/users/.well-known/jwks.json"
+
+func jwksURL() string {
+	if url := os.Getenv("JWKS_URL"); url != "" {
+		return url
 	}
+	return defaultJWKSURL
 }
 
 func InitializeRoutes() {
 	db.Connect()
-	http.HandleFunc("/recommendations/", recommend)
-	http.HandleFunc("/recommendations/top3", top3)
+	if _, err := ResolveStrategy(""); err != nil {
+		log.Fatalf("Invalid RECOMMENDATION_STRATEGY: %v", err)
+	}
+	verifier := auth.NewJWKSVerifier(jwksURL(), auth.RevocationStoreFromEnv())
+	registerRoutes(access.NewRouter(http.DefaultServeMux, verifier))
+}
+
+// registerRoutes маршруты сервиса. Рекомендации products запрашивает внутри сети
+// без токена пользователя, поэтому они публичные; выгрузку данных вызывает users.
+func registerRoutes(rt *access.Router) {
+	rt.HandleFunc("/recommendations/", access.Public(), recommend)
+	rt.HandleFunc("/recommendations/top3", access.Public(), top3)
+	rt.HandleFunc("/recommendations/top", access.Public(), topLiked)
+	rt.HandleFunc("/recommendations/internal/export", access.Service(auth.PurposeDataExport), exportUserData)
+
+	rt.HandleFunc("/health", access.Public(), health.Live)
+	rt.HandleFunc("/ready", access.Public(), ready)
 }
 
 /*
@@ -369,7 +378,11 @@ KAFKA
 
 */
 
+// Топики консьюмера: изменения продуктов и удаление пользователей
+var consumedTopics = []string{events.TopicProductUpdates, events.TopicUserUpdates}
+
 func InitKafka() {
+	initAckProducer()
 	consumer, err := kafka.NewConsumer(&kafka.ConfigMap{
 		"bootstrap.servers": os.Getenv("KAFKA_BROKER"),
 		"group.id":          "recommendations",
@@ -379,9 +392,10 @@ func InitKafka() {
 		log.Fatalf("Ошибка создания консьюмера: %v", err)
 	}
 	defer consumer.Close()
+	kafkaConsumer.Store(consumer)
+	defer kafkaConsumer.Store(nil)
 
-	// Подписка на топик
-	consumer.SubscribeTopics([]string{"product_updates"}, nil)
+	consumer.SubscribeTopics(consumedTopics, nil)
 
 	// Чтение сообщений
 	kafkaLoop(consumer)
@@ -392,12 +406,12 @@ func kafkaLoop(consumer *kafka.Consumer) {
 	for {
 		msg, err := consumer.ReadMessage(-1)
 		if err == nil {
-			var event KafkaMessage
-			if err := json.Unmarshal(msg.Value, &event); err != nil {
-				log.Printf("Error unmarshalling message: %s", err)
+			envelope, err := events.Decode(msg.Value)
+			if err != nil {
+				log.Printf("Error decoding message: %s", err)
 				continue
 			}
-			processKafkaMessage(event)
+			processKafkaMessage(envelope)
 		} else {
 			log.Printf("Error while consuming message: %s", err)
 		}
@@ -405,53 +419,149 @@ func kafkaLoop(consumer *kafka.Consumer) {
 	}
 }
 
-func processKafkaMessage(event KafkaMessage) {
-	switch event.Action {
-	case "like":
+func processKafkaMessage(envelope events.Envelope) {
+	if envelope.Type == events.UserDeleted {
+		processUserDeleted(envelope)
+		return
+	}
+	if envelope.Type.Topic() != events.TopicProductUpdates {
+		return
+	}
+	event, err := envelope.Product()
+	if err != nil {
+		log.Printf("Error decoding %s payload: %s", envelope.Type, err)
+		return
+	}
+
+	switch envelope.Type {
+	case events.ProductLiked:
 		processLike(event)
-	case "unlike":
+	case events.ProductUnliked:
 		processUnlike(event)
+	case events.ProductCreated, events.ProductUpdated:
+		processProductUpsert(event)
+	case events.ProductDeleted:
+		processProductDelete(event)
+	}
+}
+
+// Функция для обработки создания и изменения продукта
+func processProductUpsert(event events.ProductPayload) {
+	productID := event.ProductID
+
+	// Рекомендации зависят только от категории и лайков продукта: если они не
+	// поменялись (например, переименование), сбрасывать нечего. Если поменялась
+	// категория, затронуты и старая, и новая
+	categories := []string{event.Category}
+	var oldCategory string
+	var oldLikes int
+	err := db.GetDB().QueryRow("SELECT category, likes FROM products WHERE id = $1", productID).Scan(&oldCategory, &oldLikes)
+	changed := err != nil || oldCategory != event.Category || oldLikes != event.Likes
+	if err == nil && oldCategory != event.Category {
+		categories = append(categories, oldCategory)
 	}
+
+	if err := upsertProduct(productID, event.Category, event.Likes); err != nil {
+		log.Printf("Error upserting product into database: %v", err)
+		return
+	}
+	if changed {
+		invalidateRecommendations(productID, categories)
+	}
+
+	log.Printf("Product %d synced", productID)
+}
+
+// Функция для обработки удаления продукта
+func processProductDelete(event events.ProductPayload) {
+	productID := event.ProductID
+
+	// Сначала сбрасываем рекомендации, пока продукт ещё связан со своей категорией
+	invalidateRecommendations(productID, []string{event.Category})
+
+	// Лайки удаляются каскадно
+	if _, err := db.GetDB().Exec("DELETE FROM products WHERE id = $1", productID); err != nil {
+		log.Printf("Error deleting product from database: %v", err)
+		return
+	}
+
+	log.Printf("Product %d deleted", productID)
+}
+
+func upsertProduct(productID int, category string, likes int) error {
+	_, err := db.GetDB().Exec(`INSERT INTO products (id, category, likes) VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO UPDATE SET category = EXCLUDED.category, likes = EXCLUDED.likes`,
+		productID, category, likes)
+	return err
 }
 
 // Функция для обработки лайков
-func processLike(event KafkaMessage) {
-	query := `INSERT INTO likes (user_id, product_id) VALUES ($1, $2)`
-	if _, err := db.GetDB().Exec(query, event.UserID, event.ProductID); err != nil {
-		log.Printf("Error inserting like into database: %v", err)
+func processLike(event events.ProductPayload) {
+	if skipErasedUser(event) {
 		return
 	}
-	productId, _ := strconv.Atoi(event.ProductID)
-	if isRecommendationInDB(event.UserID, productId) {
-		updateRecommendationInDB(event.UserID, productId)
+	productId := event.ProductID
+	shifted := likesRankingShifted(productId, event.Category, event.Likes)
+	if err := upsertProduct(productId, event.Category, event.Likes); err != nil {
+		log.Printf("Error syncing product likes: %v", err)
+		return
 	}
+	if err := addUserLike(event.UserID, productId); err != nil {
+		log.Printf("Error inserting like into database: %v", err)
+		return
+	}
+	invalidateAfterLikeChange(event.UserID, productId, event.Category, shifted)
 
-	log.Printf("User %d liked product %s", event.UserID, event.ProductID)
+	log.Printf("User %d liked product %d", event.UserID, event.ProductID)
 }
 
 // Функция для обработки анлайков
-func processUnlike(event KafkaMessage) {
-	query := `DELETE FROM likes WHERE user_id = $1 AND product_id = $2`
-	if _, err := db.GetDB().Exec(query, event.UserID, event.ProductID); err != nil {
-		log.Printf("Error deleting like from database: %v", err)
+func processUnlike(event events.ProductPayload) {
+	if skipErasedUser(event) {
 		return
 	}
-	productId, _ := strconv.Atoi(event.ProductID)
-	if isRecommendationInDB(event.UserID, productId) {
-		updateRecommendationInDB(event.UserID, productId)
+	productId := event.ProductID
+	shifted := likesRankingShifted(productId, event.Category, event.Likes)
+	if err := upsertProduct(productId, event.Category, event.Likes); err != nil {
+		log.Printf("Error syncing product likes: %v", err)
+		return
 	}
+	if err := removeUserLike(event.UserID, productId); err != nil {
+		log.Printf("Error deleting like from database: %v", err)
+		return
+	}
+	invalidateAfterLikeChange(event.UserID, productId, event.Category, shifted)
 
-	log.Printf("User %d unliked product %s", event.UserID, event.ProductID)
+	log.Printf("User %d unliked product %d", event.UserID, event.ProductID)
 }
 
+// addRecommendationToBD сохраняет ранжированный список рекомендаций для пары (пользователь, продукт)
 func addRecommendationToBD(userID int, productID int, recommendations []RecommendationResponce) {
-	query := `INSERT INTO recommendations (user_id, product_id, recommendation1, recommendation2, recommendation3) VALUES ($1, $2, $3, $4, $5)`
-	if _, err := db.GetDB().Exec(query, userID, productID, recommendations[0].ProductID, recommendations[1].ProductID, recommendations[2].ProductID); err != nil {
+	if err := saveRecommendations(userID, productID, recommendations); err != nil {
 		log.Printf("Error adding recommendation to database: %v", err)
-		return
 	}
 }
 
+func saveRecommendations(userID int, productID int, recommendations []RecommendationResponce) error {
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM recommendations WHERE user_id = $1 AND product_id = $2", userID, productID); err != nil {
+		return err
+	}
+	for rank, rec := range recommendations {
+		_, err := tx.Exec("INSERT INTO recommendations (user_id, product_id, rank, recommended_id, score, reason) VALUES ($1, $2, $3, $4, $5, $6)",
+			userID, productID, rank+1, rec.ProductID, rec.Score, rec.Reason)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 func isRecommendationInDB(userID int, productID int) bool {
 	var exists bool
 	db.GetDB().QueryRow("SELECT EXISTS(SELECT 1 FROM recommendations WHERE user_id = $1 AND product_id = $2)", userID, productID).Scan(&exists)
@@ -459,27 +569,32 @@ func isRecommendationInDB(userID int, productID int) bool {
 }
 
 func getRecommendationFromDB(userID int, productID int) []RecommendationResponce {
-	recommendations := make([]RecommendationResponce, 3)
-	err := db.GetDB().QueryRow("SELECT recommendation1, recommendation2, recommendation3 FROM recommendations WHERE user_id = $1 AND product_id = $2", userID, productID).Scan(&recommendations[0].ProductID, &recommendations[1].ProductID, &recommendations[2].ProductID)
-	if err == sql.ErrNoRows {
+	rows, err := db.GetDB().Query("SELECT recommended_id, score, reason FROM recommendations WHERE user_id = $1 AND product_id = $2 ORDER BY rank", userID, productID)
+	if err != nil {
 		log.Printf("Error getting recommendation from database: %v", err)
 		return nil
 	}
+	defer rows.Close()
+
+	recommendations := []RecommendationResponce{}
+	for rows.Next() {
+		var rec RecommendationResponce
+		if err := rows.Scan(&rec.ProductID, &rec.Score, &rec.Reason); err != nil {
+			log.Printf("Error getting recommendation from database: %v", err)
+			return nil
+		}
+		recommendations = append(recommendations, rec)
+	}
 	return recommendations
 }
 
-// func isRecommendationInRedis(userID int, productID int) bool {}
-
 func updateRecommendationInDB(userID int, productID int) {
 	recommendations, err := getRecommendations(userID, productID)
 	if err != nil {
 		log.Printf("Error getting recommendation from database: %v", err)
 		return
 	}
-	_, err = db.GetDB().Exec("UPDATE recommendations SET recommendation1 = $3, recommendation2 = $4, recommendation3 = $5 WHERE user_id = $1 AND product_id = $2",
-		userID, productID, recommendations[0].ID, recommendations[1].ID, recommendations[2].ID)
-
-	if err != nil {
+	if err := saveRecommendations(userID, productID, convertRecommendations(recommendations)); err != nil {
 		log.Printf("Error updating recommendation from database: %v", err)
 		return
 	}
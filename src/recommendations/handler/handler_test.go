@@ -0,0 +1,62 @@
+package handler
+
+import "testing"
+
+func TestNormalizePage(t *testing.T) {
+	tests := []struct {
+		name          string
+		limit, offset int
+		wantLimit     int
+		wantOffset    int
+		wantErr       bool
+	}{
+		{"defaults", 0, 0, defaultRecommendationsLimit, 0, false},
+		{"explicit", 10, 5, 10, 5, false},
+		{"limit is capped", 500, 0, maxStoredRecommendations, 0, false},
+		{"window ends at the stored list", 20, 40, maxStoredRecommendations - 40, 40, false},
+		{"offset past the stored list", 10, 80, 0, maxStoredRecommendations, false},
+		{"negative limit", -1, 0, 0, 0, true},
+		{"negative offset", 5, -1, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limit, offset := tt.limit, tt.offset
+			err := normalizePage(&limit, &offset)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("normalizePage error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (limit != tt.wantLimit || offset != tt.wantOffset) {
+				t.Errorf("normalizePage = limit %d offset %d, want %d %d", limit, offset, tt.wantLimit, tt.wantOffset)
+			}
+		})
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	list := make([]RecommendationResponce, 5)
+	for i := range list {
+		list[i].ProductID = i + 1
+	}
+	tests := []struct {
+		name          string
+		limit, offset int
+		want          []int
+	}{
+		{"first page", 2, 0, []int{1, 2}},
+		{"last partial page", 2, 4, []int{5}},
+		{"past the end", 2, 5, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := paginate(list, tt.limit, tt.offset)
+			if len(got) != len(tt.want) {
+				t.Fatalf("paginate = %v, want %v", got, tt.want)
+			}
+			for i, r := range got {
+				if r.ProductID != tt.want[i] {
+					t.Errorf("paginate = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"health"
+	"recommendations/db"
+)
+
+// Readiness: проверяем Postgres, Kafka и Redis
+func ready(w http.ResponseWriter, r *http.Request) {
+	health.WriteReadiness(w, r, map[string]health.Check{
+		"postgres": func(ctx context.Context) error {
+			return db.GetDB().PingContext(ctx)
+		},
+		"kafka": func(ctx context.Context) error {
+			consumer := kafkaConsumer.Load()
+			if consumer == nil {
+				return errors.New("consumer is not initialized")
+			}
+			for _, topic := range consumedTopics {
+				if _, err := consumer.GetMetadata(&topic, false, health.RemainingMs(ctx)); err != nil {
+					return fmt.Errorf("%s: %w", topic, err)
+				}
+			}
+			return nil
+		},
+		"redis": func(ctx context.Context) error {
+			return redisClient.Ping(ctx).Err()
+		},
+	})
+}
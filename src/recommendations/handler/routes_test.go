@@ -0,0 +1,25 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+
+	"auth"
+	"auth/access"
+	"auth/access/accesstest"
+)
+
+func TestRoutePolicies(t *testing.T) {
+	rt := access.NewRouter(http.NewServeMux(), auth.NewJWKSVerifier("http://localhost/jwks.json", auth.NewMemoryRevocationStore()))
+	registerRoutes(rt)
+
+	accesstest.CheckPolicies(t, rt, map[string]access.Policy{
+		"/recommendations/":                access.Public(),
+		"/recommendations/top3":            access.Public(),
+		"/recommendations/top":             access.Public(),
+		"/recommendations/internal/export": access.Service(auth.PurposeDataExport),
+		"/health":                          access.Public(),
+		"/ready":                           access.Public(),
+	})
+	accesstest.CheckNoDirectRoutes(t, ".")
+}
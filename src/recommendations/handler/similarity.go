@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"recommendations/db"
+)
+
+// Item-to-item collaborative filtering: "пользователи, лайкнувшие этот продукт,
+// лайкали и эти". Матрица совместных лайков product_cooccurrence хранится в обе
+// стороны и обновляется инкрементально на событиях лайков.
+
+const (
+	// Минимум пользователей, лайкнувших оба продукта, чтобы пара считалась похожей
+	similarityMinSupport = 2
+)
+
+// addUserLike сохраняет лайк и увеличивает счетчики совместных лайков.
+// Повторная доставка того же события ничего не меняет.
+func addUserLike(userID int, productID int) error {
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT INTO likes (user_id, product_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`, userID, productID)
+	if err != nil {
+		return err
+	}
+	if inserted, _ := result.RowsAffected(); inserted == 0 {
+		return nil
+	}
+
+	_, err = tx.Exec(`INSERT INTO product_cooccurrence (product_a, product_b, common_likes)
+		SELECT pair.a, pair.b, 1 FROM (
+			SELECT $2::int AS a, l.product_id AS b FROM likes l WHERE l.user_id = $1 AND l.product_id <> $2
+			UNION ALL
+			SELECT l.product_id AS a, $2::int AS b FROM likes l WHERE l.user_id = $1 AND l.product_id <> $2
+		) pair
+		ON CONFLICT (product_a, product_b) DO UPDATE SET common_likes = product_cooccurrence.common_likes + 1`,
+		userID, productID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// removeUserLike удаляет лайк и уменьшает счетчики совместных лайков
+func removeUserLike(userID int, productID int) error {
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM likes WHERE user_id = $1 AND product_id = $2`, userID, productID)
+	if err != nil {
+		return err
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return nil
+	}
+
+	_, err = tx.Exec(`UPDATE product_cooccurrence SET common_likes = common_likes - 1
+		WHERE (product_a = $2 AND product_b IN (SELECT product_id FROM likes WHERE user_id = $1))
+			OR (product_b = $2 AND product_a IN (SELECT product_id FROM likes WHERE user_id = $1))`,
+		userID, productID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM product_cooccurrence WHERE common_likes <= 0 AND (product_a = $1 OR product_b = $1)`, productID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// getSimilarProducts возвращает продукты, похожие на productID по косинусной мере
+// над векторами лайков пользователей. Продукты, уже лайкнутые пользователем,
+// не предлагаются. Пары с поддержкой меньше similarityMinSupport отбрасываются,
+// поэтому при редких данных результат может быть пустым.
+func getSimilarProducts(userID int, productID int, limit int, exclude []int) ([]Candidate, error) {
+	rows, err := db.GetDB().Query(`SELECT id, category, likes, score FROM (
+			SELECT p.id, p.category, p.likes, c.common_likes / sqrt(
+				(SELECT COUNT(*) FROM likes WHERE product_id = c.product_a)::float *
+				(SELECT COUNT(*) FROM likes WHERE product_id = c.product_b)::float
+			) AS score
+			FROM product_cooccurrence c
+			JOIN products p ON p.id = c.product_b
+			WHERE c.product_a = $2 AND c.common_likes >= $3
+				AND NOT (c.product_b = ANY($5))
+				AND NOT EXISTS (SELECT 1 FROM likes l WHERE l.user_id = $1 AND l.product_id = c.product_b)
+		) similar
+		ORDER BY score DESC, likes DESC, id
+		LIMIT $4`,
+		userID, productID, similarityMinSupport, limit, idArray(exclude))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var candidates []Candidate
+	for rows.Next() {
+		c := Candidate{Reason: "liked together with this product"}
+		if err := rows.Scan(&c.ID, &c.Category, &c.Likes, &c.Score); err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates, rows.Err()
+}
@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"regexp"
+	"testing"
+
+	"recommendations/db"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// Повторное событие лайка (или анлайка) не меняет матрицу совместных лайков:
+// если строка в likes не добавилась (не удалилась), счетчики не трогаются.
+func TestLikeChangesAreIdempotent(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(userID, productID int) error
+		like    string
+		counter string
+		cleanup bool // удаление обнулившихся пар
+	}{
+		{"addUserLike", addUserLike, "INSERT INTO likes (user_id, product_id) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+			"INSERT INTO product_cooccurrence", false},
+		{"removeUserLike", removeUserLike, "DELETE FROM likes WHERE user_id = $1 AND product_id = $2",
+			"UPDATE product_cooccurrence SET common_likes = common_likes - 1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			db.SetDB(conn)
+
+			// Первая доставка меняет лайк и счетчики
+			mock.ExpectBegin()
+			mock.ExpectExec(regexp.QuoteMeta(tt.like)).WithArgs(3, 5).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(regexp.QuoteMeta(tt.counter)).WithArgs(3, 5).WillReturnResult(sqlmock.NewResult(0, 2))
+			if tt.cleanup {
+				mock.ExpectExec(regexp.QuoteMeta("DELETE FROM product_cooccurrence WHERE common_likes <= 0")).
+					WithArgs(5).WillReturnResult(sqlmock.NewResult(0, 0))
+			}
+			mock.ExpectCommit()
+			// Повторная — только пытается изменить лайк
+			mock.ExpectBegin()
+			mock.ExpectExec(regexp.QuoteMeta(tt.like)).WithArgs(3, 5).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectRollback()
+
+			for i := 0; i < 2; i++ {
+				if err := tt.change(3, 5); err != nil {
+					t.Fatalf("delivery %d: %v", i+1, err)
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package handler
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Strategy стратегия подбора рекомендаций. Стратегии регистрируются по имени
+// и выбираются конфигурацией или полем strategy запроса; несколько имен через
+// запятую образуют цепочку.
+type Strategy interface {
+	Name() string
+	Recommend(req StrategyRequest) ([]Candidate, error)
+}
+
+// StrategyRequest входные данные стратегии
+type StrategyRequest struct {
+	UserID    int
+	ProductID int
+	Limit     int
+	Exclude   []int // продукты, которые нельзя рекомендовать
+}
+
+// Candidate рекомендованный продукт с оценкой и причиной.
+// Оценки сравнимы только внутри одной стратегии.
+type Candidate struct {
+	Product
+	Score  float64
+	Reason string
+}
+
+// Стратегия по умолчанию, если не задана переменной окружения RECOMMENDATION_STRATEGY
+const defaultStrategySpec = "similar,category,top_liked"
+
+var strategies = map[string]Strategy{}
+
+// RegisterStrategy добавляет стратегию в реестр
+func RegisterStrategy(s Strategy) {
+	strategies[s.Name()] = s
+}
+
+// StrategyNames возвращает имена зарегистрированных стратегий
+func StrategyNames() []string {
+	names := make([]string, 0, len(strategies))
+	for name := range strategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ResolveStrategy находит стратегию или собирает цепочку по спецификации вида "a,b,c".
+// Пустая спецификация означает стратегию из конфигурации.
+func ResolveStrategy(spec string) (Strategy, error) {
+	if strings.TrimSpace(spec) == "" {
+		spec = configuredStrategySpec()
+	}
+
+	var steps []Strategy
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		s, ok := strategies[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown strategy %q, available: %s", name, strings.Join(StrategyNames(), ", "))
+		}
+		steps = append(steps, s)
+	}
+	if len(steps) == 1 {
+		return steps[0], nil
+	}
+	return chainStrategy{steps: steps}, nil
+}
+
+func configuredStrategySpec() string {
+	if spec := os.Getenv("RECOMMENDATION_STRATEGY"); spec != "" {
+		return spec
+	}
+	return defaultStrategySpec
+}
+
+// chainStrategy по очереди спрашивает стратегии, пока не наберет Limit кандидатов
+type chainStrategy struct {
+	steps []Strategy
+}
+
+func (c chainStrategy) Name() string {
+	names := make([]string, len(c.steps))
+	for i, s := range c.steps {
+		names[i] = s.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+func (c chainStrategy) Recommend(req StrategyRequest) ([]Candidate, error) {
+	var result []Candidate
+	exclude := append([]int(nil), req.Exclude...)
+
+	for _, step := range c.steps {
+		if len(result) >= req.Limit {
+			break
+		}
+		stepReq := req
+		stepReq.Limit = req.Limit - len(result)
+		stepReq.Exclude = exclude
+
+		candidates, err := step.Recommend(stepReq)
+		if err != nil {
+			return nil, fmt.Errorf("strategy %s: %w", step.Name(), err)
+		}
+		for _, candidate := range candidates {
+			if len(result) >= req.Limit {
+				break
+			}
+			if containsID(exclude, candidate.ID) {
+				continue
+			}
+			result = append(result, candidate)
+			exclude = append(exclude, candidate.ID)
+		}
+	}
+	return result, nil
+}
+
+// funcStrategy адаптер для стратегий-функций
+type funcStrategy struct {
+	name string
+	fn   func(req StrategyRequest) ([]Candidate, error)
+}
+
+func (s funcStrategy) Name() string { return s.name }
+
+func (s funcStrategy) Recommend(req StrategyRequest) ([]Candidate, error) {
+	return s.fn(req)
+}
+
+func init() {
+	RegisterStrategy(funcStrategy{name: "similar", fn: similarStrategy})
+	RegisterStrategy(funcStrategy{name: "category", fn: categoryStrategy})
+	RegisterStrategy(funcStrategy{name: "top_liked", fn: topLikedStrategy})
+}
+
+// "Пользователи, лайкнувшие этот продукт, лайкали и эти"
+func similarStrategy(req StrategyRequest) ([]Candidate, error) {
+	return getSimilarProducts(req.UserID, req.ProductID, req.Limit, req.Exclude)
+}
+
+// Если продукт лайкнут — топ его категории, иначе топ категорий, которые лайкает пользователь
+func categoryStrategy(req StrategyRequest) ([]Candidate, error) {
+	liked, err := isProductLikedByUser(req.UserID, req.ProductID)
+	if err != nil {
+		return nil, err
+	}
+
+	if liked {
+		category, err := getProductCategory(req.ProductID)
+		if err != nil {
+			return nil, err
+		}
+		products, err := getTopProductsByCategory(category, req.Limit, req.Exclude)
+		if err != nil {
+			return nil, err
+		}
+		return toCandidates(products, "top in category "+category), nil
+	}
+
+	categories, err := getLikedCategoriesByUser(req.UserID)
+	if err != nil {
+		return nil, err
+	}
+	products, err := getProductsFromLikedCategories(categories, req.Limit, req.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	return toCandidates(products, "popular in a category you like"), nil
+}
+
+// Самые залайканные продукты в системе
+func topLikedStrategy(req StrategyRequest) ([]Candidate, error) {
+	products, err := getTopLikedProducts(req.Limit, req.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	return toCandidates(products, "most liked overall"), nil
+}
+
+// Оценка по количеству лайков
+func toCandidates(products []Product, reason string) []Candidate {
+	candidates := make([]Candidate, len(products))
+	for i, p := range products {
+		candidates[i] = Candidate{Product: p, Score: float64(p.Likes), Reason: reason}
+	}
+	return candidates
+}
+
+// idArray готовит список ID для "= ANY($n)". pq.Array превращает nil-срез в NULL,
+// и тогда условие NOT (id = ANY(NULL)) отбрасывает все строки.
+func idArray(ids []int) pq.Int64Array {
+	arr := make(pq.Int64Array, len(ids))
+	for i, id := range ids {
+		arr[i] = int64(id)
+	}
+	return arr
+}
+
+func containsID(ids []int, id int) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// fixedStrategy возвращает заданные продукты и запоминает, сколько раз ее спросили
+type fixedStrategy struct {
+	name  string
+	ids   []int
+	err   error
+	calls *int
+}
+
+func (s fixedStrategy) Name() string { return s.name }
+
+func (s fixedStrategy) Recommend(req StrategyRequest) ([]Candidate, error) {
+	*s.calls++
+	if s.err != nil {
+		return nil, s.err
+	}
+	var result []Candidate
+	for _, id := range s.ids {
+		if len(result) == req.Limit {
+			break
+		}
+		if containsID(req.Exclude, id) {
+			continue
+		}
+		result = append(result, Candidate{Product: Product{ID: id}, Reason: s.name})
+	}
+	return result, nil
+}
+
+func TestResolveStrategy(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		env     string
+		want    string
+		wantErr bool
+	}{
+		{"single", "similar", "", "similar", false},
+		{"chain", "category, top_liked", "", "category,top_liked", false},
+		{"default", "", "", defaultStrategySpec, false},
+		{"from environment", " ", "top_liked", "top_liked", false},
+		{"unknown", "similar,magic", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("RECOMMENDATION_STRATEGY", tt.env)
+			s, err := ResolveStrategy(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResolveStrategy(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			}
+			if err == nil && s.Name() != tt.want {
+				t.Errorf("ResolveStrategy(%q) = %s, want %s", tt.spec, s.Name(), tt.want)
+			}
+		})
+	}
+}
+
+func TestChainStrategyFallback(t *testing.T) {
+	boom := errors.New("boom")
+	tests := []struct {
+		name      string
+		first     []int
+		second    []int
+		secondErr error
+		exclude   []int
+		limit     int
+		want      []int
+		wantCalls int // сколько раз спросили вторую стратегию
+		wantErr   bool
+	}{
+		{"first is enough", []int{1, 2, 3}, []int{4}, nil, nil, 3, []int{1, 2, 3}, 0, false},
+		{"falls back for the rest", []int{1}, []int{4, 5, 6}, nil, nil, 3, []int{1, 4, 5}, 1, false},
+		{"excludes earlier picks in fallback", []int{1, 2}, []int{2, 7, 8}, nil, []int{1}, 3, []int{2, 7, 8}, 1, false},
+		{"nothing found", nil, nil, nil, nil, 3, nil, 1, false},
+		{"error in fallback", []int{1}, nil, boom, nil, 3, nil, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var firstCalls, secondCalls int
+			chain := chainStrategy{steps: []Strategy{
+				fixedStrategy{name: "first", ids: tt.first, calls: &firstCalls},
+				fixedStrategy{name: "second", ids: tt.second, err: tt.secondErr, calls: &secondCalls},
+			}}
+			candidates, err := chain.Recommend(StrategyRequest{Limit: tt.limit, Exclude: tt.exclude})
+			if !errors.Is(err, tt.secondErr) || (err != nil) != tt.wantErr {
+				t.Fatalf("Recommend error = %v, want %v", err, tt.secondErr)
+			}
+			var got []int
+			for _, c := range candidates {
+				got = append(got, c.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Recommend = %v, want %v", got, tt.want)
+			}
+			if secondCalls != tt.wantCalls {
+				t.Errorf("fallback called %d times, want %d", secondCalls, tt.wantCalls)
+			}
+		})
+	}
+}
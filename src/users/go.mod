@@ -3,8 +3,30 @@ module users
 go 1.23.1
 
 require (
+	github.com/DATA-DOG/go-sqlmock v1.5.2
+	github.com/confluentinc/confluent-kafka-go v1.9.2
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/go-redis/redis/v8 v8.11.5
 	github.com/lib/pq v1.10.9
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	golang.org/x/crypto v0.32.0
-	github.com/confluentinc/confluent-kafka-go v1.9.2
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+)
+
+require (
+	auth v0.0.0
+	events v0.0.0
+	health v0.0.0
+	outbox v0.0.0
+)
+
+replace (
+	auth => ../auth
+	events => ../events
+	health => ../health
+	outbox => ../outbox
 )
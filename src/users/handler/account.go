@@ -0,0 +1,282 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"auth/access"
+	"events"
+	"users/db"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Текущий пользователь определяется только токеном доступа из cookie.
+// Изменять профиль может сам владелец или пользователь с правом user:manage.
+
+var (
+	errUserNotFound = errors.New("user not found")
+	errEmailTaken   = errors.New("email is already in use")
+	errInvalidEmail = errors.New("invalid email")
+)
+
+// canManage: свой профиль или любой профиль для того, кто управляет пользователями
+func canManage(p access.Principal, userID int) bool {
+	return p.ID == userID || p.Can(access.UserManage)
+}
+
+type Profile struct {
+	User
+	PendingEmail string `json:"pending_email,omitempty"`
+}
+
+type ProfileUpdate struct {
+	Name  *string `json:"name"`
+	Email *string `json:"email"`
+}
+
+type PasswordChange struct {
+	CurrentPass string `json:"current_pass"`
+	NewPass     string `json:"new_pass"`
+}
+
+// authenticate возвращает пользователя, проверенного middleware маршрута;
+// на публичном маршруте его нет, и тогда ответ 401
+func authenticate(w http.ResponseWriter, r *http.Request) (access.Principal, bool) {
+	p, ok := access.FromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	}
+	return p, ok
+}
+
+// targetUserID профиль из параметра id, по умолчанию свой.
+// Чужой профиль доступен только администратору.
+func targetUserID(w http.ResponseWriter, r *http.Request, p access.Principal) (int, bool) {
+	id := p.ID
+	if v := r.URL.Query().Get("id"); v != "" {
+		var err error
+		id, err = strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return 0, false
+		}
+	}
+	if !canManage(p, id) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return 0, false
+	}
+	return id, true
+}
+
+func loadProfile(userID int) (Profile, error) {
+	var profile Profile
+	var pendingEmail sql.NullString
+	err := db.GetDB().QueryRow("SELECT id, name, email, role, email_verified_at IS NOT NULL, pending_email FROM users WHERE id = $1", userID).
+		Scan(&profile.ID, &profile.Name, &profile.Email, &profile.Role, &profile.EmailVerified, &pendingEmail)
+	if err == sql.ErrNoRows {
+		return profile, errUserNotFound
+	}
+	profile.PendingEmail = pendingEmail.String
+	return profile, err
+}
+
+// updateProfile меняет имя сразу, а новый email сохраняет как ожидающий
+// подтверждения и отправляет письма на новый и старый адреса
+func updateProfile(userID int, name string, email string) error {
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return errInvalidEmail
+	}
+
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var currentEmail string
+	err = tx.QueryRow("SELECT email FROM users WHERE id = $1 FOR UPDATE", userID).Scan(&currentEmail)
+	if err == sql.ErrNoRows {
+		return errUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	// Новый email сохраняется отдельно и применяется только после подтверждения
+	eventType := events.UserUpdated
+	pendingEmail := ""
+	if email != currentEmail {
+		if checkIfExist(email) {
+			return errEmailTaken
+		}
+		eventType = events.UserEmailChangeRequested
+		pendingEmail = email
+		_, err = tx.Exec("UPDATE users SET name = $1, pending_email = $2 WHERE id = $3", name, email, userID)
+	} else {
+		_, err = tx.Exec("UPDATE users SET name = $1 WHERE id = $2", name, userID)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Сообщение для кафки пишем в outbox в той же транзакции
+	msg := events.UserPayload{
+		UserID:       userID,
+		Name:         name,
+		Email:        currentEmail,
+		PendingEmail: pendingEmail,
+	}
+	if err := enqueueEvent(tx, eventType, msg); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if pendingEmail != "" {
+		user := User{ID: userID, Name: name, Email: currentEmail}
+		sendEmailVerification(user, pendingEmail)
+		sendEmailChangeNotice(user, pendingEmail)
+	}
+	return nil
+}
+
+// Код ответа для ошибок updateProfile
+func profileErrorStatus(err error) int {
+	switch err {
+	case errInvalidEmail:
+		return http.StatusBadRequest
+	case errUserNotFound:
+		return http.StatusNotFound
+	case errEmailTaken:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// /users/me: GET — свой профиль, PUT/PATCH — изменение имени и email
+func me(w http.ResponseWriter, r *http.Request) {
+	p, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPatch:
+		var update ProfileUpdate
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		current, err := loadProfile(p.ID)
+		if err != nil {
+			http.Error(w, "Could not update profile", profileErrorStatus(err))
+			return
+		}
+		name, email := current.Name, current.Email
+		if update.Name != nil {
+			name = *update.Name
+		}
+		if update.Email != nil {
+			email = *update.Email
+		}
+		if err := updateProfile(p.ID, name, email); err != nil {
+			http.Error(w, err.Error(), profileErrorStatus(err))
+			return
+		}
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	profile, err := loadProfile(p.ID)
+	if err != nil {
+		http.Error(w, "Could not load profile", profileErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
+
+// /users/me/password: смена пароля с проверкой текущего.
+// Остальные сессии пользователя завершаются, текущая остается.
+func changePassword(w http.ResponseWriter, r *http.Request) {
+	if !isPostRequest(w, r) {
+		return
+	}
+	p, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	var req PasswordChange
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.NewPass == "" {
+		http.Error(w, "New password is required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		http.Error(w, "Could not change password", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var user User
+	err = tx.QueryRow("SELECT id, name, email, COALESCE(pass, '') FROM users WHERE id = $1 FOR UPDATE", p.ID).Scan(&user.ID, &user.Name, &user.Email, &user.Pass)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not change password", http.StatusInternalServerError)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Pass), []byte(req.CurrentPass)) != nil {
+		http.Error(w, "Invalid password", http.StatusUnauthorized)
+		return
+	}
+
+	hashedPassword, err := hashPassword(req.NewPass)
+	if err != nil {
+		http.Error(w, "Could not hash password", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("UPDATE users SET pass = $1 WHERE id = $2", hashedPassword, user.ID); err != nil {
+		http.Error(w, "Could not change password", http.StatusInternalServerError)
+		return
+	}
+	msg := events.UserPayload{
+		UserID: user.ID,
+		Name:   user.Name,
+		Email:  user.Email,
+	}
+	if err := enqueueEvent(tx, events.UserPasswordChanged, msg); err != nil {
+		http.Error(w, "Could not change password", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Could not change password", http.StatusInternalServerError)
+		return
+	}
+
+	if err := revokeUserSessions(r.Context(), user.ID, p.SessionID); err != nil {
+		http.Error(w, "Password changed, but other sessions could not be ended", http.StatusInternalServerError)
+		return
+	}
+	sendMail(user.Email, "Пароль изменен", "password_changed", passwordMail{
+		Name: user.Name,
+		Link: publicURL() + "/users/password/forgot",
+	})
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password changed"})
+}
@@ -0,0 +1,309 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"auth/access"
+	"events"
+	"users/db"
+)
+
+// Управление пользователями (право user:manage): список с поиском, смена роли,
+// блокировка и принудительный выход. Каждое действие публикуется в user_updates.
+// Смена роли, блокировка и выход завершают все сессии пользователя, поэтому
+// старые токены перестают приниматься сразу.
+
+const (
+	defaultAdminPageLimit = 20
+	maxAdminPageLimit     = 100
+)
+
+var (
+	errSelfAction  = errors.New("admins cannot apply this action to themselves")
+	errInvalidRole = errors.New("invalid role")
+)
+
+type AdminUser struct {
+	ID            int        `json:"id"`
+	Name          string     `json:"name"`
+	Email         string     `json:"email"`
+	Role          string     `json:"role"`
+	EmailVerified bool       `json:"email_verified"`
+	Status        string     `json:"status"`
+	SuspendedAt   *time.Time `json:"suspended_at,omitempty"`
+	LockedUntil   *time.Time `json:"locked_until,omitempty"` // временная блокировка входа после неудачных попыток
+}
+
+type AdminUserList struct {
+	Items  []AdminUser `json:"items"`
+	Total  int         `json:"total"`
+	Limit  int         `json:"limit"`
+	Offset int         `json:"offset"`
+}
+
+type AdminAction struct {
+	ID   int    `json:"id"`
+	Role string `json:"role,omitempty"`
+}
+
+// Страница управления пользователями
+func adminUsersPage(w http.ResponseWriter, r *http.Request) {
+	tmpl := template.Must(template.ParseFiles("templates/admin_users.html"))
+	tmpl.Execute(w, nil)
+}
+
+// Список пользователей: q — поиск по имени и email, role, status (pending, active, suspended), limit, offset
+func adminListUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	list := AdminUserList{Items: []AdminUser{}, Limit: defaultAdminPageLimit}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		if limit > maxAdminPageLimit {
+			limit = maxAdminPageLimit
+		}
+		list.Limit = limit
+	}
+	if v := q.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+		list.Offset = offset
+	}
+	status := q.Get("status")
+	if status != "" && status != events.UserStatusPending && status != events.UserStatusActive && status != events.UserStatusSuspended {
+		http.Error(w, "invalid status", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.GetDB().Query(`SELECT id, name, email, role, email_verified_at IS NOT NULL, suspended_at, locked_until, COUNT(*) OVER ()
+		FROM users
+		WHERE ($1 = '' OR lower(name) LIKE $1 ESCAPE '\' OR lower(email) LIKE $1 ESCAPE '\')
+			AND ($2 = '' OR role = $2)
+			AND ($3 = ''
+				OR ($3 = 'suspended' AND suspended_at IS NOT NULL)
+				OR ($3 = 'pending' AND suspended_at IS NULL AND email_verified_at IS NULL)
+				OR ($3 = 'active' AND suspended_at IS NULL AND email_verified_at IS NOT NULL))
+		ORDER BY id
+		LIMIT $4 OFFSET $5`,
+		likePattern(q.Get("q")), q.Get("role"), status, list.Limit, list.Offset)
+	if err != nil {
+		log.Printf("Error listing users: %v", err)
+		http.Error(w, "Could not list users", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user AdminUser
+		var suspendedAt, lockedUntil sql.NullTime
+		if err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.Role, &user.EmailVerified, &suspendedAt, &lockedUntil, &list.Total); err != nil {
+			http.Error(w, "Could not list users", http.StatusInternalServerError)
+			return
+		}
+		user.setSuspended(suspendedAt)
+		user.setLocked(lockedUntil)
+		list.Items = append(list.Items, user)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Could not list users", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// Смена роли
+func adminChangeRole(w http.ResponseWriter, r *http.Request) {
+	adminUserAction(w, r, events.UserRoleChanged, true, func(tx *sql.Tx, actor access.Principal, action AdminAction, user *AdminUser) error {
+		if !access.KnownRole(action.Role) {
+			return errInvalidRole
+		}
+		if user.ID == actor.ID {
+			return errSelfAction
+		}
+		user.Role = action.Role
+		_, err := tx.Exec("UPDATE users SET role = $1 WHERE id = $2", action.Role, user.ID)
+		return err
+	})
+}
+
+// Блокировка: вход и обновление токенов запрещены, текущие сессии завершаются
+func adminSuspendUser(w http.ResponseWriter, r *http.Request) {
+	adminUserAction(w, r, events.UserSuspended, true, func(tx *sql.Tx, actor access.Principal, action AdminAction, user *AdminUser) error {
+		if user.ID == actor.ID {
+			return errSelfAction
+		}
+		now := time.Now()
+		user.setSuspended(sql.NullTime{Time: now, Valid: true})
+		_, err := tx.Exec("UPDATE users SET suspended_at = COALESCE(suspended_at, $1) WHERE id = $2", now, user.ID)
+		return err
+	})
+}
+
+// Снятие блокировки
+func adminUnsuspendUser(w http.ResponseWriter, r *http.Request) {
+	adminUserAction(w, r, events.UserUnsuspended, false, func(tx *sql.Tx, actor access.Principal, action AdminAction, user *AdminUser) error {
+		user.setSuspended(sql.NullTime{})
+		_, err := tx.Exec("UPDATE users SET suspended_at = NULL WHERE id = $1", user.ID)
+		return err
+	})
+}
+
+// Снятие временной блокировки входа и сброс счетчика неудачных попыток
+func adminUnlockUser(w http.ResponseWriter, r *http.Request) {
+	var email string
+	// Событие user.unlocked публикует unlockAccountTx, и только если вход был заблокирован
+	ok := adminUserAction(w, r, "", false, func(tx *sql.Tx, actor access.Principal, action AdminAction, user *AdminUser) error {
+		user.LockedUntil = nil
+		email = user.Email
+		return unlockAccountTx(tx, User{ID: user.ID, Name: user.Name, Email: user.Email}, actor.ID, unlockReasonAdmin)
+	})
+	// Счетчик сбрасывается только после фиксации транзакции
+	if ok {
+		resetLoginFailures(r.Context(), email)
+	}
+}
+
+// Принудительный выход из всех сессий
+func adminForceLogout(w http.ResponseWriter, r *http.Request) {
+	adminUserAction(w, r, events.UserSessionsRevoked, true, func(tx *sql.Tx, actor access.Principal, action AdminAction, user *AdminUser) error {
+		return nil
+	})
+}
+
+// adminUserAction общий порядок действий над пользователем: проверка прав,
+// изменение в транзакции вместе с событием, затем при необходимости завершение сессий.
+// Пустой eventType — событие публикует сам apply. Возвращает true, если изменение зафиксировано.
+func adminUserAction(w http.ResponseWriter, r *http.Request, eventType events.Type, endSessions bool,
+	apply func(tx *sql.Tx, actor access.Principal, action AdminAction, user *AdminUser) error) bool {
+	if !isPostRequest(w, r) {
+		return false
+	}
+	actor, ok := authenticate(w, r)
+	if !ok {
+		return false
+	}
+	var action AdminAction
+	if err := json.NewDecoder(r.Body).Decode(&action); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		http.Error(w, "Could not update user", http.StatusInternalServerError)
+		return false
+	}
+	defer tx.Rollback()
+
+	var user AdminUser
+	var suspendedAt, lockedUntil sql.NullTime
+	err = tx.QueryRow("SELECT id, name, email, role, email_verified_at IS NOT NULL, suspended_at, locked_until FROM users WHERE id = $1 FOR UPDATE", action.ID).
+		Scan(&user.ID, &user.Name, &user.Email, &user.Role, &user.EmailVerified, &suspendedAt, &lockedUntil)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		http.Error(w, "Could not update user", http.StatusInternalServerError)
+		return false
+	}
+	user.setSuspended(suspendedAt)
+	user.setLocked(lockedUntil)
+
+	if err := apply(tx, actor, action, &user); err != nil {
+		if err == errSelfAction || err == errInvalidRole {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return false
+		}
+		http.Error(w, "Could not update user", http.StatusInternalServerError)
+		return false
+	}
+
+	if eventType != "" {
+		msg := events.UserPayload{
+			UserID:  user.ID,
+			Name:    user.Name,
+			Email:   user.Email,
+			Status:  user.Status,
+			Role:    user.Role,
+			ActorID: actor.ID,
+		}
+		if err := enqueueEvent(tx, eventType, msg); err != nil {
+			http.Error(w, "Could not update user", http.StatusInternalServerError)
+			return false
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Could not update user", http.StatusInternalServerError)
+		return false
+	}
+
+	if endSessions {
+		if err := revokeUserSessions(r.Context(), user.ID, ""); err != nil {
+			log.Printf("Error revoking sessions of user %d: %v", user.ID, err)
+			http.Error(w, "User updated, but sessions could not be ended", http.StatusInternalServerError)
+			return true
+		}
+	}
+	log.Printf("Admin %d: %s for user %d", actor.ID, r.URL.Path, user.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+	return true
+}
+
+func (u *AdminUser) setSuspended(suspendedAt sql.NullTime) {
+	u.SuspendedAt = nil
+	if suspendedAt.Valid {
+		u.SuspendedAt = &suspendedAt.Time
+	}
+	u.Status = userStatus(u.EmailVerified, suspendedAt.Valid)
+}
+
+// setLocked показывает только действующую блокировку
+func (u *AdminUser) setLocked(lockedUntil sql.NullTime) {
+	u.LockedUntil = nil
+	if lockedUntil.Valid && lockedUntil.Time.After(time.Now()) {
+		u.LockedUntil = &lockedUntil.Time
+	}
+}
+
+func userStatus(emailVerified bool, suspended bool) string {
+	switch {
+	case suspended:
+		return events.UserStatusSuspended
+	case !emailVerified:
+		return events.UserStatusPending
+	}
+	return events.UserStatusActive
+}
+
+// likePattern строка поиска для LIKE без спецсимволов
+func likePattern(q string) string {
+	q = strings.ToLower(strings.TrimSpace(q))
+	if q == "" {
+		return ""
+	}
+	q = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(q)
+	return "%" + q + "%"
+}
@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Адреса прокси (nginx), которым доверяется заголовок X-Real-IP; TRUSTED_PROXIES —
+// IP-адреса и подсети через запятую. Без него заголовок игнорируется, иначе клиент,
+// обратившийся к сервису напрямую, подставлял бы любой адрес в обход лимита по IP.
+var trustedProxies []*net.IPNet
+
+func initTrustedProxies() {
+	var err error
+	trustedProxies, err = parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatalf("Некорректный TRUSTED_PROXIES: %s", err)
+	}
+}
+
+// parseTrustedProxies разбирает список IP-адресов и подсетей в нотации CIDR
+func parseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		// Отдельный адрес — подсеть из одного адреса
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// clientIP адрес клиента; X-Real-IP учитывается, только если запрос пришел от доверенного прокси
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" && isTrustedProxy(host) {
+		return ip
+	}
+	return host
+}
+
+func isTrustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
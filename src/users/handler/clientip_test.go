@@ -0,0 +1,65 @@
+package handler
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.5, 192.168.1.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := trustedProxies
+	trustedProxies = proxies
+	defer func() { trustedProxies = saved }()
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		realIP     string
+		want       string
+	}{
+		{"direct request", "203.0.113.7:5000", "", "203.0.113.7"},
+		{"spoofed header", "203.0.113.7:5000", "1.2.3.4", "203.0.113.7"},
+		{"trusted proxy address", "10.0.0.5:5000", "198.51.100.1", "198.51.100.1"},
+		{"trusted proxy subnet", "192.168.1.20:5000", "198.51.100.2", "198.51.100.2"},
+		{"proxy without header", "10.0.0.5:5000", "", "10.0.0.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/users/password/forgot/submit", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := clientIP(r); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"172.28.0.10", 1, false},
+		{"10.0.0.0/8, ::1", 2, false},
+		{"nginx", 0, true},
+		{"10.0.0.0/33", 0, true},
+	}
+	for _, tt := range tests {
+		nets, err := parseTrustedProxies(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTrustedProxies(%q) error = %v", tt.value, err)
+			continue
+		}
+		if len(nets) != tt.want {
+			t.Errorf("parseTrustedProxies(%q) = %d networks, want %d", tt.value, len(nets), tt.want)
+		}
+	}
+}
@@ -0,0 +1,418 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"auth"
+	"auth/access"
+	"events"
+	"users/db"
+
+	kafka "github.com/confluentinc/confluent-kafka-go/kafka"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Удаление аккаунта — сага по сервисам. users в одной транзакции удаляет строку
+// пользователя (вместе с сессиями, связями OIDC и 2FA) и его события в outbox,
+// создает запись удаления с шагом на каждый сервис и публикует user.deleted.
+// products, recommendations и analytics стирают или обезличивают свои данные
+// и отвечают в топик user_erasure. Шаг без подтверждения в течение
+// deletionAckTimeout или с ошибкой публикуется заново; обработчики в сервисах
+// идемпотентны, поэтому повтор безопасен.
+
+const (
+	deletionStepPending = "pending" // событие опубликовано, ждем подтверждения
+	deletionStepFailed  = "failed"  // сервис сообщил об ошибке, повтор запланирован
+	deletionStepDone    = "done"
+
+	deletionInProgress = "in_progress"
+	deletionCompleted  = "completed"
+
+	deletionAckTimeout      = 10 * time.Minute
+	deletionRetryMinBackoff = 30 * time.Second
+	deletionRetryMaxBackoff = time.Hour
+	deletionPollInterval    = 30 * time.Second
+)
+
+// Сервисы, которые должны подтвердить стирание данных
+var erasureServices = []string{"products", "recommendations", "analytics"}
+
+// Текущий консьюмер user_erasure, нужен для проверки готовности
+var erasureConsumer atomic.Pointer[kafka.Consumer]
+
+var errLastAdmin = errors.New("cannot delete the last administrator")
+
+// DeleteAccountRequest подтверждение удаления: пароль, а для аккаунта без
+// пароля (вход только через OIDC) — его email
+type DeleteAccountRequest struct {
+	Pass  string `json:"pass"`
+	Email string `json:"email"`
+}
+
+type DeletionStatus struct {
+	ID          string         `json:"id"`
+	Status      string         `json:"status"`
+	RequestedAt time.Time      `json:"requested_at"`
+	CompletedAt *time.Time     `json:"completed_at,omitempty"`
+	Steps       []DeletionStep `json:"steps"`
+}
+
+type DeletionStep struct {
+	Service       string     `json:"service"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"last_error,omitempty"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	CompletedAt   *time.Time `json:"completed_at,omitempty"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+}
+
+// Удаление своего аккаунта; ответ содержит адрес статуса удаления
+func deleteAccount(w http.ResponseWriter, r *http.Request) {
+	if !isPostRequest(w, r) {
+		return
+	}
+	p, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	var req DeleteAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		http.Error(w, "Could not delete account", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var user User
+	err = tx.QueryRow("SELECT id, name, email, COALESCE(pass, ''), role FROM users WHERE id = $1 FOR UPDATE", p.ID).
+		Scan(&user.ID, &user.Name, &user.Email, &user.Pass, &user.Role)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not delete account", http.StatusInternalServerError)
+		return
+	}
+	if user.Pass != "" {
+		if bcrypt.CompareHashAndPassword([]byte(user.Pass), []byte(req.Pass)) != nil {
+			http.Error(w, "Invalid password", http.StatusUnauthorized)
+			return
+		}
+	} else if !strings.EqualFold(strings.TrimSpace(req.Email), user.Email) {
+		http.Error(w, "Confirm deletion with your email", http.StatusBadRequest)
+		return
+	}
+
+	deletionID, sessions, err := deleteUser(tx, user)
+	if err == errLastAdmin {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error deleting user %d: %v", user.ID, err)
+		http.Error(w, "Could not delete account", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Could not delete account", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %d deleted, erasure %s started", user.ID, deletionID)
+
+	// Строк сессий уже нет, но выданные токены доступа еще действуют
+	for _, sessionID := range sessions {
+		if err := auth.RevokeSession(r.Context(), verifier.Revocations(), sessionID, time.Now().Add(accessTokenTTL)); err != nil {
+			log.Printf("Error revoking session %s: %v", sessionID, err)
+		}
+	}
+	resetLoginFailures(r.Context(), user.Email)
+	clearAuthCookies(w)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"id": deletionID, "status_url": "/users/deletions/" + deletionID})
+}
+
+// deleteUser удаляет пользователя и начинает сагу в транзакции tx.
+// Возвращает ID удаления и сессии, которые нужно отозвать после коммита.
+func deleteUser(tx *sql.Tx, user User) (string, []string, error) {
+	if user.Role == access.RoleAdmin {
+		var others bool
+		err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE role = $1 AND id <> $2 AND suspended_at IS NULL)", access.RoleAdmin, user.ID).Scan(&others)
+		if err != nil {
+			return "", nil, err
+		}
+		if !others {
+			return "", nil, errLastAdmin
+		}
+	}
+
+	deletionID, err := auth.NewID()
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err := tx.Exec("INSERT INTO account_deletions (id, user_id) VALUES ($1, $2)", deletionID, user.ID); err != nil {
+		return "", nil, err
+	}
+	// Данные в самом users стираются в этой транзакции
+	_, err = tx.Exec(`INSERT INTO account_deletion_steps (deletion_id, service, status, next_attempt_at, completed_at)
+		VALUES ($1, $2, $3, now(), now())`, deletionID, eventProducer, deletionStepDone)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, service := range erasureServices {
+		_, err := tx.Exec(`INSERT INTO account_deletion_steps (deletion_id, service, status, next_attempt_at)
+			VALUES ($1, $2, $3, now() + $4 * interval '1 second')`, deletionID, service, deletionStepPending, deletionAckTimeout.Seconds())
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	// Прежние события пользователя в outbox содержат имя и email, поэтому удаляются
+	// вместе с ним, в том числе еще не опубликованные: user.deleted все равно сотрет
+	// их данные в сервисах
+	if _, err := tx.Exec("DELETE FROM outbox WHERE aggregate_key = $1", events.UserKey(user.ID)); err != nil {
+		return "", nil, err
+	}
+	if err := enqueueEvent(tx, events.UserDeleted, events.UserPayload{UserID: user.ID, DeletionID: deletionID}); err != nil {
+		return "", nil, err
+	}
+
+	rows, err := tx.Query("SELECT id FROM sessions WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > now()", user.ID)
+	if err != nil {
+		return "", nil, err
+	}
+	var sessions []string
+	for rows.Next() {
+		var sessionID string
+		if err := rows.Scan(&sessionID); err != nil {
+			rows.Close()
+			return "", nil, err
+		}
+		sessions = append(sessions, sessionID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", nil, err
+	}
+
+	// Сессии, refresh-токены, связи OIDC и 2FA удаляются каскадно
+	if _, err := tx.Exec("DELETE FROM users WHERE id = $1", user.ID); err != nil {
+		return "", nil, err
+	}
+	return deletionID, sessions, nil
+}
+
+// Ход удаления по сервисам. ID удаления случайный и служит доступом к статусу:
+// аккаунта, от имени которого можно было бы войти, уже нет.
+func deletionStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	status := DeletionStatus{ID: r.PathValue("id"), Status: deletionInProgress, Steps: []DeletionStep{}}
+
+	var completedAt sql.NullTime
+	err := db.GetDB().QueryRow("SELECT requested_at, completed_at FROM account_deletions WHERE id = $1", status.ID).
+		Scan(&status.RequestedAt, &completedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Deletion not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not load deletion status", http.StatusInternalServerError)
+		return
+	}
+	if completedAt.Valid {
+		status.Status = deletionCompleted
+		status.CompletedAt = &completedAt.Time
+	}
+
+	rows, err := db.GetDB().Query(`SELECT service, status, attempts, COALESCE(last_error, ''), updated_at, completed_at, next_attempt_at
+		FROM account_deletion_steps WHERE deletion_id = $1 ORDER BY service`, status.ID)
+	if err != nil {
+		http.Error(w, "Could not load deletion status", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var step DeletionStep
+		var stepCompletedAt sql.NullTime
+		var nextAttemptAt time.Time
+		if err := rows.Scan(&step.Service, &step.Status, &step.Attempts, &step.LastError, &step.UpdatedAt, &stepCompletedAt, &nextAttemptAt); err != nil {
+			http.Error(w, "Could not load deletion status", http.StatusInternalServerError)
+			return
+		}
+		if stepCompletedAt.Valid {
+			step.CompletedAt = &stepCompletedAt.Time
+		} else {
+			step.NextAttemptAt = &nextAttemptAt
+		}
+		status.Steps = append(status.Steps, step)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Could not load deletion status", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+/*
+
+
+ПОДТВЕРЖДЕНИЯ И ПОВТОРЫ
+
+
+*/
+
+// runErasureAckConsumer читает подтверждения сервисов из user_erasure.
+// Потерянное подтверждение не страшно: шаг будет опубликован повторно.
+func runErasureAckConsumer() {
+	consumer, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers": os.Getenv("KAFKA_BROKER"),
+		"group.id":          "users_erasure",
+		"auto.offset.reset": "earliest",
+	})
+	if err != nil {
+		log.Fatalf("Ошибка создания консьюмера: %v", err)
+	}
+	defer consumer.Close()
+	erasureConsumer.Store(consumer)
+	defer erasureConsumer.Store(nil)
+
+	consumer.SubscribeTopics([]string{events.TopicUserErasure}, nil)
+
+	for {
+		msg, err := consumer.ReadMessage(-1)
+		if err != nil {
+			log.Printf("Error while consuming message: %s", err)
+			continue
+		}
+		envelope, err := events.Decode(msg.Value)
+		if err != nil {
+			log.Printf("Error decoding message: %s", err)
+			continue
+		}
+		if err := processErasureAck(envelope); err != nil {
+			log.Printf("Error processing %s: %v", envelope.Type, err)
+		}
+	}
+}
+
+func processErasureAck(envelope events.Envelope) error {
+	if envelope.Type.Topic() != events.TopicUserErasure {
+		return nil
+	}
+	ack, err := envelope.Erasure()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	switch envelope.Type {
+	case events.UserErasureCompleted:
+		_, err = tx.Exec(`UPDATE account_deletion_steps SET status = $3, completed_at = now(), updated_at = now(), last_error = NULL
+			WHERE deletion_id = $1 AND service = $2 AND status <> $3`, ack.DeletionID, ack.Service, deletionStepDone)
+	case events.UserErasureFailed:
+		log.Printf("Erasure %s failed in %s: %s", ack.DeletionID, ack.Service, ack.Error)
+		_, err = tx.Exec(`UPDATE account_deletion_steps SET status = $3, last_error = $4, updated_at = now(),
+				next_attempt_at = now() + LEAST($5 * power(2, attempts - 1), $6) * interval '1 second'
+			WHERE deletion_id = $1 AND service = $2 AND status <> $7`,
+			ack.DeletionID, ack.Service, deletionStepFailed, ack.Error, deletionRetryMinBackoff.Seconds(), deletionRetryMaxBackoff.Seconds(), deletionStepDone)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE account_deletions SET completed_at = now()
+		WHERE id = $1 AND completed_at IS NULL
+			AND NOT EXISTS (SELECT 1 FROM account_deletion_steps WHERE deletion_id = $1 AND status <> $2)`,
+		ack.DeletionID, deletionStepDone)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// runDeletionRetries бесконечно публикует user.deleted для шагов, которые
+// не подтверждены вовремя или завершились ошибкой
+func runDeletionRetries() {
+	ticker := time.NewTicker(deletionPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		rows, err := db.GetDB().Query(`SELECT DISTINCT d.id, d.user_id
+			FROM account_deletions d JOIN account_deletion_steps s ON s.deletion_id = d.id
+			WHERE s.status <> $1 AND s.next_attempt_at <= now()`, deletionStepDone)
+		if err != nil {
+			log.Printf("Deletion retries: error loading steps: %v", err)
+			continue
+		}
+		due := map[string]int{}
+		for rows.Next() {
+			var id string
+			var userID int
+			if err := rows.Scan(&id, &userID); err != nil {
+				log.Printf("Deletion retries: error loading steps: %v", err)
+				break
+			}
+			due[id] = userID
+		}
+		rows.Close()
+
+		for id, userID := range due {
+			if err := retryDeletion(id, userID); err != nil {
+				log.Printf("Deletion retries: error retrying %s: %v", id, err)
+			}
+		}
+	}
+}
+
+// retryDeletion публикует событие заново; подтвердившие сервисы ответят еще раз
+func retryDeletion(deletionID string, userID int) error {
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Условие по next_attempt_at не дает двум экземплярам повторить шаг одновременно
+	result, err := tx.Exec(`UPDATE account_deletion_steps SET status = $2, attempts = attempts + 1, updated_at = now(),
+			next_attempt_at = now() + $3 * interval '1 second'
+		WHERE deletion_id = $1 AND status <> $4 AND next_attempt_at <= now()`,
+		deletionID, deletionStepPending, deletionAckTimeout.Seconds(), deletionStepDone)
+	if err != nil {
+		return err
+	}
+	if retried, _ := result.RowsAffected(); retried == 0 {
+		return nil
+	}
+	if err := enqueueEvent(tx, events.UserDeleted, events.UserPayload{UserID: userID, DeletionID: deletionID}); err != nil {
+		return err
+	}
+	log.Printf("Retrying erasure %s of user %d", deletionID, userID)
+	return tx.Commit()
+}
@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"log"
+	"os"
+	texttemplate "text/template"
+
+	"users/mail"
+)
+
+// Письма собираются из пары шаблонов templates/email/<name>.txt и <name>.html
+
+var mailer mail.Mailer
+
+// Адрес сайта для ссылок в письмах
+func publicURL() string {
+	if url := os.Getenv("PUBLIC_URL"); url != "" {
+		return url
+	}
+	return "http://localhost:8080"
+}
+
+// sendMail отправляет письмо по шаблону; ошибки только логируются,
+// чтобы сбой почты не ломал основное действие
+func sendMail(to string, subject string, name string, data interface{}) {
+	msg, err := renderMail(to, subject, name, data)
+	if err != nil {
+		log.Printf("Error rendering %s mail: %v", name, err)
+		return
+	}
+	if err := mailer.Send(msg); err != nil {
+		log.Printf("Error sending %s mail to %s: %v", name, to, err)
+	}
+}
+
+func renderMail(to string, subject string, name string, data interface{}) (mail.Message, error) {
+	var text, html bytes.Buffer
+
+	textTmpl, err := texttemplate.ParseFiles("templates/email/" + name + ".txt")
+	if err != nil {
+		return mail.Message{}, err
+	}
+	if err := textTmpl.Execute(&text, data); err != nil {
+		return mail.Message{}, err
+	}
+
+	htmlTmpl, err := htmltemplate.ParseFiles("templates/email/" + name + ".html")
+	if err != nil {
+		return mail.Message{}, err
+	}
+	if err := htmlTmpl.Execute(&html, data); err != nil {
+		return mail.Message{}, err
+	}
+
+	return mail.Message{To: to, Subject: subject, Text: text.String(), HTML: html.String()}, nil
+}
@@ -0,0 +1,454 @@
+package handler
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"auth"
+	"users/db"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Выгрузка персональных данных по запросу пользователя. Запрос создает задание
+// в data_exports, фоновый обработчик собирает zip-архив: users.json из users_db
+// и по файлу от каждого сервиса, которые отдают данные пользователя по внутреннему
+// маршруту с одноцелевым токеном auth.PurposeDataExport. Готовый архив можно
+// скачать в течение exportTTL, после этого он удаляется.
+
+const (
+	exportPending = "pending"
+	exportRunning = "running"
+	exportReady   = "ready"
+	exportFailed  = "failed"
+	exportExpired = "expired"
+
+	exportPollInterval    = 5 * time.Second
+	exportLease           = 5 * time.Minute // столько задание скрыто от других обработчиков
+	exportMaxAttempts     = 3
+	exportRetryBackoff    = time.Minute
+	exportTTL             = 24 * time.Hour
+	exportTokenTTL        = 5 * time.Minute
+	exportFetchTimeout    = 30 * time.Second
+	exportMaxServiceBytes = 50 << 20
+	exportCleanupInterval = time.Hour
+)
+
+// exportSource сервис, у которого запрашиваются данные пользователя
+type exportSource struct {
+	Service string
+	URL     string
+}
+
+// exportSourcesFromEnv адреса сервисов; по умолчанию — имена из docker-compose
+func exportSourcesFromEnv() []exportSource {
+	base := func(env, fallback string) string {
+		if url := os.Getenv(env); url != "" {
+			return url
+		}
+		return fallback
+	}
+	return []exportSource{
+		{Service: "products", URL: base("PRODUCTS_URL", "http://product-service:7777") + "/products/internal/export"},
+		{Service: "recommendations", URL: base("RECOMMENDATIONS_URL", "http://recommendation-service:6666") + "/recommendations/internal/export"},
+		{Service: "analytics", URL: base("ANALYTICS_URL", "http://analytics-service:5555") + "/analytics/internal/export"},
+	}
+}
+
+type DataExport struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	RequestedAt time.Time  `json:"requested_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	DownloadURL string     `json:"download_url,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// ExportedUser строка users и связанные с аккаунтом записи; хэши паролей и секреты не выгружаются
+type ExportedUser struct {
+	ID               int                `json:"id"`
+	Name             string             `json:"name"`
+	Email            string             `json:"email"`
+	Role             string             `json:"role"`
+	EmailVerifiedAt  *time.Time         `json:"email_verified_at"`
+	PendingEmail     string             `json:"pending_email,omitempty"`
+	SuspendedAt      *time.Time         `json:"suspended_at"`
+	LockedUntil      *time.Time         `json:"locked_until"`
+	HasPassword      bool               `json:"has_password"`
+	TwoFactorEnabled bool               `json:"two_factor_enabled"`
+	Identities       []ExportedIdentity `json:"identities"`
+	Sessions         []ExportedSession  `json:"sessions"`
+}
+
+type ExportedIdentity struct {
+	Provider    string     `json:"provider"`
+	Subject     string     `json:"subject"`
+	Email       string     `json:"email,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at"`
+}
+
+type ExportedSession struct {
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+// Запрос выгрузки; пока предыдущая не готова, возвращается она же
+func requestDataExport(w http.ResponseWriter, r *http.Request) {
+	if !isPostRequest(w, r) {
+		return
+	}
+	p, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	id, err := auth.NewID()
+	if err != nil {
+		http.Error(w, "Could not request export", http.StatusInternalServerError)
+		return
+	}
+	// Незавершенная выгрузка у пользователя одна, это гарантирует частичный уникальный индекс
+	_, err = db.GetDB().Exec(`INSERT INTO data_exports (id, user_id, status) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) WHERE status IN ('pending', 'running') DO NOTHING`, id, p.ID, exportPending)
+	if err == nil {
+		err = db.GetDB().QueryRow("SELECT id FROM data_exports WHERE user_id = $1 AND status IN ($2, $3)", p.ID, exportPending, exportRunning).Scan(&id)
+	}
+	if err == sql.ErrNoRows {
+		// Задание уже успели выполнить, новое не нужно — отдаем последнее
+		err = db.GetDB().QueryRow("SELECT id FROM data_exports WHERE user_id = $1 ORDER BY requested_at DESC LIMIT 1", p.ID).Scan(&id)
+	}
+	if err != nil {
+		http.Error(w, "Could not request export", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"id": id, "status_url": "/users/me/exports/" + id})
+}
+
+// Статус выгрузки текущего пользователя; у готовой есть ссылка на скачивание
+func dataExportStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	export := DataExport{ID: r.PathValue("id")}
+	var completedAt, expiresAt sql.NullTime
+	var lastError sql.NullString
+	err := db.GetDB().QueryRow(`SELECT status, requested_at, completed_at, expires_at, last_error
+		FROM data_exports WHERE id = $1 AND user_id = $2`, export.ID, p.ID).
+		Scan(&export.Status, &export.RequestedAt, &completedAt, &expiresAt, &lastError)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not load export status", http.StatusInternalServerError)
+		return
+	}
+	if completedAt.Valid {
+		export.CompletedAt = &completedAt.Time
+	}
+	if expiresAt.Valid {
+		export.ExpiresAt = &expiresAt.Time
+	}
+	switch export.Status {
+	case exportReady:
+		export.DownloadURL = "/users/me/exports/" + export.ID + "/download"
+	case exportFailed:
+		export.Error = lastError.String
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(export)
+}
+
+// Скачивание архива; после expires_at ссылка больше не работает
+func downloadDataExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	id := r.PathValue("id")
+	var archive []byte
+	err := db.GetDB().QueryRow(`SELECT archive FROM data_exports
+		WHERE id = $1 AND user_id = $2 AND status = $3 AND expires_at > now()`, id, p.ID, exportReady).Scan(&archive)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Export not found or expired", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not load export", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="data-export-%s.zip"`, id))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(archive)
+}
+
+// runExportJobs бесконечно выполняет задания выгрузки и удаляет просроченные архивы
+func runExportJobs() {
+	ticker := time.NewTicker(exportPollInterval)
+	defer ticker.Stop()
+
+	sources := exportSourcesFromEnv()
+	lastCleanup := time.Now()
+	for range ticker.C {
+		for processNextExport(sources) {
+			// Очередь не пуста, берем следующее задание сразу
+		}
+		if time.Since(lastCleanup) > exportCleanupInterval {
+			expireDataExports()
+			lastCleanup = time.Now()
+		}
+	}
+}
+
+// processNextExport выполняет одно задание; false, если заданий нет
+func processNextExport(sources []exportSource) bool {
+	var id string
+	var userID, attempts int
+	// Задание в статусе running с истекшей арендой осталось от упавшего обработчика
+	err := db.GetDB().QueryRow(`UPDATE data_exports SET status = $1, attempts = attempts + 1,
+			next_attempt_at = now() + $2 * interval '1 second'
+		WHERE id = (
+			SELECT id FROM data_exports
+			WHERE status IN ($1, $3) AND next_attempt_at <= now()
+			ORDER BY requested_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, user_id, attempts`, exportRunning, exportLease.Seconds(), exportPending).Scan(&id, &userID, &attempts)
+	if err == sql.ErrNoRows {
+		return false
+	}
+	if err != nil {
+		log.Printf("Exports: error claiming job: %v", err)
+		return false
+	}
+
+	archive, err := buildExportArchive(userID, sources)
+	if err != nil {
+		failDataExport(id, attempts, err)
+		return true
+	}
+	_, err = db.GetDB().Exec(`UPDATE data_exports SET status = $2, archive = $3, last_error = NULL,
+			completed_at = now(), expires_at = now() + $4 * interval '1 second'
+		WHERE id = $1`, id, exportReady, archive, exportTTL.Seconds())
+	if err != nil {
+		log.Printf("Exports: error saving export %s: %v", id, err)
+		return true
+	}
+	log.Printf("Exports: export %s of user %d is ready", id, userID)
+	return true
+}
+
+// failDataExport планирует повтор, а после exportMaxAttempts попыток завершает задание ошибкой
+func failDataExport(id string, attempts int, cause error) {
+	log.Printf("Exports: export %s failed (attempt %d): %v", id, attempts, cause)
+	var err error
+	if attempts >= exportMaxAttempts {
+		_, err = db.GetDB().Exec("UPDATE data_exports SET status = $2, last_error = $3, completed_at = now() WHERE id = $1",
+			id, exportFailed, cause.Error())
+	} else {
+		_, err = db.GetDB().Exec(`UPDATE data_exports SET status = $2, last_error = $3,
+				next_attempt_at = now() + $4 * interval '1 second'
+			WHERE id = $1`, id, exportPending, cause.Error(), (time.Duration(attempts) * exportRetryBackoff).Seconds())
+	}
+	if err != nil {
+		log.Printf("Exports: error updating export %s: %v", id, err)
+	}
+}
+
+// expireDataExports удаляет архивы, срок скачивания которых истек
+func expireDataExports() {
+	result, err := db.GetDB().Exec("UPDATE data_exports SET status = $1, archive = NULL WHERE status = $2 AND expires_at <= now()",
+		exportExpired, exportReady)
+	if err != nil {
+		log.Printf("Exports: error expiring archives: %v", err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("Exports: %d archives expired", n)
+	}
+}
+
+// buildExportArchive собирает данные пользователя из users_db и всех сервисов
+func buildExportArchive(userID int, sources []exportSource) ([]byte, error) {
+	user, err := loadExportedUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	userJSON, err := json.MarshalIndent(user, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := signer.Sign(jwt.MapClaims{
+		auth.ClaimPurpose:   auth.PurposeDataExport,
+		auth.ClaimUserID:    userID,
+		auth.ClaimExpiresAt: time.Now().Add(exportTokenTTL).Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	files, err := collectServiceData(context.Background(), http.DefaultClient, sources, token)
+	if err != nil {
+		return nil, err
+	}
+	files["users.json"] = userJSON
+	return writeArchive(files)
+}
+
+// collectServiceData запрашивает данные у каждого сервиса; файл архива — <сервис>.json
+func collectServiceData(ctx context.Context, client *http.Client, sources []exportSource, token string) (map[string][]byte, error) {
+	files := make(map[string][]byte, len(sources)+1)
+	for _, source := range sources {
+		data, err := fetchServiceData(ctx, client, source.URL, token)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", source.Service, err)
+		}
+		files[source.Service+".json"] = data
+	}
+	return files, nil
+}
+
+func fetchServiceData(ctx context.Context, client *http.Client, url string, token string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, exportFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, exportMaxServiceBytes))
+	if err != nil {
+		return nil, err
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, body, "", "  "); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	return indented.Bytes(), nil
+}
+
+// writeArchive упаковывает файлы в zip в порядке имен
+func writeArchive(files map[string][]byte) ([]byte, error) {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, name := range names {
+		f, err := archive.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(files[name]); err != nil {
+			return nil, err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func loadExportedUser(userID int) (ExportedUser, error) {
+	user := ExportedUser{ID: userID, Identities: []ExportedIdentity{}, Sessions: []ExportedSession{}}
+	var name, pendingEmail sql.NullString
+	var verifiedAt, suspendedAt, lockedUntil sql.NullTime
+	err := db.GetDB().QueryRow(`SELECT name, email, role, email_verified_at, pending_email, suspended_at, locked_until, pass IS NOT NULL,
+			EXISTS (SELECT 1 FROM user_totp WHERE user_id = $1 AND confirmed_at IS NOT NULL)
+		FROM users WHERE id = $1`, userID).
+		Scan(&name, &user.Email, &user.Role, &verifiedAt, &pendingEmail, &suspendedAt, &lockedUntil, &user.HasPassword, &user.TwoFactorEnabled)
+	if err != nil {
+		return user, err
+	}
+	user.Name, user.PendingEmail = name.String, pendingEmail.String
+	user.EmailVerifiedAt = nullableTime(verifiedAt)
+	user.SuspendedAt = nullableTime(suspendedAt)
+	user.LockedUntil = nullableTime(lockedUntil)
+
+	rows, err := db.GetDB().Query(`SELECT provider, subject, COALESCE(email, ''), created_at, last_login_at
+		FROM user_identities WHERE user_id = $1 ORDER BY id`, userID)
+	if err != nil {
+		return user, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var identity ExportedIdentity
+		var lastLoginAt sql.NullTime
+		if err := rows.Scan(&identity.Provider, &identity.Subject, &identity.Email, &identity.CreatedAt, &lastLoginAt); err != nil {
+			return user, err
+		}
+		identity.LastLoginAt = nullableTime(lastLoginAt)
+		user.Identities = append(user.Identities, identity)
+	}
+	if err := rows.Err(); err != nil {
+		return user, err
+	}
+
+	rows, err = db.GetDB().Query(`SELECT user_agent, ip, created_at, last_seen_at, expires_at, revoked_at
+		FROM sessions WHERE user_id = $1 ORDER BY created_at`, userID)
+	if err != nil {
+		return user, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var session ExportedSession
+		var revokedAt sql.NullTime
+		if err := rows.Scan(&session.UserAgent, &session.IP, &session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt, &revokedAt); err != nil {
+			return user, err
+		}
+		session.RevokedAt = nullableTime(revokedAt)
+		user.Sessions = append(user.Sessions, session)
+	}
+	return user, rows.Err()
+}
+
+func nullableTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
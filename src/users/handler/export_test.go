@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCollectServiceDataArchive(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer service-token" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"user_id":7,"path":"` + r.URL.Path + `"}`))
+	}))
+	defer server.Close()
+
+	sources := []exportSource{
+		{Service: "products", URL: server.URL + "/products/internal/export"},
+		{Service: "analytics", URL: server.URL + "/analytics/internal/export"},
+	}
+	files, err := collectServiceData(context.Background(), server.Client(), sources, "service-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files["users.json"] = []byte(`{"id":7}`)
+
+	data, err := writeArchive(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range archive.File {
+		names = append(names, f.Name)
+		if f.Name != "products.json" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(rc)
+		rc.Close()
+		if !strings.Contains(string(content), `"path": "/products/internal/export"`) {
+			t.Errorf("products.json = %s", content)
+		}
+	}
+	if got := strings.Join(names, ","); got != "analytics.json,products.json,users.json" {
+		t.Errorf("archive files = %s", got)
+	}
+}
+
+func TestCollectServiceDataFails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			w.Write([]byte("not json"))
+			return
+		}
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	for _, path := range []string{"/denied", "/broken"} {
+		sources := []exportSource{{Service: "products", URL: server.URL + path}}
+		_, err := collectServiceData(context.Background(), server.Client(), sources, "service-token")
+		if err == nil || !strings.HasPrefix(err.Error(), "products: ") {
+			t.Errorf("%s: error = %v, want products error", path, err)
+		}
+	}
+}
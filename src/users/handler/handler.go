@@ -1,11 +1,8 @@
 package handler
 
-// TODO: добавить обновление своего профиля
-
 import (
 	"database/sql"
 	"encoding/json"
-	"fmt"
 	"html/template"
 	"log"
 	"net/http"
@@ -13,10 +10,17 @@ import (
 	"strconv"
 	"time"
 
+	"auth"
+	"auth/access"
+	"events"
+	"health"
+	"outbox"
 	"users/db"
+	"users/mail"
+	"users/oidc"
+	"users/ratelimit"
 
 	kafka "github.com/confluentinc/confluent-kafka-go/kafka"
-	"github.com/dgrijalva/jwt-go"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -33,11 +37,12 @@ type UserUpdate struct {
 }
 
 type User struct {
-	ID    int    `json:"id"`
-	Name  string `json:"name"`
-	Email string `json:"email"`
-	Pass  string `json:"-"`
-	Role  string `json:"role"`
+	ID            int    `json:"id"`
+	Name          string `json:"name"`
+	Email         string `json:"email"`
+	Pass          string `json:"-"`
+	Role          string `json:"role"`
+	EmailVerified bool   `json:"email_verified"`
 }
 
 type UserLog struct {
@@ -45,19 +50,13 @@ type UserLog struct {
 	Pass  string `json:"pass"`
 }
 
-type KafkaMessage struct {
-	Action string `json:"action"`
-	UserID int    `json:"user_id"`
-	Email  string `json:"email"`
-	Name   string `json:"name"`
-}
+// Имя сервиса в конверте событий
+const eventProducer = "users"
 
-var userUpdateTopic = "user_updates"
+var userUpdateTopic = events.TopicUserUpdates
 
 var producer *kafka.Producer
 
-var jwtSecret = []byte("secret")
-
 // Home page handler
 func homePage(w http.ResponseWriter, r *http.Request) {
 	tmpl := template.Must(template.ParseFiles("templates/index.html"))
@@ -73,7 +72,7 @@ func registrationPage(w http.ResponseWriter, r *http.Request) {
 // Login page handler
 func loginPage(w http.ResponseWriter, r *http.Request) {
 	tmpl := template.Must(template.ParseFiles("templates/login.html"))
-	tmpl.Execute(w, nil)
+	tmpl.Execute(w, struct{ Providers []oidc.ProviderConfig }{oidcProviderConfigs})
 }
 
 // Create a new user
@@ -87,6 +86,12 @@ func createUser(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	email, err := normalizeEmail(user.Email)
+	if err != nil {
+		http.Error(w, "Invalid email", http.StatusBadRequest)
+		return
+	}
+	user.Email = email
 
 	if checkIfExist(user.Email) {
 		http.Error(w, "User already exists", http.StatusConflict)
@@ -100,31 +105,47 @@ func createUser(w http.ResponseWriter, r *http.Request) {
 	}
 	user.Pass = hashedPassword
 
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		http.Error(w, "Could not create user", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
 	var newUserID int
-	err = db.GetDB().QueryRow("INSERT INTO users (name, email, pass, role) VALUES ($1, $2, $3, $4) RETURNING id",
-		user.Name, user.Email, user.Pass, "user").Scan(&newUserID)
+	err = tx.QueryRow("INSERT INTO users (name, email, pass, role) VALUES ($1, $2, $3, $4) RETURNING id",
+		user.Name, user.Email, user.Pass, access.RoleUser).Scan(&newUserID)
 	if err != nil {
 		http.Error(w, "Could not create user", http.StatusInternalServerError)
 		return
 	}
-	// Отправляем сообщение в кафка
-	msg := KafkaMessage{
+	// Сообщение для кафки пишем в outbox в той же транзакции
+	msg := events.UserPayload{
 
 		UserID: newUserID,
-		Action: "new user",
 		Name:   user.Name,
 		Email:  user.Email,
+		Status: events.UserStatusPending,
+	}
+	if err := enqueueEvent(tx, events.UserCreated, msg); err != nil {
+		http.Error(w, "Could not create user", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Could not create user", http.StatusInternalServerError)
+		return
 	}
-	sendToKafka(msg)
-	fmt.Println(msg)
 
-	json.NewEncoder(w).Encode(map[string]interface{}{"id": newUserID, "name": user.Name, "email": user.Email})
+	// До перехода по ссылке из письма аккаунт остается неподтвержденным
+	sendEmailVerification(User{ID: newUserID, Name: user.Name}, user.Email)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": newUserID, "name": user.Name, "email": user.Email, "status": events.UserStatusPending})
 }
 
 // Check if user already exists in the database
 func checkIfExist(email string) bool {
 	var exists bool
-	err := db.GetDB().QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE email=$1)", email).Scan(&exists)
+	err := db.GetDB().QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE lower(email)=$1)", email).Scan(&exists)
 	if err != nil {
 		return false // В случае ошибки считаем пользователя не существующим.
 	}
@@ -149,46 +170,81 @@ func login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Слишком частые попытки отклоняются до поиска пользователя и bcrypt
+	ctx := r.Context()
+	ipKey, accountKey := ipAttemptsKey(r), accountAttemptsKey(loginUser.Email)
+	if wait := loginRetryAfter(ctx, ipKey, accountKey); wait > 0 {
+		tooManyLoginAttempts(w, wait)
+		return
+	}
+
+	// Некорректный адрес не может принадлежать пользователю: ответ как для неизвестного
 	var user User
-	err := db.GetDB().QueryRow("SELECT id, name, pass, role FROM users WHERE email=$1", loginUser.Email).Scan(&user.ID, &user.Name, &user.Pass, &user.Role)
-	if err == sql.ErrNoRows {
-		http.Error(w, "Пользователь не найден", http.StatusNotFound)
+	var suspended bool
+	var lockedUntil sql.NullTime
+	err := sql.ErrNoRows
+	if email, emailErr := normalizeEmail(loginUser.Email); emailErr == nil {
+		err = db.GetDB().QueryRow("SELECT id, name, email, COALESCE(pass, ''), role, email_verified_at IS NOT NULL, suspended_at IS NOT NULL, locked_until FROM users WHERE lower(email)=$1", email).
+			Scan(&user.ID, &user.Name, &user.Email, &user.Pass, &user.Role, &user.EmailVerified, &suspended, &lockedUntil)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Could not log in", http.StatusInternalServerError)
+		return
+	}
+	found := err == nil
+
+	// Блокировка из БД действует, даже если счетчики попыток потеряны
+	if found && lockedUntil.Valid {
+		if wait := time.Until(lockedUntil.Time); wait > 0 {
+			tooManyLoginAttempts(w, wait)
+			return
+		}
+		if err := unlockExpired(user); err != nil {
+			log.Printf("Error unlocking user %d: %v", user.ID, err)
+		}
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(user.Pass), []byte(loginUser.Pass))
-	if err != nil {
-		http.Error(w, "Invalid password", http.StatusUnauthorized)
+	// Для неизвестного email и аккаунта без пароля (вход только через OIDC)
+	// bcrypt сравнивает с фиктивным хэшем, ответ тот же
+	hasPass := found && user.Pass != ""
+	hash := dummyPasswordHash
+	if hasPass {
+		hash = []byte(user.Pass)
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(loginUser.Pass)); err != nil || !hasPass {
+		var lockTarget *User
+		if found {
+			lockTarget = &user
+		}
+		recordLoginFailure(ctx, ipKey, accountKey, lockTarget)
+		http.Error(w, "Invalid email or password", http.StatusUnauthorized)
+		return
+	}
+	resetLoginFailures(ctx, loginUser.Email)
+	if suspended {
+		http.Error(w, "Account suspended", http.StatusForbidden)
 		return
 	}
 
-	token, err := generateJWT(user)
+	// С включенной 2FA (а для администраторов — всегда) токены выдаются только после второго шага
+	twoFactor, err := loadTwoFactorStatus(user.ID, user.Role)
 	if err != nil {
-		http.Error(w, "Could not generate token", http.StatusInternalServerError)
+		http.Error(w, "Could not log in", http.StatusInternalServerError)
+		return
+	}
+	if twoFactor.Enabled || twoFactor.Required {
+		if err := startLoginChallenge(w, user, !twoFactor.Enabled); err != nil {
+			http.Error(w, "Could not log in", http.StatusInternalServerError)
+		}
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    token,
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   true,
-	})
-
-	json.NewEncoder(w).Encode(map[string]string{"message": "Login successful"})
-}
-
-// Generate JWT token for the user
-func generateJWT(user User) (string, error) {
-	claims := jwt.MapClaims{
-		"id":   user.ID,
-		"name": user.Name,
-		"exp":  time.Now().Add(time.Hour * 24).Unix(),
-		"role": user.Role,
+	if err := startSession(w, r, user); err != nil {
+		http.Error(w, "Could not generate token", http.StatusInternalServerError)
+		return
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Login successful"})
 }
 
 // Get user information by ID from the database
@@ -201,6 +257,7 @@ func getUser(w http.ResponseWriter, r *http.Request) {
 	err := db.GetDB().QueryRow("SELECT id, name, email, role FROM users WHERE id=$1", id).Scan(&user.ID, &user.Name, &user.Email, &user.Role)
 	if err == sql.ErrNoRows {
 		http.Error(w, "Пользователь не найден", http.StatusNotFound)
+		return
 	}
 
 	// Рендерим HTML-шаблон с данными пользователя
@@ -210,20 +267,39 @@ func getUser(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Обработчик для страницы редактирования профиля пользователя
+// Обработчик для страницы редактирования профиля пользователя.
+// Без id открывается свой профиль, чужой доступен только администратору.
 func editUserPage(w http.ResponseWriter, r *http.Request) {
-	id := r.URL.Query().Get("id")
-	var user User
+	p, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	id, ok := targetUserID(w, r, p)
+	if !ok {
+		return
+	}
 
 	// Получаем данные пользователя из базы данных
-	err := db.GetDB().QueryRow("SELECT id, name, email, role FROM users WHERE id=$1", id).Scan(&user.ID, &user.Name, &user.Email, &user.Role)
-	if err == sql.ErrNoRows {
+	profile, err := loadProfile(id)
+	if err == errUserNotFound {
 		http.Error(w, "Пользователь не найден", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Ошибка при загрузке профиля", http.StatusInternalServerError)
+		return
 	}
 
-	// Рендерим HTML-шаблон с данными для редактирования
+	// Рендерим HTML-шаблон с данными для редактирования; 2FA настраивается только в своем профиле
+	data := struct {
+		Profile
+		Own bool
+	}{
+		Profile: profile,
+		Own:     id == p.ID,
+	}
 	tmpl := template.Must(template.ParseFiles("templates/user_edit.html"))
-	if err := tmpl.Execute(w, user); err != nil {
+	if err := tmpl.Execute(w, data); err != nil {
 		http.Error(w, "Ошибка при рендеринге шаблона", http.StatusInternalServerError)
 	}
 }
@@ -234,38 +310,34 @@ func editUser(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Метод не разрешен", http.StatusMethodNotAllowed)
 		return
 	}
-
-	id := r.URL.Query().Get("id")
-	if id == "" {
-		http.Error(w, "Missing user ID", http.StatusBadRequest)
+	p, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	id, ok := targetUserID(w, r, p)
+	if !ok {
 		return
 	}
 
 	// Получаем данные из формы
-	name := r.FormValue("name")
-	email := r.FormValue("email")
-
-	// Обновляем данные пользователя в базе данных
-	_, err := db.GetDB().Exec("UPDATE users SET name = $1, email = $2 WHERE id = $3",
-		name, email, id)
-
-	if err != nil {
+	err := updateProfile(id, r.FormValue("name"), r.FormValue("email"))
+	switch err {
+	case nil:
+	case errInvalidEmail:
+		http.Error(w, "Некорректный email", http.StatusBadRequest)
+		return
+	case errUserNotFound:
+		http.Error(w, "Пользователь не найден", http.StatusNotFound)
+		return
+	case errEmailTaken:
+		http.Error(w, "Email уже используется", http.StatusConflict)
+		return
+	default:
 		http.Error(w, "Ошибка при обновлении данных пользователя", http.StatusInternalServerError)
 		return
 	}
-	// Отправляем сообщение в кафка
-	ID, _ := strconv.Atoi(id)
-	msg := KafkaMessage{
-
-		UserID: ID,
-		Action: "update user info",
-		Name:   name,
-		Email:  email,
-	}
-	fmt.Println(msg)
-	sendToKafka(msg)
 	// Отправляем успешный ответ
-	http.Redirect(w, r, "/users/user?id="+id, http.StatusSeeOther)
+	http.Redirect(w, r, "/users/user?id="+strconv.Itoa(id), http.StatusSeeOther)
 }
 
 // Utility function to check if the request method is POST and return an error if not.
@@ -282,17 +354,83 @@ func isPostRequest(w http.ResponseWriter, r *http.Request) bool {
 func InitializeRoutes() {
 	db.Connect()
 	initKafka()
-	http.HandleFunc("/", homePage)
-	http.HandleFunc("/users/registration", registrationPage)
-	http.HandleFunc("/users/login", loginPage)
-
-	http.HandleFunc("/users/registration/create", createUser) // POST for creating a new user
-	http.HandleFunc("/users/login/submit", login)             // POST for logging in a user
-
-	http.HandleFunc("/users/user/", getUser) // GET for getting a user by ID from the database.
+	initSigner()
+	mailer = mail.FromEnv()
+	forgotPasswordRequests = ratelimit.FromEnv()
+	loginAttempts = ratelimit.FromEnv()
+	initTrustedProxies()
+	initOIDC()
+	go outbox.NewRelay(db.GetDB(), producer).Run()
+	go runErasureAckConsumer()
+	go runDeletionRetries()
+	go runExportJobs()
+	registerRoutes(access.NewRouter(http.DefaultServeMux, verifier))
+}
 
-	http.HandleFunc("/users/edit/", editUserPage)
-	http.HandleFunc("/users/edit/submit", editUser)
+// registerRoutes маршруты сервиса; у каждого маршрута явная политика доступа
+func registerRoutes(rt *access.Router) {
+	rt.HandleFunc("/", access.Public(), homePage)
+	rt.HandleFunc("/users/registration", access.Public(), registrationPage)
+	rt.HandleFunc("/users/login", access.Public(), loginPage)
+
+	rt.HandleFunc("/users/registration/create", access.Public(), createUser) // POST for creating a new user
+	rt.HandleFunc("/users/login/submit", access.Public(), login)             // POST for logging in a user
+	// Второй шаг входа; учетные данные — cookie login_challenge
+	rt.HandleFunc("/users/login/2fa", access.Public(), loginSecondFactor)                       // POST {"code"}
+	rt.HandleFunc("/users/login/2fa/enroll", access.Public(), loginEnrollSecondFactor)          // POST, required enrolment
+	rt.HandleFunc("/users/login/2fa/enroll/confirm", access.Public(), loginConfirmSecondFactor) // POST {"code"}
+	// Вход через провайдеров OpenID Connect
+	rt.HandleFunc("/users/oidc/{provider}/login", access.Public(), oidcLogin)       // GET, redirects to the provider
+	rt.HandleFunc("/users/oidc/{provider}/callback", access.Public(), oidcCallback) // GET, the provider redirects back here
+	rt.HandleFunc("/users/token/refresh", access.Public(), refreshTokens)           // POST for rotating the refresh token
+	rt.HandleFunc("/users/logout", access.Public(), logout)                         // POST for logging out, works with an expired token too
+	rt.HandleFunc("/users/.well-known/jwks.json", access.Public(), auth.JWKSHandler(signer))
+
+	rt.HandleFunc("/users/email/verify", access.Public(), verifyEmail)                           // the link itself is the credential
+	rt.HandleFunc("/users/email/verify/resend", access.Authenticated(), resendEmailVerification) // POST for sending the link again
+
+	rt.HandleFunc("/users/password/forgot", access.Public(), forgotPasswordPage)
+	rt.HandleFunc("/users/password/forgot/submit", access.Public(), forgotPassword) // POST for requesting a reset link
+	rt.HandleFunc("/users/password/reset", access.Public(), resetPasswordPage)
+	rt.HandleFunc("/users/password/reset/submit", access.Public(), resetPassword) // POST for setting a new password
+
+	rt.HandleFunc("/users/user/", access.Public(), getUser) // GET for getting a user by ID from the database.
+
+	rt.HandleFunc("/users/edit/", access.Authenticated(), editUserPage)
+	rt.HandleFunc("/users/edit/submit", access.Authenticated(), editUser)
+
+	rt.HandleFunc("/users/me", access.Authenticated(), me)                      // GET, PUT/PATCH for the current user's profile
+	rt.HandleFunc("/users/me/password", access.Authenticated(), changePassword) // POST for changing the current user's password
+	rt.HandleFunc("/users/me/delete", access.Authenticated(), deleteAccount)    // POST {"pass"}, starts the account deletion
+	rt.HandleFunc("/users/deletions/{id}", access.Public(), deletionStatus)     // GET, the deletion ID is the credential
+
+	rt.HandleFunc("/users/me/exports", access.Authenticated(), requestDataExport)                // POST, starts a personal data export
+	rt.HandleFunc("/users/me/exports/{id}", access.Authenticated(), dataExportStatus)            // GET
+	rt.HandleFunc("/users/me/exports/{id}/download", access.Authenticated(), downloadDataExport) // GET, the zip archive until it expires
+
+	rt.HandleFunc("/users/sessions", access.Authenticated(), sessionsPage)
+	rt.HandleFunc("/users/me/sessions", access.Authenticated(), listSessions)                 // GET, active sessions of the current user
+	rt.HandleFunc("/users/me/sessions/revoke", access.Authenticated(), revokeOwnSession)      // POST {"id"}
+	rt.HandleFunc("/users/me/sessions/revoke-all", access.Authenticated(), revokeAllSessions) // POST, signs out everywhere
+
+	rt.HandleFunc("/users/me/2fa", access.Authenticated(), twoFactorStatus)                        // GET
+	rt.HandleFunc("/users/me/2fa/enroll", access.Authenticated(), enrollTwoFactor)                 // POST, returns the secret and QR code
+	rt.HandleFunc("/users/me/2fa/confirm", access.Authenticated(), confirmTwoFactor)               // POST {"code"}, returns recovery codes
+	rt.HandleFunc("/users/me/2fa/recovery-codes", access.Authenticated(), regenerateRecoveryCodes) // POST {"code"}
+	rt.HandleFunc("/users/me/2fa/disable", access.Authenticated(), disableTwoFactor)               // POST {"code"}
+
+	// Управление пользователями
+	manage := access.Require(access.UserManage)
+	rt.HandleFunc("/users/admin", manage, adminUsersPage)
+	rt.HandleFunc("/users/admin/users", manage, adminListUsers)               // GET list with search and pagination
+	rt.HandleFunc("/users/admin/users/role", manage, adminChangeRole)         // POST {"id", "role"}
+	rt.HandleFunc("/users/admin/users/suspend", manage, adminSuspendUser)     // POST {"id"}
+	rt.HandleFunc("/users/admin/users/unsuspend", manage, adminUnsuspendUser) // POST {"id"}
+	rt.HandleFunc("/users/admin/users/unlock", manage, adminUnlockUser)       // POST {"id"}
+	rt.HandleFunc("/users/admin/users/logout", manage, adminForceLogout)      // POST {"id"}
+
+	rt.HandleFunc("/health", access.Public(), health.Live)
+	rt.HandleFunc("/ready", access.Public(), ready)
 }
 
 // kafka
@@ -304,14 +442,3 @@ func initKafka() {
 		log.Fatalf("Не удалось создать продюсер: %s", err)
 	}
 }
-
-func sendToKafka(msg KafkaMessage) {
-	jsonMsg, err := json.Marshal(msg)
-	if err != nil {
-		log.Fatalf("Ошибка при сериализации в JSON: %v", err)
-	}
-	producer.Produce(&kafka.Message{
-		TopicPartition: kafka.TopicPartition{Topic: &userUpdateTopic, Partition: kafka.PartitionAny},
-		Value:          []byte(jsonMsg),
-	}, nil)
-}
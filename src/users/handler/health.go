@@ -0,0 +1,36 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"events"
+	"health"
+	"users/db"
+)
+
+// Readiness: проверяем Postgres, продюсер Kafka и консьюмер подтверждений удаления
+func ready(w http.ResponseWriter, r *http.Request) {
+	health.WriteReadiness(w, r, map[string]health.Check{
+		"postgres": func(ctx context.Context) error {
+			return db.GetDB().PingContext(ctx)
+		},
+		"kafka": func(ctx context.Context) error {
+			if producer == nil {
+				return errors.New("producer is not initialized")
+			}
+			_, err := producer.GetMetadata(&userUpdateTopic, false, health.RemainingMs(ctx))
+			return err
+		},
+		"kafka_user_erasure": func(ctx context.Context) error {
+			consumer := erasureConsumer.Load()
+			if consumer == nil {
+				return errors.New("consumer is not initialized")
+			}
+			topic := events.TopicUserErasure
+			_, err := consumer.GetMetadata(&topic, false, health.RemainingMs(ctx))
+			return err
+		},
+	})
+}
@@ -0,0 +1,212 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"events"
+	"users/db"
+	"users/ratelimit"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Защита входа от перебора. Неудачные попытки считаются отдельно по IP-адресу
+// и по email. После нескольких неудач каждая следующая попытка возможна только
+// через экспоненциально растущую паузу, после accountLockoutAfter неудач подряд
+// вход в аккаунт блокируется на accountLockoutPeriod. Решение принимается до
+// поиска пользователя и одинаково для существующих и несуществующих адресов,
+// поэтому по ответам нельзя узнать, зарегистрирован ли email.
+
+const (
+	loginFailureWindow  = 15 * time.Minute // счетчик сбрасывается после этого времени без неудач
+	loginBackoffBase    = time.Second
+	loginBackoffMax     = 5 * time.Minute
+	accountBackoffAfter = 3
+	accountLockoutAfter = 10
+	// С одного IP могут входить многие пользователи (NAT), поэтому порог выше
+	ipBackoffAfter = 20
+
+	accountLockoutPeriod = loginFailureWindow
+)
+
+// Причины блокировки и разблокировки в событиях user.locked и user.unlocked
+const (
+	lockReasonFailedLogins    = "too_many_failed_logins"
+	unlockReasonExpired       = "expired"
+	unlockReasonPasswordReset = "password_reset"
+	unlockReasonAdmin         = "admin"
+)
+
+var loginAttempts ratelimit.Store
+
+// Хэш для сравнения, когда пользователя нет: bcrypt выполняется всегда,
+// и время ответа не выдает, существует ли email
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+func accountAttemptsKey(email string) string {
+	return "login:account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipAttemptsKey(r *http.Request) string {
+	return "login:ip:" + clientIP(r)
+}
+
+// loginRetryAfter сколько ждать до следующей попытки входа; 0 — можно сейчас.
+// При недоступном хранилище счетчиков вход не блокируется.
+func loginRetryAfter(ctx context.Context, ipKey string, accountKey string) time.Duration {
+	var wait time.Duration
+	for _, check := range []struct {
+		key          string
+		backoffAfter int
+		lockoutAfter int
+	}{
+		{ipKey, ipBackoffAfter, 0},
+		{accountKey, accountBackoffAfter, accountLockoutAfter},
+	} {
+		attempts, err := loginAttempts.Get(ctx, check.key)
+		if err != nil {
+			log.Printf("Error reading login attempts: %v", err)
+			continue
+		}
+		if d := retryAfter(attempts, check.backoffAfter, check.lockoutAfter); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+func retryAfter(attempts ratelimit.Attempts, backoffAfter int, lockoutAfter int) time.Duration {
+	var pause time.Duration
+	switch {
+	case lockoutAfter > 0 && attempts.Count >= lockoutAfter:
+		pause = accountLockoutPeriod
+	case attempts.Count >= backoffAfter:
+		pause = loginBackoff(attempts.Count - backoffAfter)
+	default:
+		return 0
+	}
+	return time.Until(attempts.Last.Add(pause))
+}
+
+// loginBackoff пауза после n-й неудачи сверх порога: 1s, 2s, 4s... до loginBackoffMax
+func loginBackoff(n int) time.Duration {
+	d := time.Duration(float64(loginBackoffBase) * math.Pow(2, float64(n)))
+	if d > loginBackoffMax || d <= 0 {
+		return loginBackoffMax
+	}
+	return d
+}
+
+// tooManyLoginAttempts ответ 429 с Retry-After
+func tooManyLoginAttempts(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too many login attempts, try again later", http.StatusTooManyRequests)
+}
+
+// recordLoginFailure учитывает неудачу; user — найденный пользователь или nil.
+// Когда email достигает порога, аккаунт блокируется и публикуется user.locked.
+func recordLoginFailure(ctx context.Context, ipKey string, accountKey string, user *User) {
+	if _, err := loginAttempts.Fail(ctx, ipKey, loginFailureWindow); err != nil {
+		log.Printf("Error recording login failure: %v", err)
+	}
+	attempts, err := loginAttempts.Fail(ctx, accountKey, loginFailureWindow)
+	if err != nil {
+		log.Printf("Error recording login failure: %v", err)
+		return
+	}
+	if user == nil || attempts.Count < accountLockoutAfter {
+		return
+	}
+	if err := lockAccount(*user, attempts.Last.Add(accountLockoutPeriod)); err != nil {
+		log.Printf("Error locking user %d: %v", user.ID, err)
+	}
+}
+
+func resetLoginFailures(ctx context.Context, email string) {
+	if err := loginAttempts.Reset(ctx, accountAttemptsKey(email)); err != nil {
+		log.Printf("Error resetting login attempts: %v", err)
+	}
+}
+
+// lockAccount записывает срок блокировки; событие публикуется только при
+// переходе из незаблокированного состояния, продление его не повторяет
+func lockAccount(user User, until time.Time) error {
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var lockedUntil sql.NullTime
+	if err := tx.QueryRow("SELECT locked_until FROM users WHERE id = $1 FOR UPDATE", user.ID).Scan(&lockedUntil); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE users SET locked_until = $1 WHERE id = $2", until, user.ID); err != nil {
+		return err
+	}
+	if !lockedUntil.Valid || lockedUntil.Time.Before(time.Now()) {
+		msg := events.UserPayload{
+			UserID:      user.ID,
+			Name:        user.Name,
+			Email:       user.Email,
+			LockedUntil: &until,
+			Reason:      lockReasonFailedLogins,
+		}
+		if err := enqueueEvent(tx, events.UserLocked, msg); err != nil {
+			return err
+		}
+		log.Printf("User %d locked until %s after %d failed logins", user.ID, until.Format(time.RFC3339), accountLockoutAfter)
+	}
+	return tx.Commit()
+}
+
+// unlockAccountTx снимает блокировку в транзакции tx и публикует user.unlocked;
+// если аккаунт не был заблокирован, ничего не делает. Счетчик попыток по email
+// вызывающий сбрасывает после commit.
+func unlockAccountTx(tx *sql.Tx, user User, actorID int, reason string) error {
+	result, err := tx.Exec("UPDATE users SET locked_until = NULL WHERE id = $1 AND locked_until IS NOT NULL", user.ID)
+	if err != nil {
+		return err
+	}
+	return enqueueUnlocked(tx, result, user, actorID, reason)
+}
+
+// unlockExpired фиксирует окончание истекшей блокировки
+func unlockExpired(user User) error {
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE users SET locked_until = NULL WHERE id = $1 AND locked_until <= now()", user.ID)
+	if err != nil {
+		return err
+	}
+	if err := enqueueUnlocked(tx, result, user, 0, unlockReasonExpired); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// enqueueUnlocked публикует user.unlocked, если блокировка действительно снята
+func enqueueUnlocked(tx *sql.Tx, result sql.Result, user User, actorID int, reason string) error {
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil
+	}
+	msg := events.UserPayload{
+		UserID:  user.ID,
+		Name:    user.Name,
+		Email:   user.Email,
+		ActorID: actorID,
+		Reason:  reason,
+	}
+	return enqueueEvent(tx, events.UserUnlocked, msg)
+}
@@ -0,0 +1,105 @@
+package handler
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"users/ratelimit"
+)
+
+// useLoginAttempts счетчики попыток входа в памяти на время теста
+func useLoginAttempts(t *testing.T) {
+	previous := loginAttempts
+	loginAttempts = ratelimit.NewMemoryStore()
+	t.Cleanup(func() { loginAttempts = previous })
+}
+
+func loginRequest(email string, pass string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/users/login/submit", strings.NewReader(`{"email":"`+email+`","pass":"`+pass+`"}`))
+	r.RemoteAddr = "203.0.113.7:5000"
+	return r
+}
+
+func TestLoginBackoff(t *testing.T) {
+	tests := []struct {
+		n    int
+		want time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{8, 256 * time.Second},
+		{9, loginBackoffMax},
+		{100, loginBackoffMax},
+		{5000, loginBackoffMax},
+	}
+	for _, tt := range tests {
+		if got := loginBackoff(tt.n); got != tt.want {
+			t.Errorf("loginBackoff(%d) = %v, want %v", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name         string
+		attempts     ratelimit.Attempts
+		backoffAfter int
+		lockoutAfter int
+		want         time.Duration
+	}{
+		{"no failures", ratelimit.Attempts{}, accountBackoffAfter, accountLockoutAfter, 0},
+		{"below backoff threshold", ratelimit.Attempts{Count: 2, Last: now}, accountBackoffAfter, accountLockoutAfter, 0},
+		{"first backoff", ratelimit.Attempts{Count: 3, Last: now}, accountBackoffAfter, accountLockoutAfter, time.Second},
+		{"growing backoff", ratelimit.Attempts{Count: 5, Last: now}, accountBackoffAfter, accountLockoutAfter, 4 * time.Second},
+		{"backoff already passed", ratelimit.Attempts{Count: 3, Last: now.Add(-time.Minute)}, accountBackoffAfter, accountLockoutAfter, 0},
+		{"lockout", ratelimit.Attempts{Count: 10, Last: now}, accountBackoffAfter, accountLockoutAfter, accountLockoutPeriod},
+		{"no lockout for ip", ratelimit.Attempts{Count: 40, Last: now}, ipBackoffAfter, 0, loginBackoffMax},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := retryAfter(tt.attempts, tt.backoffAfter, tt.lockoutAfter)
+			if tt.want == 0 {
+				if got > 0 {
+					t.Errorf("retryAfter = %v, want no wait", got)
+				}
+				return
+			}
+			// Время прошло между вычислением now и вызовом
+			if got > tt.want || got < tt.want-time.Second {
+				t.Errorf("retryAfter = %v, want about %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Попытки с адресом в разном регистре считаются одному аккаунту, и после
+// accountBackoffAfter неудач вход отклоняется до обращения к БД
+func TestLoginBackoffSharesAccountAcrossCase(t *testing.T) {
+	useLoginAttempts(t)
+	mock := useSQLMock(t)
+	for _, email := range []string{"ann@example.com", "Ann@Example.com", " ANN@example.com"} {
+		mock.ExpectQuery(regexp.QuoteMeta("FROM users WHERE lower(email)=$1")).WithArgs("ann@example.com").
+			WillReturnError(sql.ErrNoRows)
+		rec := httptest.NewRecorder()
+		login(rec, loginRequest(email, "wrong"))
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("%q: code = %d, want %d", email, rec.Code, http.StatusUnauthorized)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	login(rec, loginRequest("ann@EXAMPLE.com", "wrong"))
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("code = %d, Retry-After = %q, want 429 with Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
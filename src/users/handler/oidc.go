@@ -0,0 +1,309 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"auth"
+	"auth/access"
+	"events"
+	"users/db"
+	"users/oidc"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Вход через внешнего провайдера OpenID Connect. /users/oidc/<provider>/login
+// отправляет браузер к провайдеру, /users/oidc/<provider>/callback меняет код на
+// ID-токен и связывает внешнюю учетную запись (provider, sub) со строкой users:
+// по ранее сохраненной связи, по подтвержденному email или создавая новый
+// аккаунт. Дальше вход идет как после пароля: блокировка, 2FA, сессия.
+// Провайдеры описываются в файле OIDC_PROVIDERS_FILE.
+
+const (
+	oidcStateTTL     = 10 * time.Minute
+	oidcStatePurpose = "oidc_state"
+	oidcStateCookie  = "oidc_state"
+
+	claimProvider     = "provider"
+	claimState        = "state"
+	claimNonce        = "nonce"
+	claimCodeVerifier = "code_verifier"
+)
+
+// Коды ошибок в параметре error страницы входа
+const (
+	oidcErrorFailed            = "oidc_failed"
+	oidcErrorEmailUnverified   = "oidc_email_unverified"
+	oidcErrorAccountUnverified = "oidc_account_unverified"
+	oidcErrorAccountSuspended  = "suspended"
+	oidcErrorCancelled         = "oidc_cancelled"
+)
+
+var (
+	errIdentityEmailUnverified = errors.New("identity provider did not verify the email")
+	errAccountEmailUnverified  = errors.New("existing account with this email is not verified")
+)
+
+var (
+	oidcProviders map[string]*oidc.Provider
+	// Порядок кнопок на странице входа
+	oidcProviderConfigs []oidc.ProviderConfig
+)
+
+func initOIDC() {
+	oidcProviders = map[string]*oidc.Provider{}
+	path := os.Getenv("OIDC_PROVIDERS_FILE")
+	if path == "" {
+		return
+	}
+	configs, err := oidc.LoadConfig(path)
+	if err != nil {
+		log.Fatalf("Не удалось загрузить провайдеров OIDC: %s", err)
+	}
+	for _, cfg := range configs {
+		oidcProviders[cfg.Name] = oidc.NewProvider(cfg)
+	}
+	oidcProviderConfigs = configs
+}
+
+func oidcRedirectURI(provider string) string {
+	return publicURL() + "/users/oidc/" + provider + "/callback"
+}
+
+// oidcProvider провайдер из пути запроса; для неизвестного отвечает 404
+func oidcProvider(w http.ResponseWriter, r *http.Request) (*oidc.Provider, bool) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	provider, ok := oidcProviders[r.PathValue("provider")]
+	if !ok {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	return provider, true
+}
+
+// Начало входа: state, nonce и code_verifier запоминаются в подписанной cookie
+// и не хранятся на сервере. Cookie не уходит провайдеру, поэтому перехваченный
+// код без неё бесполезен.
+func oidcLogin(w http.ResponseWriter, r *http.Request) {
+	provider, ok := oidcProvider(w, r)
+	if !ok {
+		return
+	}
+
+	var values [3]string
+	for i := range values {
+		v, err := oidc.RandomString()
+		if err != nil {
+			http.Error(w, "Could not start login", http.StatusInternalServerError)
+			return
+		}
+		values[i] = v
+	}
+	state, nonce, codeVerifier := values[0], values[1], values[2]
+
+	name := provider.Config.Name
+	authURL, err := provider.AuthCodeURL(r.Context(), oidcRedirectURI(name), state, nonce, codeVerifier)
+	if err != nil {
+		log.Printf("OIDC %s: %v", name, err)
+		http.Error(w, "Identity provider is unavailable", http.StatusBadGateway)
+		return
+	}
+	token, err := signer.Sign(jwt.MapClaims{
+		auth.ClaimPurpose:   oidcStatePurpose,
+		claimProvider:       name,
+		claimState:          state,
+		claimNonce:          nonce,
+		claimCodeVerifier:   codeVerifier,
+		auth.ClaimExpiresAt: time.Now().Add(oidcStateTTL).Unix(),
+	})
+	if err != nil {
+		http.Error(w, "Could not start login", http.StatusInternalServerError)
+		return
+	}
+	// Lax: cookie должна прийти с переходом от провайдера обратно на callback
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    token,
+		Path:     "/users/oidc/" + name,
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// Возврат от провайдера
+func oidcCallback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := oidcProvider(w, r)
+	if !ok {
+		return
+	}
+	name := provider.Config.Name
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/users/oidc/" + name, MaxAge: -1, HttpOnly: true, Secure: true})
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		log.Printf("OIDC %s: provider returned %s: %s", name, e, q.Get("error_description"))
+		redirectLoginError(w, r, oidcErrorCancelled)
+		return
+	}
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		redirectLoginError(w, r, oidcErrorFailed)
+		return
+	}
+	claims, err := verifier.ParsePurpose(cookie.Value, oidcStatePurpose)
+	if err != nil {
+		redirectLoginError(w, r, oidcErrorFailed)
+		return
+	}
+	state, _ := claims[claimState].(string)
+	nonce, _ := claims[claimNonce].(string)
+	codeVerifier, _ := claims[claimCodeVerifier].(string)
+	if claims[claimProvider] != name || state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(q.Get("state"))) != 1 {
+		redirectLoginError(w, r, oidcErrorFailed)
+		return
+	}
+
+	identity, err := provider.Exchange(r.Context(), q.Get("code"), oidcRedirectURI(name), codeVerifier, nonce)
+	if err != nil {
+		log.Printf("OIDC %s: %v", name, err)
+		redirectLoginError(w, r, oidcErrorFailed)
+		return
+	}
+
+	user, suspended, err := linkIdentity(name, identity)
+	switch {
+	case errors.Is(err, errIdentityEmailUnverified):
+		redirectLoginError(w, r, oidcErrorEmailUnverified)
+		return
+	case errors.Is(err, errAccountEmailUnverified):
+		redirectLoginError(w, r, oidcErrorAccountUnverified)
+		return
+	case err != nil:
+		log.Printf("OIDC %s: error linking identity %s: %v", name, identity.Subject, err)
+		redirectLoginError(w, r, oidcErrorFailed)
+		return
+	}
+	if suspended {
+		redirectLoginError(w, r, oidcErrorAccountSuspended)
+		return
+	}
+
+	// Второй фактор запрашивает страница входа по параметру step
+	twoFactor, err := loadTwoFactorStatus(user.ID, user.Role)
+	if err != nil {
+		redirectLoginError(w, r, oidcErrorFailed)
+		return
+	}
+	if twoFactor.Enabled || twoFactor.Required {
+		status, err := setLoginChallenge(w, user, !twoFactor.Enabled)
+		if err != nil {
+			redirectLoginError(w, r, oidcErrorFailed)
+			return
+		}
+		http.Redirect(w, r, "/users/login?step="+url.QueryEscape(status), http.StatusFound)
+		return
+	}
+
+	if err := startSession(w, r, user); err != nil {
+		redirectLoginError(w, r, oidcErrorFailed)
+		return
+	}
+	http.Redirect(w, r, "/products", http.StatusFound)
+}
+
+func redirectLoginError(w http.ResponseWriter, r *http.Request, code string) {
+	http.Redirect(w, r, "/users/login?error="+url.QueryEscape(code), http.StatusFound)
+}
+
+// linkIdentity находит или создает пользователя для внешней учетной записи.
+// Связь по email допускается только с аккаунтом, чей адрес уже подтвержден,
+// иначе владелец неподтвержденного адреса получил бы чужой аккаунт.
+func linkIdentity(provider string, identity oidc.Identity) (User, bool, error) {
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return User{}, false, err
+	}
+	defer tx.Rollback()
+
+	var user User
+	var suspended bool
+	err = tx.QueryRow(`SELECT u.id, u.name, u.email, u.role, u.email_verified_at IS NOT NULL, u.suspended_at IS NOT NULL
+		FROM user_identities i JOIN users u ON u.id = i.user_id
+		WHERE i.provider = $1 AND i.subject = $2`, provider, identity.Subject).
+		Scan(&user.ID, &user.Name, &user.Email, &user.Role, &user.EmailVerified, &suspended)
+	if err == nil {
+		_, err = tx.Exec("UPDATE user_identities SET email = $3, last_login_at = now() WHERE provider = $1 AND subject = $2",
+			provider, identity.Subject, identity.Email)
+		if err != nil {
+			return User{}, false, err
+		}
+		return user, suspended, tx.Commit()
+	}
+	if err != sql.ErrNoRows {
+		return User{}, false, err
+	}
+
+	email, err := normalizeEmail(identity.Email)
+	if err != nil || !identity.EmailVerified {
+		return User{}, false, errIdentityEmailUnverified
+	}
+
+	err = tx.QueryRow(`SELECT id, name, email, role, email_verified_at IS NOT NULL, suspended_at IS NOT NULL
+		FROM users WHERE lower(email) = $1 FOR UPDATE`, email).
+		Scan(&user.ID, &user.Name, &user.Email, &user.Role, &user.EmailVerified, &suspended)
+	switch {
+	case err == sql.ErrNoRows:
+		if user, err = createIdentityUser(tx, identity, email); err != nil {
+			return User{}, false, err
+		}
+	case err != nil:
+		return User{}, false, err
+	case !user.EmailVerified:
+		return User{}, false, errAccountEmailUnverified
+	}
+
+	_, err = tx.Exec(`INSERT INTO user_identities (user_id, provider, subject, email, last_login_at)
+		VALUES ($1, $2, $3, $4, now())`, user.ID, provider, identity.Subject, email)
+	if err != nil {
+		return User{}, false, err
+	}
+	return user, suspended, tx.Commit()
+}
+
+// createIdentityUser создает аккаунт без пароля; email подтвержден провайдером.
+// Пароль можно задать позже через восстановление пароля.
+func createIdentityUser(tx *sql.Tx, identity oidc.Identity, email string) (User, error) {
+	user := User{Name: identity.Name, Email: email, Role: access.RoleUser, EmailVerified: true}
+	if user.Name == "" {
+		user.Name = email[:strings.Index(email, "@")]
+	}
+	err := tx.QueryRow(`INSERT INTO users (name, email, role, email_verified_at) VALUES ($1, $2, $3, now()) RETURNING id`,
+		user.Name, user.Email, user.Role).Scan(&user.ID)
+	if err != nil {
+		return User{}, err
+	}
+	msg := events.UserPayload{
+		UserID: user.ID,
+		Name:   user.Name,
+		Email:  user.Email,
+		Status: events.UserStatusActive,
+	}
+	if err := enqueueEvent(tx, events.UserCreated, msg); err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
@@ -0,0 +1,14 @@
+package handler
+
+import (
+	"database/sql"
+
+	"events"
+	"outbox"
+)
+
+// enqueueEvent сохраняет событие в outbox в рамках переданной транзакции;
+// публикует его relay из модуля outbox
+func enqueueEvent(tx *sql.Tx, eventType events.Type, payload interface{}) error {
+	return outbox.Enqueue(tx, eventProducer, eventType, payload)
+}
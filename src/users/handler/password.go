@@ -0,0 +1,256 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"events"
+	"users/db"
+	"users/ratelimit"
+)
+
+// Сброс пароля по одноразовой ссылке из письма. В БД хранится только хэш
+// токена; новый запрос делает предыдущие ссылки недействительными.
+
+const passwordResetTTL = time.Hour
+
+// Запросы ссылки ограничены по IP и по email, чтобы форму нельзя было
+// использовать для рассылки писем. Счетчик живет окно с последнего запроса.
+const (
+	forgotPasswordWindow   = time.Hour
+	forgotPasswordPerEmail = 3
+	forgotPasswordPerIP    = 20
+)
+
+var forgotPasswordRequests ratelimit.Store
+
+type PasswordForgot struct {
+	Email string `json:"email"`
+}
+
+type PasswordReset struct {
+	Token string `json:"token"`
+	Pass  string `json:"pass"`
+}
+
+// Данные для шаблонов писем
+type passwordMail struct {
+	Name     string
+	Link     string
+	ValidFor string
+}
+
+// Страница "забыли пароль"
+func forgotPasswordPage(w http.ResponseWriter, r *http.Request) {
+	tmpl := template.Must(template.ParseFiles("templates/forgot_password.html"))
+	tmpl.Execute(w, nil)
+}
+
+// Страница ввода нового пароля, токен приходит из ссылки в письме
+func resetPasswordPage(w http.ResponseWriter, r *http.Request) {
+	tmpl := template.Must(template.ParseFiles("templates/reset_password.html"))
+	tmpl.Execute(w, map[string]string{"Token": r.URL.Query().Get("token")})
+}
+
+// Запрос ссылки для сброса. Ответ одинаковый для существующих и несуществующих
+// адресов, чтобы по нему нельзя было проверить, зарегистрирован ли email.
+func forgotPassword(w http.ResponseWriter, r *http.Request) {
+	if !isPostRequest(w, r) {
+		return
+	}
+	var req PasswordForgot
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// На некорректный адрес ответ такой же, как на незарегистрированный
+	email, emailErr := normalizeEmail(req.Email)
+
+	// Лимит считается до поиска пользователя и одинаков для любых адресов
+	if wait := forgotPasswordRetryAfter(r.Context(), clientIP(r), email); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "Too many requests, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	var user User
+	err := sql.ErrNoRows
+	if emailErr == nil {
+		err = db.GetDB().QueryRow("SELECT id, name, email FROM users WHERE lower(email) = $1", email).Scan(&user.ID, &user.Name, &user.Email)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Could not process request", http.StatusInternalServerError)
+		return
+	}
+	if err == nil {
+		token, err := createPasswordResetToken(user.ID)
+		if err != nil {
+			log.Printf("Error creating password reset token for user %d: %v", user.ID, err)
+			http.Error(w, "Could not process request", http.StatusInternalServerError)
+			return
+		}
+		// Письмо уходит в фоне: время ответа не зависит от почтового сервера
+		// и не выдает, что адрес зарегистрирован
+		go sendMail(user.Email, "Сброс пароля", "password_reset", passwordMail{
+			Name:     user.Name,
+			Link:     publicURL() + "/users/password/reset?token=" + token,
+			ValidFor: "1 час",
+		})
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "If the account exists, a reset link has been sent"})
+}
+
+// forgotPasswordRetryAfter учитывает запрос ссылки и возвращает, сколько ждать,
+// если лимит по IP или по email (уже нормализованному) исчерпан; 0 — запрос разрешен. Отклоненный
+// запрос не продлевает окно. При недоступном хранилище счетчиков запрос не блокируется.
+func forgotPasswordRetryAfter(ctx context.Context, ip string, email string) time.Duration {
+	limits := []struct {
+		key string
+		max int
+	}{
+		{"forgot:ip:" + ip, forgotPasswordPerIP},
+		{"forgot:email:" + email, forgotPasswordPerEmail},
+	}
+
+	var wait time.Duration
+	for _, limit := range limits {
+		attempts, err := forgotPasswordRequests.Get(ctx, limit.key)
+		if err != nil {
+			log.Printf("Error reading password reset requests: %v", err)
+			return 0
+		}
+		if attempts.Count >= limit.max {
+			if left := time.Until(attempts.Last.Add(forgotPasswordWindow)); left > wait {
+				wait = left
+			}
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+
+	for _, limit := range limits {
+		if _, err := forgotPasswordRequests.Fail(ctx, limit.key, forgotPasswordWindow); err != nil {
+			log.Printf("Error counting password reset requests: %v", err)
+		}
+	}
+	return 0
+}
+
+func createPasswordResetToken(userID int) (string, error) {
+	token, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE password_reset_tokens SET used_at = now() WHERE user_id = $1 AND used_at IS NULL", userID); err != nil {
+		return "", err
+	}
+	_, err = tx.Exec("INSERT INTO password_reset_tokens (token_hash, user_id, expires_at) VALUES ($1, $2, $3)",
+		hashToken(token), userID, time.Now().Add(passwordResetTTL))
+	if err != nil {
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+// Установка нового пароля по токену из письма
+func resetPassword(w http.ResponseWriter, r *http.Request) {
+	if !isPostRequest(w, r) {
+		return
+	}
+	var req PasswordReset
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Token == "" || req.Pass == "" {
+		http.Error(w, "Token and password are required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		http.Error(w, "Could not reset password", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var (
+		tokenID   int64
+		expiresAt time.Time
+		usedAt    sql.NullTime
+		user      User
+	)
+	err = tx.QueryRow(`SELECT t.id, t.expires_at, t.used_at, u.id, u.name, u.email
+		FROM password_reset_tokens t JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = $1
+		FOR UPDATE OF t`, hashToken(req.Token)).
+		Scan(&tokenID, &expiresAt, &usedAt, &user.ID, &user.Name, &user.Email)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Could not reset password", http.StatusInternalServerError)
+		return
+	}
+	if err == sql.ErrNoRows || usedAt.Valid || time.Now().After(expiresAt) {
+		http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+		return
+	}
+
+	hashedPassword, err := hashPassword(req.Pass)
+	if err != nil {
+		http.Error(w, "Could not hash password", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("UPDATE users SET pass = $1 WHERE id = $2", hashedPassword, user.ID); err != nil {
+		http.Error(w, "Could not reset password", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("UPDATE password_reset_tokens SET used_at = now() WHERE id = $1", tokenID); err != nil {
+		http.Error(w, "Could not reset password", http.StatusInternalServerError)
+		return
+	}
+	msg := events.UserPayload{
+		UserID: user.ID,
+		Name:   user.Name,
+		Email:  user.Email,
+	}
+	if err := enqueueEvent(tx, events.UserPasswordChanged, msg); err != nil {
+		http.Error(w, "Could not reset password", http.StatusInternalServerError)
+		return
+	}
+	// Владелец подтвердил доступ к почте, блокировку входа можно снять
+	if err := unlockAccountTx(tx, user, 0, unlockReasonPasswordReset); err != nil {
+		http.Error(w, "Could not reset password", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Could not reset password", http.StatusInternalServerError)
+		return
+	}
+	resetLoginFailures(r.Context(), user.Email)
+
+	// Старый пароль мог утечь вместе с сессиями, завершаем их все
+	if err := revokeUserSessions(r.Context(), user.ID, ""); err != nil {
+		log.Printf("Error revoking sessions of user %d: %v", user.ID, err)
+	}
+	sendMail(user.Email, "Пароль изменен", "password_changed", passwordMail{
+		Name: user.Name,
+		Link: publicURL() + "/users/password/forgot",
+	})
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password changed"})
+}
@@ -0,0 +1,169 @@
+package handler
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"users/mail"
+	"users/ratelimit"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const selectUserByEmail = "SELECT id, name, email FROM users WHERE lower(email) = $1"
+
+// useMailer подменяет почту и счетчики запросов; шаблоны писем читаются
+// относительно каталога сервиса
+func useMailer(t *testing.T, m mail.Mailer) {
+	previousMailer, previousRequests := mailer, forgotPasswordRequests
+	mailer, forgotPasswordRequests = m, ratelimit.NewMemoryStore()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		mailer, forgotPasswordRequests = previousMailer, previousRequests
+	})
+}
+
+func forgotRequest(email string, ip string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/users/password/forgot/submit", strings.NewReader(`{"email":"`+email+`"}`))
+	r.RemoteAddr = ip + ":5000"
+	return r
+}
+
+func expectResetToken(mock sqlmock.Sqlmock, email string) {
+	mock.ExpectQuery(regexp.QuoteMeta(selectUserByEmail)).WithArgs(email).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email"}).AddRow(7, "Ann", email))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE password_reset_tokens SET used_at = now()")).WithArgs(7).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO password_reset_tokens")).WithArgs(sqlmock.AnyArg(), 7, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+}
+
+// waitSent ждет, пока фоновая отправка доставит n писем
+func waitSent(t *testing.T, m *mail.FileMailer, n int) []mail.Message {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(m.Sent()) < n && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	sent := m.Sent()
+	if len(sent) != n {
+		t.Fatalf("sent %d messages, want %d", len(sent), n)
+	}
+	return sent
+}
+
+func TestForgotPasswordSendsResetLink(t *testing.T) {
+	m := mail.NewFileMailer(t.TempDir(), "no-reply@example.com")
+	useMailer(t, m)
+	mock := useSQLMock(t)
+	expectResetToken(mock, "ann@example.com")
+	mock.ExpectQuery(regexp.QuoteMeta(selectUserByEmail)).WithArgs("nobody@example.com").WillReturnError(sql.ErrNoRows)
+
+	known := httptest.NewRecorder()
+	forgotPassword(known, forgotRequest(" Ann@Example.com", "203.0.113.7"))
+	unknown := httptest.NewRecorder()
+	forgotPassword(unknown, forgotRequest("nobody@example.com", "203.0.113.7"))
+
+	if known.Code != http.StatusOK || known.Body.String() != unknown.Body.String() || unknown.Code != http.StatusOK {
+		t.Errorf("responses differ: %d %q and %d %q", known.Code, known.Body, unknown.Code, unknown.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	sent := waitSent(t, m, 1)
+	if sent[0].To != "ann@example.com" || !strings.Contains(sent[0].Text, "/users/password/reset?token=") {
+		t.Errorf("mail = %+v, want a reset link to ann@example.com", sent[0])
+	}
+}
+
+// blockingMailer не отвечает, пока не закрыт release
+type blockingMailer struct {
+	release chan struct{}
+	sent    chan mail.Message
+}
+
+func (m blockingMailer) Send(msg mail.Message) error {
+	<-m.release
+	m.sent <- msg
+	return nil
+}
+
+func TestForgotPasswordDoesNotWaitForMail(t *testing.T) {
+	m := blockingMailer{release: make(chan struct{}), sent: make(chan mail.Message, 1)}
+	useMailer(t, m)
+	mock := useSQLMock(t)
+	expectResetToken(mock, "ann@example.com")
+
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		forgotPassword(rec, forgotRequest("ann@example.com", "203.0.113.7"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("forgotPassword waits for the mail server")
+	}
+	close(m.release)
+	select {
+	case <-m.sent:
+	case <-time.After(2 * time.Second):
+		t.Fatal("mail was not sent")
+	}
+}
+
+func TestForgotPasswordThrottling(t *testing.T) {
+	useMailer(t, mail.NewFileMailer(t.TempDir(), "no-reply@example.com"))
+	mock := useSQLMock(t)
+	mock.MatchExpectationsInOrder(false)
+
+	// Лимит по email не зависит от регистра и от IP
+	for i := 0; i < forgotPasswordPerEmail; i++ {
+		mock.ExpectQuery(regexp.QuoteMeta(selectUserByEmail)).WillReturnError(sql.ErrNoRows)
+		rec := httptest.NewRecorder()
+		forgotPassword(rec, forgotRequest("Nobody@example.com", fmt.Sprintf("203.0.113.%d", i+1)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d: code = %d", i+1, rec.Code)
+		}
+	}
+	rec := httptest.NewRecorder()
+	forgotPassword(rec, forgotRequest("nobody@example.com", "203.0.113.9"))
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("email over the limit: code = %d, Retry-After = %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	// Лимит по IP: разные адреса с одного IP
+	for i := 0; i < forgotPasswordPerIP; i++ {
+		mock.ExpectQuery(regexp.QuoteMeta(selectUserByEmail)).WillReturnError(sql.ErrNoRows)
+		rec := httptest.NewRecorder()
+		forgotPassword(rec, forgotRequest(fmt.Sprintf("user%d@example.com", i), "198.51.100.1"))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("IP request %d: code = %d", i+1, rec.Code)
+		}
+	}
+	rec = httptest.NewRecorder()
+	forgotPassword(rec, forgotRequest("other@example.com", "198.51.100.1"))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("IP over the limit: code = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
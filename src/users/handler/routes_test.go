@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+
+	"auth"
+	"auth/access"
+	"auth/access/accesstest"
+)
+
+func TestRoutePolicies(t *testing.T) {
+	rt := access.NewRouter(http.NewServeMux(), auth.NewJWKSVerifier("http://localhost/jwks.json", auth.NewMemoryRevocationStore()))
+	registerRoutes(rt)
+
+	manage := access.Require(access.UserManage)
+	accesstest.CheckPolicies(t, rt, map[string]access.Policy{
+		"/":                               access.Public(),
+		"/users/registration":             access.Public(),
+		"/users/login":                    access.Public(),
+		"/users/registration/create":      access.Public(),
+		"/users/login/submit":             access.Public(),
+		"/users/login/2fa":                access.Public(),
+		"/users/login/2fa/enroll":         access.Public(),
+		"/users/login/2fa/enroll/confirm": access.Public(),
+		"/users/oidc/{provider}/login":    access.Public(),
+		"/users/oidc/{provider}/callback": access.Public(),
+		"/users/token/refresh":            access.Public(),
+		"/users/logout":                   access.Public(),
+		"/users/.well-known/jwks.json":    access.Public(),
+		"/users/email/verify":             access.Public(),
+		"/users/email/verify/resend":      access.Authenticated(),
+		"/users/password/forgot":          access.Public(),
+		"/users/password/forgot/submit":   access.Public(),
+		"/users/password/reset":           access.Public(),
+		"/users/password/reset/submit":    access.Public(),
+		"/users/user/":                    access.Public(),
+		"/users/edit/":                    access.Authenticated(),
+		"/users/edit/submit":              access.Authenticated(),
+		"/users/me":                       access.Authenticated(),
+		"/users/me/exports":               access.Authenticated(),
+		"/users/me/exports/{id}":          access.Authenticated(),
+		"/users/me/exports/{id}/download": access.Authenticated(),
+		"/users/me/password":              access.Authenticated(),
+		"/users/me/delete":                access.Authenticated(),
+		"/users/deletions/{id}":           access.Public(),
+		"/users/sessions":                 access.Authenticated(),
+		"/users/me/sessions":              access.Authenticated(),
+		"/users/me/sessions/revoke":       access.Authenticated(),
+		"/users/me/sessions/revoke-all":   access.Authenticated(),
+		"/users/me/2fa":                   access.Authenticated(),
+		"/users/me/2fa/enroll":            access.Authenticated(),
+		"/users/me/2fa/confirm":           access.Authenticated(),
+		"/users/me/2fa/recovery-codes":    access.Authenticated(),
+		"/users/me/2fa/disable":           access.Authenticated(),
+		"/users/admin":                    manage,
+		"/users/admin/users":              manage,
+		"/users/admin/users/role":         manage,
+		"/users/admin/users/suspend":      manage,
+		"/users/admin/users/unsuspend":    manage,
+		"/users/admin/users/unlock":       manage,
+		"/users/admin/users/logout":       manage,
+		"/health":                         access.Public(),
+		"/ready":                          access.Public(),
+	})
+	accesstest.CheckNoDirectRoutes(t, ".")
+}
@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+
+	"events"
+	"users/db"
+)
+
+// Сессии пользователя. Каждый вход создает запись в sessions с устройством
+// (User-Agent) и IP; refresh-токены сессии образуют семейство с family_id = id
+// сессии. Время последней активности обновляется при обновлении токена доступа,
+// то есть не реже раза в accessTokenTTL, пока сессией пользуются.
+
+// Длинный User-Agent обрезается, показывать его целиком незачем
+const maxUserAgentLength = 512
+
+type Session struct {
+	ID         string    `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	Current    bool      `json:"current"`
+}
+
+type SessionAction struct {
+	ID string `json:"id"`
+}
+
+func userAgent(r *http.Request) string {
+	ua := r.UserAgent()
+	if len(ua) > maxUserAgentLength {
+		ua = ua[:maxUserAgentLength]
+	}
+	return ua
+}
+
+// Страница "Мои сессии"
+func sessionsPage(w http.ResponseWriter, r *http.Request) {
+	tmpl := template.Must(template.ParseFiles("templates/sessions.html"))
+	tmpl.Execute(w, nil)
+}
+
+// Действующие сессии текущего пользователя, последние активные первыми
+func listSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	rows, err := db.GetDB().Query(`SELECT id, user_agent, ip, created_at, last_seen_at FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > now()
+		ORDER BY last_seen_at DESC`, p.ID)
+	if err != nil {
+		http.Error(w, "Could not load sessions", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastSeenAt); err != nil {
+			http.Error(w, "Could not load sessions", http.StatusInternalServerError)
+			return
+		}
+		s.Current = s.ID == p.SessionID
+		sessions = append(sessions, s)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Could not load sessions", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// Завершение одной своей сессии; для текущей это то же, что выход
+func revokeOwnSession(w http.ResponseWriter, r *http.Request) {
+	if !isPostRequest(w, r) {
+		return
+	}
+	p, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	var action SessionAction
+	if err := json.NewDecoder(r.Body).Decode(&action); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	err := db.GetDB().QueryRow("SELECT EXISTS(SELECT 1 FROM sessions WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL)", action.ID, p.ID).Scan(&exists)
+	if err != nil {
+		http.Error(w, "Could not end session", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err := revokeSession(r.Context(), action.ID); err != nil {
+		http.Error(w, "Could not end session", http.StatusInternalServerError)
+		return
+	}
+	if action.ID == p.SessionID {
+		clearAuthCookies(w)
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "Session ended"})
+}
+
+// Выход на всех устройствах, включая текущее
+func revokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	if !isPostRequest(w, r) {
+		return
+	}
+	p, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		http.Error(w, "Could not end sessions", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	msg := events.UserPayload{UserID: p.ID, ActorID: p.ID}
+	err = tx.QueryRow("SELECT name, email FROM users WHERE id = $1", p.ID).Scan(&msg.Name, &msg.Email)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not end sessions", http.StatusInternalServerError)
+		return
+	}
+	if err := enqueueEvent(tx, events.UserSessionsRevoked, msg); err != nil {
+		http.Error(w, "Could not end sessions", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Could not end sessions", http.StatusInternalServerError)
+		return
+	}
+
+	if err := revokeUserSessions(r.Context(), p.ID, ""); err != nil {
+		log.Printf("Error revoking sessions of user %d: %v", p.ID, err)
+		http.Error(w, "Could not end sessions", http.StatusInternalServerError)
+		return
+	}
+	clearAuthCookies(w)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Signed out everywhere"})
+}
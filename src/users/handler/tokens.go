@@ -0,0 +1,335 @@
+package handler
+
+import (
+	"auth"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"users/db"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Короткоживущий токен доступа в cookie token и ротируемый refresh-токен в cookie
+// refresh_token. Каждый refresh-токен одноразовый: при обновлении выдается новый
+// в том же семействе (сессии). Повторное предъявление использованного токена
+// означает утечку, и тогда отзывается вся сессия.
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+
+	accessCookie  = "token"
+	refreshCookie = "refresh_token"
+)
+
+var (
+	signer   *auth.Signer
+	verifier *auth.Verifier
+)
+
+// initSigner загружает ключи подписи из JWT_KEYS_DIR (файлы <kid>.pem, активный
+// ключ задается JWT_ACTIVE_KID); пустой каталог при первом запуске получает ключ
+// с алгоритмом JWT_SIGNING_ALG (RS256 или EdDSA). Без каталога создается
+// временный ключ.
+func initSigner() {
+	var err error
+	if dir := os.Getenv("JWT_KEYS_DIR"); dir != "" {
+		if err = auth.EnsureSigningKey(dir, os.Getenv("JWT_SIGNING_ALG")); err == nil {
+			signer, err = auth.LoadSigner(dir, os.Getenv("JWT_ACTIVE_KID"))
+		}
+	} else {
+		log.Println("JWT_KEYS_DIR is not set, using a temporary signing key")
+		signer, err = auth.GenerateSigner(os.Getenv("JWT_SIGNING_ALG"))
+	}
+	if err != nil {
+		log.Fatalf("Не удалось загрузить ключи подписи: %s", err)
+	}
+	verifier = auth.NewLocalVerifier(signer, auth.RevocationStoreFromEnv())
+}
+
+// startSession начинает новую сессию после успешного входа и запоминает устройство
+func startSession(w http.ResponseWriter, r *http.Request, user User) error {
+	sessionID, err := auth.NewID()
+	if err != nil {
+		return err
+	}
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO sessions (id, user_id, user_agent, ip, expires_at) VALUES ($1, $2, $3, $4, $5)",
+		sessionID, user.ID, userAgent(r), clientIP(r), time.Now().Add(refreshTokenTTL))
+	if err != nil {
+		return err
+	}
+	tokens, err := issueTokens(tx, user, sessionID)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	setAuthCookies(w, tokens)
+	return nil
+}
+
+type tokenPair struct {
+	access  string
+	refresh string
+}
+
+// issueTokens выдает пару токенов в рамках сессии; refresh-токен сохраняется
+// в транзакции вызывающего, cookies ставятся только после ее фиксации
+func issueTokens(tx *sql.Tx, user User, sessionID string) (tokenPair, error) {
+	var tokens tokenPair
+	tokenID, err := auth.NewID()
+	if err != nil {
+		return tokens, err
+	}
+	if tokens.access, err = generateJWT(user, tokenID, sessionID); err != nil {
+		return tokens, err
+	}
+	if tokens.refresh, err = newOpaqueToken(); err != nil {
+		return tokens, err
+	}
+	_, err = tx.Exec("INSERT INTO refresh_tokens (token_hash, user_id, family_id, expires_at) VALUES ($1, $2, $3, $4)",
+		hashToken(tokens.refresh), user.ID, sessionID, time.Now().Add(refreshTokenTTL))
+	return tokens, err
+}
+
+func setAuthCookies(w http.ResponseWriter, tokens tokenPair) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     accessCookie,
+		Value:    tokens.access,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookie,
+		Value:    tokens.refresh,
+		Path:     "/users",
+		MaxAge:   int(refreshTokenTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// Generate JWT token for the user
+func generateJWT(user User, tokenID string, sessionID string) (string, error) {
+	claims := jwt.MapClaims{
+		auth.ClaimUserID:        user.ID,
+		auth.ClaimName:          user.Name,
+		auth.ClaimRole:          user.Role,
+		auth.ClaimEmailVerified: user.EmailVerified,
+		auth.ClaimTokenID:       tokenID,
+		auth.ClaimSessionID:     sessionID,
+		auth.ClaimExpiresAt:     time.Now().Add(accessTokenTTL).Unix(),
+	}
+
+	return signer.Sign(claims)
+}
+
+// Обмен refresh-токена на новую пару токенов
+func refreshTokens(w http.ResponseWriter, r *http.Request) {
+	if !isPostRequest(w, r) {
+		return
+	}
+	cookie, err := r.Cookie(refreshCookie)
+	if err != nil || cookie.Value == "" {
+		http.Error(w, "Missing refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		http.Error(w, "Could not refresh token", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var (
+		tokenID   int64
+		sessionID string
+		expiresAt time.Time
+		usedAt    sql.NullTime
+		revokedAt sql.NullTime
+		suspended bool
+		user      User
+	)
+	err = tx.QueryRow(`SELECT t.id, t.family_id, t.expires_at, t.used_at, t.revoked_at, u.id, u.name, u.role, u.email_verified_at IS NOT NULL, u.suspended_at IS NOT NULL
+		FROM refresh_tokens t JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = $1
+		FOR UPDATE OF t`, hashToken(cookie.Value)).
+		Scan(&tokenID, &sessionID, &expiresAt, &usedAt, &revokedAt, &user.ID, &user.Name, &user.Role, &user.EmailVerified, &suspended)
+	if err == sql.ErrNoRows {
+		clearAuthCookies(w)
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not refresh token", http.StatusInternalServerError)
+		return
+	}
+
+	if revokedAt.Valid {
+		clearAuthCookies(w)
+		http.Error(w, "Session has been revoked", http.StatusUnauthorized)
+		return
+	}
+	if usedAt.Valid {
+		// Токен уже обменяли: им пользуется кто-то ещё, закрываем всю сессию
+		tx.Rollback()
+		log.Printf("Refresh token reuse detected for user %d, revoking session %s", user.ID, sessionID)
+		if err := revokeSession(r.Context(), sessionID); err != nil {
+			log.Printf("Error revoking session %s: %v", sessionID, err)
+		}
+		clearAuthCookies(w)
+		http.Error(w, "Refresh token reuse detected", http.StatusUnauthorized)
+		return
+	}
+	if time.Now().After(expiresAt) {
+		clearAuthCookies(w)
+		http.Error(w, "Refresh token expired", http.StatusUnauthorized)
+		return
+	}
+	if suspended {
+		clearAuthCookies(w)
+		http.Error(w, "Account suspended", http.StatusForbidden)
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE refresh_tokens SET used_at = now() WHERE id = $1", tokenID); err != nil {
+		http.Error(w, "Could not refresh token", http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec("UPDATE sessions SET last_seen_at = now(), user_agent = $2, ip = $3, expires_at = $4 WHERE id = $1",
+		sessionID, userAgent(r), clientIP(r), time.Now().Add(refreshTokenTTL))
+	if err != nil {
+		http.Error(w, "Could not refresh token", http.StatusInternalServerError)
+		return
+	}
+	// Новый токен записывается в той же транзакции, что и отметка об использовании
+	// старого: при сбое клиент сохраняет рабочий токен и может повторить обмен
+	tokens, err := issueTokens(tx, user, sessionID)
+	if err != nil {
+		http.Error(w, "Could not generate token", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Could not refresh token", http.StatusInternalServerError)
+		return
+	}
+	setAuthCookies(w, tokens)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Token refreshed"})
+}
+
+// Выход: отзываем текущий токен доступа и всю сессию
+func logout(w http.ResponseWriter, r *http.Request) {
+	if !isPostRequest(w, r) {
+		return
+	}
+
+	var sessionID string
+	if cookie, err := r.Cookie(accessCookie); err == nil {
+		if claims, err := verifier.Parse(r.Context(), cookie.Value); err == nil {
+			if err := auth.RevokeToken(r.Context(), verifier.Revocations(), claims); err != nil {
+				log.Printf("Error revoking access token: %v", err)
+			}
+			sessionID, _ = claims[auth.ClaimSessionID].(string)
+		}
+	}
+	// Токен доступа мог истечь, тогда сессию находим по refresh-токену
+	if cookie, err := r.Cookie(refreshCookie); sessionID == "" && err == nil {
+		db.GetDB().QueryRow("SELECT family_id FROM refresh_tokens WHERE token_hash = $1", hashToken(cookie.Value)).Scan(&sessionID)
+	}
+
+	if sessionID != "" {
+		if err := revokeSession(r.Context(), sessionID); err != nil {
+			http.Error(w, "Could not log out", http.StatusInternalServerError)
+			return
+		}
+	}
+	clearAuthCookies(w)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Logged out"})
+}
+
+// revokeSession отзывает все refresh-токены сессии и её токены доступа
+func revokeSession(ctx context.Context, sessionID string) error {
+	_, err := db.GetDB().Exec("UPDATE sessions SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL", sessionID)
+	if err != nil {
+		return err
+	}
+	_, err = db.GetDB().Exec("UPDATE refresh_tokens SET revoked_at = now() WHERE family_id = $1 AND revoked_at IS NULL", sessionID)
+	if err != nil {
+		return err
+	}
+	return auth.RevokeSession(ctx, verifier.Revocations(), sessionID, time.Now().Add(accessTokenTTL))
+}
+
+// revokeUserSessions завершает все сессии пользователя, кроме except
+func revokeUserSessions(ctx context.Context, userID int, except string) error {
+	_, err := db.GetDB().Exec("UPDATE refresh_tokens SET revoked_at = now() WHERE user_id = $1 AND family_id <> $2 AND revoked_at IS NULL", userID, except)
+	if err != nil {
+		return err
+	}
+	// В истекших сессиях не осталось действующих токенов доступа
+	rows, err := db.GetDB().Query(`UPDATE sessions SET revoked_at = now()
+		WHERE user_id = $1 AND id <> $2 AND revoked_at IS NULL AND expires_at > now()
+		RETURNING id`, userID, except)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var sessions []string
+	for rows.Next() {
+		var sessionID string
+		if err := rows.Scan(&sessionID); err != nil {
+			return err
+		}
+		sessions = append(sessions, sessionID)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, sessionID := range sessions {
+		if err := auth.RevokeSession(ctx, verifier.Revocations(), sessionID, time.Now().Add(accessTokenTTL)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func clearAuthCookies(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: accessCookie, Path: "/", MaxAge: -1, HttpOnly: true, Secure: true})
+	http.SetCookie(w, &http.Cookie{Name: refreshCookie, Path: "/users", MaxAge: -1, HttpOnly: true, Secure: true})
+}
+
+// newOpaqueToken случайный токен для refresh-токенов и ссылок из писем
+func newOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// В БД хранится только хэш токена
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
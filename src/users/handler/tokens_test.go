@@ -0,0 +1,162 @@
+package handler
+
+import (
+	"auth"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+	"users/db"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const selectRefreshToken = "FROM refresh_tokens t JOIN users u ON u.id = t.user_id"
+
+func useSQLMock(t *testing.T) sqlmock.Sqlmock {
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	db.SetDB(conn)
+	return mock
+}
+
+// useTestSigner временный ключ подписи и отзыв в памяти
+func useTestSigner(t *testing.T) {
+	previousSigner, previousVerifier := signer, verifier
+	var err error
+	if signer, err = auth.GenerateSigner("EdDSA"); err != nil {
+		t.Fatal(err)
+	}
+	verifier = auth.NewLocalVerifier(signer, auth.NewMemoryRevocationStore())
+	t.Cleanup(func() { signer, verifier = previousSigner, previousVerifier })
+}
+
+func refreshRequest(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/users/token/refresh", nil)
+	r.AddCookie(&http.Cookie{Name: refreshCookie, Value: token})
+	return r
+}
+
+func refreshTokenRow(usedAt interface{}) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "family_id", "expires_at", "used_at", "revoked_at", "user_id", "name", "role", "email_verified", "suspended"}).
+		AddRow(1, "s1", time.Now().Add(time.Hour), usedAt, nil, 7, "Ann", "user", true, false)
+}
+
+func expectRevokeSession(mock sqlmock.Sqlmock, sessionID string) {
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE sessions SET revoked_at = now() WHERE id = $1")).WithArgs(sessionID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE refresh_tokens SET revoked_at = now() WHERE family_id = $1")).WithArgs(sessionID).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+}
+
+func cookieValue(rec *httptest.ResponseRecorder, name string) (string, bool) {
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == name {
+			return c.Value, c.MaxAge >= 0
+		}
+	}
+	return "", false
+}
+
+func TestRefreshRotatesToken(t *testing.T) {
+	useTestSigner(t)
+	mock := useSQLMock(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(selectRefreshToken)).WithArgs(hashToken("current")).WillReturnRows(refreshTokenRow(nil))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE refresh_tokens SET used_at = now() WHERE id = $1")).WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE sessions SET last_seen_at = now()")).WithArgs("s1", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// Новый токен выдается в той же сессии и в той же транзакции
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO refresh_tokens")).WithArgs(sqlmock.AnyArg(), 7, "s1", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectCommit()
+
+	rec := httptest.NewRecorder()
+	refreshTokens(rec, refreshRequest("current"))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("code = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	refreshToken, ok := cookieValue(rec, refreshCookie)
+	if !ok || refreshToken == "" || refreshToken == "current" {
+		t.Errorf("refresh cookie = %q, want a new token", refreshToken)
+	}
+	accessToken, _ := cookieValue(rec, accessCookie)
+	claims, err := verifier.Parse(context.Background(), accessToken)
+	if err != nil {
+		t.Fatalf("new access token: %v", err)
+	}
+	if claims[auth.ClaimSessionID] != "s1" {
+		t.Errorf("sid = %v, want s1", claims[auth.ClaimSessionID])
+	}
+}
+
+// Повторное предъявление уже обмененного refresh-токена отзывает всю сессию:
+// и её refresh-токены в БД, и уже выданные токены доступа
+func TestRefreshReuseRevokesSession(t *testing.T) {
+	useTestSigner(t)
+	issued, err := generateJWT(User{ID: 7, Name: "Ann", Role: "user"}, "t1", "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.Parse(context.Background(), issued); err != nil {
+		t.Fatalf("access token before reuse: %v", err)
+	}
+
+	mock := useSQLMock(t)
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(selectRefreshToken)).WithArgs(hashToken("stolen")).WillReturnRows(refreshTokenRow(time.Now()))
+	mock.ExpectRollback()
+	expectRevokeSession(mock, "s1")
+
+	rec := httptest.NewRecorder()
+	refreshTokens(rec, refreshRequest("stolen"))
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("code = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cookieValue(rec, refreshCookie); ok {
+		t.Error("refresh cookie is not cleared")
+	}
+	if _, err := verifier.Parse(context.Background(), issued); !errors.Is(err, auth.ErrRevoked) {
+		t.Errorf("access token after reuse: error = %v, want %v", err, auth.ErrRevoked)
+	}
+}
+
+func TestLogoutRevokesAccessToken(t *testing.T) {
+	useTestSigner(t)
+	issued, err := generateJWT(User{ID: 7, Name: "Ann", Role: "user"}, "t1", "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock := useSQLMock(t)
+	expectRevokeSession(mock, "s1")
+
+	r := httptest.NewRequest(http.MethodPost, "/users/logout", nil)
+	r.AddCookie(&http.Cookie{Name: accessCookie, Value: issued})
+	rec := httptest.NewRecorder()
+	logout(rec, r)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("code = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.Parse(context.Background(), issued); !errors.Is(err, auth.ErrRevoked) {
+		t.Errorf("access token after logout: error = %v, want %v", err, auth.ErrRevoked)
+	}
+}
@@ -0,0 +1,615 @@
+package handler
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"auth"
+	"auth/access"
+	"users/db"
+	"users/totp"
+
+	"github.com/dgrijalva/jwt-go"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Двухфакторная аутентификация по TOTP. Пользователь подключает приложение-
+// аутентификатор в профиле: получает секрет и QR-код, подтверждает его кодом и
+// получает одноразовые коды восстановления. Если 2FA включена, login после
+// проверки пароля не выдает токены, а отвечает "second_factor_required" и ставит
+// cookie с коротким подписанным challenge; сессия начинается только после кода.
+// Администраторы без 2FA при входе обязаны её подключить.
+
+const (
+	loginChallengeTTL     = 5 * time.Minute
+	loginChallengePurpose = "login_second_factor"
+	loginChallengeCookie  = "login_challenge"
+	claimEnroll           = "enroll" // challenge разрешает только подключение 2FA
+
+	recoveryCodeCount = 10
+	defaultTOTPIssuer = "Shop"
+)
+
+// Промежуточные состояния входа в ответе login
+const (
+	loginStatusSecondFactor = "second_factor_required"
+	loginStatusEnroll       = "second_factor_enrollment_required"
+)
+
+var (
+	errTOTPNotEnrolled    = errors.New("two-factor authentication is not being set up")
+	errTOTPAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	errInvalidCode        = errors.New("invalid code")
+)
+
+// TOTPEnrollment данные для подключения приложения-аутентификатора.
+// QR — PNG в виде data URL, в нем закодирован URI.
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+	QR     string `json:"qr"`
+}
+
+type TwoFactorStatus struct {
+	Enabled           bool `json:"enabled"`
+	Required          bool `json:"required"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+}
+
+type SecondFactorCode struct {
+	Code string `json:"code"`
+}
+
+func totpIssuer() string {
+	if issuer := os.Getenv("TOTP_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return defaultTOTPIssuer
+}
+
+// twoFactorRequired роли, которым нельзя входить без второго фактора
+func twoFactorRequired(role string) bool {
+	return role == access.RoleAdmin
+}
+
+/*
+
+
+ПОДКЛЮЧЕНИЕ И ПРОВЕРКА
+
+
+*/
+
+// beginTOTPEnrollment создает новый неподтвержденный секрет; прежний
+// неподтвержденный заменяется, включенную 2FA заменить нельзя
+func beginTOTPEnrollment(userID int, email string) (TOTPEnrollment, error) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+	result, err := db.GetDB().Exec(`INSERT INTO user_totp (user_id, secret) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, created_at = now(), last_used_step = NULL
+		WHERE user_totp.confirmed_at IS NULL`, userID, secret)
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return TOTPEnrollment{}, errTOTPAlreadyEnabled
+	}
+
+	uri := totp.ProvisioningURI(secret, totpIssuer(), email)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+	return TOTPEnrollment{
+		Secret: secret,
+		URI:    uri,
+		QR:     "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	}, nil
+}
+
+// confirmTOTPEnrollment включает 2FA по первому коду из приложения и
+// возвращает новые коды восстановления
+func confirmTOTPEnrollment(userID int, code string) ([]string, error) {
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var secret string
+	err = tx.QueryRow("SELECT secret FROM user_totp WHERE user_id = $1 AND confirmed_at IS NULL FOR UPDATE", userID).Scan(&secret)
+	if err == sql.ErrNoRows {
+		return nil, errTOTPNotEnrolled
+	}
+	if err != nil {
+		return nil, err
+	}
+	step, ok := totp.Validate(secret, code, time.Now(), 0)
+	if !ok {
+		return nil, errInvalidCode
+	}
+	if _, err := tx.Exec("UPDATE user_totp SET confirmed_at = now(), last_used_step = $2 WHERE user_id = $1", userID, step); err != nil {
+		return nil, err
+	}
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// replaceRecoveryCodes выпускает новый набор кодов восстановления; старые перестают действовать.
+// В БД хранятся только хэши.
+func replaceRecoveryCodes(tx *sql.Tx, userID int) ([]string, error) {
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := hex.EncodeToString(b)
+		codes[i] = code[:5] + "-" + code[5:]
+		if _, err := tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)", userID, hashRecoveryCode(codes[i])); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	return hashToken(strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", "")))
+}
+
+// isRecoveryCode отличает код восстановления (xxxxx-xxxxx) от кода TOTP
+func isRecoveryCode(code string) bool {
+	return len(strings.ReplaceAll(strings.TrimSpace(code), "-", "")) == 10
+}
+
+// verifySecondFactor проверяет код TOTP или одноразовый код восстановления.
+// Использованный код повторно не принимается.
+func verifySecondFactor(userID int, code string) error {
+	if isRecoveryCode(code) {
+		result, err := db.GetDB().Exec("UPDATE recovery_codes SET used_at = now() WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL",
+			userID, hashRecoveryCode(code))
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return errInvalidCode
+		}
+		return nil
+	}
+
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var secret string
+	var lastStep int64
+	err = tx.QueryRow("SELECT secret, COALESCE(last_used_step, 0) FROM user_totp WHERE user_id = $1 AND confirmed_at IS NOT NULL FOR UPDATE", userID).
+		Scan(&secret, &lastStep)
+	if err == sql.ErrNoRows {
+		return errTOTPNotEnrolled
+	}
+	if err != nil {
+		return err
+	}
+	step, ok := totp.Validate(secret, code, time.Now(), lastStep)
+	if !ok {
+		return errInvalidCode
+	}
+	if _, err := tx.Exec("UPDATE user_totp SET last_used_step = $2 WHERE user_id = $1", userID, step); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// checkSecondFactor проверяет код под теми же счетчиками попыток, что и вход:
+// коды перебираются так же, как пароли, где бы их ни принимали. При отказе
+// ответ уже записан.
+func checkSecondFactor(w http.ResponseWriter, r *http.Request, user User, code string) bool {
+	ctx := r.Context()
+	ipKey, accountKey := ipAttemptsKey(r), accountAttemptsKey(user.Email)
+	if wait := loginRetryAfter(ctx, ipKey, accountKey); wait > 0 {
+		tooManyLoginAttempts(w, wait)
+		return false
+	}
+	if err := verifySecondFactor(user.ID, code); err != nil {
+		if err == errInvalidCode || err == errTOTPNotEnrolled {
+			recordLoginFailure(ctx, ipKey, accountKey, &user)
+			http.Error(w, "Invalid code", http.StatusUnauthorized)
+			return false
+		}
+		http.Error(w, "Could not verify code", http.StatusInternalServerError)
+		return false
+	}
+	resetLoginFailures(ctx, user.Email)
+	return true
+}
+
+func loadTwoFactorStatus(userID int, role string) (TwoFactorStatus, error) {
+	status := TwoFactorStatus{Required: twoFactorRequired(role)}
+	err := db.GetDB().QueryRow(`SELECT
+			EXISTS (SELECT 1 FROM user_totp WHERE user_id = $1 AND confirmed_at IS NOT NULL),
+			(SELECT COUNT(*) FROM recovery_codes WHERE user_id = $1 AND used_at IS NULL)`, userID).
+		Scan(&status.Enabled, &status.RecoveryCodesLeft)
+	return status, err
+}
+
+/*
+
+
+ВХОД СО ВТОРЫМ ФАКТОРОМ
+
+
+*/
+
+// startLoginChallenge вызывается login после проверки пароля вместо выдачи токенов
+func startLoginChallenge(w http.ResponseWriter, user User, enroll bool) error {
+	status, err := setLoginChallenge(w, user, enroll)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(map[string]string{"message": "Second factor required", "status": status})
+}
+
+// setLoginChallenge ставит cookie challenge и возвращает состояние входа
+func setLoginChallenge(w http.ResponseWriter, user User, enroll bool) (string, error) {
+	token, err := signer.Sign(jwt.MapClaims{
+		auth.ClaimPurpose:   loginChallengePurpose,
+		auth.ClaimUserID:    user.ID,
+		claimEnroll:         enroll,
+		auth.ClaimExpiresAt: time.Now().Add(loginChallengeTTL).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginChallengeCookie,
+		Value:    token,
+		Path:     "/users/login",
+		MaxAge:   int(loginChallengeTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	if enroll {
+		return loginStatusEnroll, nil
+	}
+	return loginStatusSecondFactor, nil
+}
+
+func clearLoginChallenge(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: loginChallengeCookie, Path: "/users/login", MaxAge: -1, HttpOnly: true, Secure: true})
+}
+
+// loginChallengeUser пользователь из challenge; заблокированным вход не продолжается
+func loginChallengeUser(w http.ResponseWriter, r *http.Request) (User, bool, bool) {
+	cookie, err := r.Cookie(loginChallengeCookie)
+	if err != nil {
+		http.Error(w, "Login session expired, sign in again", http.StatusUnauthorized)
+		return User{}, false, false
+	}
+	claims, err := verifier.ParsePurpose(cookie.Value, loginChallengePurpose)
+	if err != nil {
+		clearLoginChallenge(w)
+		http.Error(w, "Login session expired, sign in again", http.StatusUnauthorized)
+		return User{}, false, false
+	}
+	id, _ := claims[auth.ClaimUserID].(float64)
+	enroll, _ := claims[claimEnroll].(bool)
+
+	var user User
+	var suspended bool
+	err = db.GetDB().QueryRow("SELECT id, name, email, role, email_verified_at IS NOT NULL, suspended_at IS NOT NULL FROM users WHERE id = $1", int(id)).
+		Scan(&user.ID, &user.Name, &user.Email, &user.Role, &user.EmailVerified, &suspended)
+	if err == sql.ErrNoRows {
+		clearLoginChallenge(w)
+		http.Error(w, "Login session expired, sign in again", http.StatusUnauthorized)
+		return User{}, false, false
+	}
+	if err != nil {
+		http.Error(w, "Could not log in", http.StatusInternalServerError)
+		return User{}, false, false
+	}
+	if suspended {
+		clearLoginChallenge(w)
+		http.Error(w, "Account suspended", http.StatusForbidden)
+		return User{}, false, false
+	}
+	return user, enroll, true
+}
+
+// Второй шаг входа: код из приложения или код восстановления
+func loginSecondFactor(w http.ResponseWriter, r *http.Request) {
+	if !isPostRequest(w, r) {
+		return
+	}
+	user, enroll, ok := loginChallengeUser(w, r)
+	if !ok {
+		return
+	}
+	if enroll {
+		http.Error(w, "Two-factor authentication must be set up first", http.StatusForbidden)
+		return
+	}
+	var req SecondFactorCode
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !checkSecondFactor(w, r, user, req.Code) {
+		return
+	}
+	clearLoginChallenge(w)
+
+	if err := startSession(w, r, user); err != nil {
+		http.Error(w, "Could not generate token", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "Login successful"})
+}
+
+// Обязательное подключение 2FA при входе: выдать секрет
+func loginEnrollSecondFactor(w http.ResponseWriter, r *http.Request) {
+	if !isPostRequest(w, r) {
+		return
+	}
+	user, enroll, ok := loginChallengeUser(w, r)
+	if !ok {
+		return
+	}
+	if !enroll {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	writeTOTPEnrollment(w, user.ID, user.Email)
+}
+
+// Обязательное подключение 2FA при входе: подтвердить код и начать сессию
+func loginConfirmSecondFactor(w http.ResponseWriter, r *http.Request) {
+	if !isPostRequest(w, r) {
+		return
+	}
+	user, enroll, ok := loginChallengeUser(w, r)
+	if !ok {
+		return
+	}
+	if !enroll {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	var req SecondFactorCode
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	ipKey, accountKey := ipAttemptsKey(r), accountAttemptsKey(user.Email)
+	if wait := loginRetryAfter(ctx, ipKey, accountKey); wait > 0 {
+		tooManyLoginAttempts(w, wait)
+		return
+	}
+	codes, err := confirmTOTPEnrollment(user.ID, req.Code)
+	if err == errInvalidCode {
+		recordLoginFailure(ctx, ipKey, accountKey, &user)
+	}
+	if err != nil {
+		writeTwoFactorError(w, err)
+		return
+	}
+	resetLoginFailures(ctx, user.Email)
+	clearLoginChallenge(w)
+
+	if err := startSession(w, r, user); err != nil {
+		http.Error(w, "Could not generate token", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Login successful", "recovery_codes": codes})
+}
+
+/*
+
+
+УПРАВЛЕНИЕ 2FA В ПРОФИЛЕ
+
+
+*/
+
+// currentUser пользователь из токена вместе с email из БД: по email
+// считаются попытки ввода кода
+func currentUser(w http.ResponseWriter, p access.Principal) (User, bool) {
+	profile, err := loadProfile(p.ID)
+	if err == errUserNotFound {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return User{}, false
+	}
+	if err != nil {
+		http.Error(w, "Could not load profile", http.StatusInternalServerError)
+		return User{}, false
+	}
+	return User{ID: p.ID, Name: profile.Name, Email: profile.Email, Role: p.Role}, true
+}
+
+// GET состояние 2FA текущего пользователя
+func twoFactorStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	p, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	status, err := loadTwoFactorStatus(p.ID, p.Role)
+	if err != nil {
+		http.Error(w, "Could not load two-factor status", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// POST выдать секрет для подключения приложения
+func enrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if !isPostRequest(w, r) {
+		return
+	}
+	p, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	profile, err := loadProfile(p.ID)
+	if err != nil {
+		http.Error(w, "Could not load profile", http.StatusInternalServerError)
+		return
+	}
+	writeTOTPEnrollment(w, p.ID, profile.Email)
+}
+
+// POST {"code"} подтвердить подключение, в ответе коды восстановления
+func confirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if !isPostRequest(w, r) {
+		return
+	}
+	p, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	var req SecondFactorCode
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	codes, err := confirmTOTPEnrollment(p.ID, req.Code)
+	if err != nil {
+		writeTwoFactorError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Two-factor authentication enabled", "recovery_codes": codes})
+}
+
+// POST {"code"} новый набор кодов восстановления; нужен текущий код,
+// неверные коды учитываются в ограничениях попыток входа
+func regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	if !isPostRequest(w, r) {
+		return
+	}
+	p, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	var req SecondFactorCode
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user, ok := currentUser(w, p)
+	if !ok || !checkSecondFactor(w, r, user, req.Code) {
+		return
+	}
+
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		http.Error(w, "Could not create recovery codes", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	codes, err := replaceRecoveryCodes(tx, p.ID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "Could not create recovery codes", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"recovery_codes": codes})
+}
+
+// POST {"code"} отключить 2FA; администраторам недоступно.
+// Неверные коды учитываются в ограничениях попыток входа.
+func disableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if !isPostRequest(w, r) {
+		return
+	}
+	p, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	if twoFactorRequired(p.Role) {
+		http.Error(w, "Two-factor authentication is required for this account", http.StatusForbidden)
+		return
+	}
+	var req SecondFactorCode
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user, ok := currentUser(w, p)
+	if !ok || !checkSecondFactor(w, r, user, req.Code) {
+		return
+	}
+
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		http.Error(w, "Could not disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM user_totp WHERE user_id = $1", p.ID)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM recovery_codes WHERE user_id = $1", p.ID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "Could not disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %d disabled two-factor authentication", p.ID)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication disabled"})
+}
+
+func writeTOTPEnrollment(w http.ResponseWriter, userID int, email string) {
+	enrollment, err := beginTOTPEnrollment(userID, email)
+	if err != nil {
+		writeTwoFactorError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(enrollment)
+}
+
+func writeTwoFactorError(w http.ResponseWriter, err error) {
+	switch err {
+	case errInvalidCode:
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+	case errTOTPNotEnrolled, errTOTPAlreadyEnabled:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("Two-factor error: %v", err)
+		http.Error(w, "Could not process two-factor request", http.StatusInternalServerError)
+	}
+}
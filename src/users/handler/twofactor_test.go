@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"auth/access"
+	"users/totp"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const (
+	selectLoginUser     = "FROM users WHERE lower(email)=$1"
+	selectTwoFactor     = "FROM user_totp WHERE user_id = $1 AND confirmed_at IS NOT NULL),"
+	selectChallengeUser = "FROM users WHERE id = $1"
+	useRecoveryCode     = "UPDATE recovery_codes SET used_at = now()"
+)
+
+// challengeCookie challenge второго шага входа для пользователя 7
+func challengeCookie(t *testing.T) *http.Cookie {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	if err := startLoginChallenge(rec, User{ID: 7}, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == loginChallengeCookie {
+			return c
+		}
+	}
+	t.Fatal("no login challenge cookie")
+	return nil
+}
+
+func secondFactorRequest(challenge *http.Cookie, code string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/users/login/2fa", strings.NewReader(`{"code":"`+code+`"}`))
+	r.RemoteAddr = "203.0.113.7:5000"
+	r.AddCookie(challenge)
+	return r
+}
+
+// С включенной 2FA пароль не дает токенов: только короткий challenge для второго шага
+func TestLoginWithTwoFactorSetsChallenge(t *testing.T) {
+	useTestSigner(t)
+	useLoginAttempts(t)
+	mock := useSQLMock(t)
+	hash, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(selectLoginUser)).WithArgs("ann@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "pass", "role", "email_verified", "suspended", "locked_until"}).
+			AddRow(7, "Ann", "ann@example.com", hash, "user", true, false, nil))
+	mock.ExpectQuery(regexp.QuoteMeta(selectTwoFactor)).WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"enabled", "left"}).AddRow(true, 10))
+
+	rec := httptest.NewRecorder()
+	login(rec, loginRequest("ann@example.com", "secret"))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("code = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	var body map[string]string
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || body["status"] != loginStatusSecondFactor {
+		t.Errorf("body = %v, %v, want status %s", body, err, loginStatusSecondFactor)
+	}
+	if _, ok := cookieValue(rec, accessCookie); ok {
+		t.Error("access token issued before the second factor")
+	}
+	var challenge *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == loginChallengeCookie {
+			challenge = c
+		}
+	}
+	if challenge == nil || challenge.Path != "/users/login" || !challenge.HttpOnly || challenge.MaxAge != int(loginChallengeTTL.Seconds()) {
+		t.Fatalf("challenge cookie = %+v, want a short-lived HttpOnly cookie for /users/login", challenge)
+	}
+	if _, err := verifier.ParsePurpose(challenge.Value, loginChallengePurpose); err != nil {
+		t.Errorf("challenge token: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Код восстановления начинает сессию один раз; повтор того же кода отклоняется
+func TestLoginSecondFactorConsumesRecoveryCode(t *testing.T) {
+	useTestSigner(t)
+	useLoginAttempts(t)
+	mock := useSQLMock(t)
+	challenge := challengeCookie(t)
+	const code = "abcde-12345"
+	userRow := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "name", "email", "role", "email_verified", "suspended"}).
+			AddRow(7, "Ann", "ann@example.com", "user", true, false)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(selectChallengeUser)).WithArgs(7).WillReturnRows(userRow())
+	mock.ExpectExec(regexp.QuoteMeta(useRecoveryCode)).WithArgs(7, hashRecoveryCode(code)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO sessions")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO refresh_tokens")).WithArgs(sqlmock.AnyArg(), 7, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	rec := httptest.NewRecorder()
+	loginSecondFactor(rec, secondFactorRequest(challenge, code))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("code = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if token, ok := cookieValue(rec, accessCookie); !ok || token == "" {
+		t.Error("no access token after the second factor")
+	}
+	if _, active := cookieValue(rec, loginChallengeCookie); active {
+		t.Error("login challenge is not cleared")
+	}
+
+	// Код уже использован: UPDATE не находит строк
+	mock.ExpectQuery(regexp.QuoteMeta(selectChallengeUser)).WithArgs(7).WillReturnRows(userRow())
+	mock.ExpectExec(regexp.QuoteMeta(useRecoveryCode)).WithArgs(7, hashRecoveryCode(code)).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	rec = httptest.NewRecorder()
+	loginSecondFactor(rec, secondFactorRequest(challenge, strings.ToUpper(code)))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("reused code: code = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if _, ok := cookieValue(rec, accessCookie); ok {
+		t.Error("reused code started a session")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Код в профиле перебирается так же, как на входе: после accountBackoffAfter
+// неудач запросы отклоняются до проверки кода
+func TestRegenerateRecoveryCodesIsThrottled(t *testing.T) {
+	useTestSigner(t)
+	useLoginAttempts(t)
+	mock := useSQLMock(t)
+	token, err := generateJWT(User{ID: 7, Name: "Ann", Role: access.RoleUser}, "t1", "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := access.Wrap(verifier, access.Authenticated(), regenerateRecoveryCodes)
+	request := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/users/me/2fa/recovery-codes", strings.NewReader(`{"code":"000000"}`))
+		r.RemoteAddr = "203.0.113.7:5000"
+		r.AddCookie(&http.Cookie{Name: access.TokenCookie, Value: token})
+		rec := httptest.NewRecorder()
+		handler(rec, r)
+		return rec
+	}
+	expectProfile := func() {
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT id, name, email, role, email_verified_at IS NOT NULL, pending_email FROM users")).WithArgs(7).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "role", "email_verified", "pending_email"}).
+				AddRow(7, "Ann", "ann@example.com", "user", true, nil))
+	}
+
+	for i := 0; i < accountBackoffAfter; i++ {
+		expectProfile()
+		mock.ExpectBegin()
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT secret, COALESCE(last_used_step, 0) FROM user_totp")).WithArgs(7).
+			WillReturnRows(sqlmock.NewRows([]string{"secret", "last_used_step"}).AddRow(secret, 0))
+		mock.ExpectRollback()
+		if rec := request(); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: code = %d, want %d: %s", i+1, rec.Code, http.StatusUnauthorized, rec.Body)
+		}
+	}
+
+	expectProfile()
+	rec := request()
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("code = %d, Retry-After = %q, want 429 with Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
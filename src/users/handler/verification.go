@@ -0,0 +1,191 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	netmail "net/mail"
+	"strings"
+	"time"
+
+	"auth"
+	"events"
+	"users/db"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/lib/pq"
+)
+
+// Подтверждение email. Ссылка содержит подписанный токен с ID пользователя и
+// адресом, поэтому хранить её не нужно. Ссылка подтверждает либо основной адрес
+// нового аккаунта, либо ожидающий адрес после смены email; если адрес с тех пор
+// поменялся, ссылка больше не действует.
+
+const (
+	emailVerificationTTL     = 24 * time.Hour
+	emailVerificationPurpose = "email_verification"
+	claimEmail               = "email"
+)
+
+// Данные для шаблонов писем о смене email
+type emailMail struct {
+	Name     string
+	Email    string
+	Link     string
+	ValidFor string
+}
+
+// normalizeEmail проверяет адрес, убирает пробелы и приводит к нижнему регистру:
+// адреса, отличающиеся только регистром, — один аккаунт. Имя получателя не допускается.
+func normalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	address, err := netmail.ParseAddress(email)
+	if err != nil {
+		return "", err
+	}
+	if address.Address != email {
+		return "", errors.New("email must be a bare address")
+	}
+	return email, nil
+}
+
+// sendEmailVerification отправляет ссылку подтверждения на адрес email
+func sendEmailVerification(user User, email string) {
+	token, err := signer.Sign(jwt.MapClaims{
+		auth.ClaimPurpose:   emailVerificationPurpose,
+		auth.ClaimUserID:    user.ID,
+		claimEmail:          email,
+		auth.ClaimExpiresAt: time.Now().Add(emailVerificationTTL).Unix(),
+	})
+	if err != nil {
+		log.Printf("Error signing verification link for user %d: %v", user.ID, err)
+		return
+	}
+	sendMail(email, "Подтверждение email", "email_verification", emailMail{
+		Name:     user.Name,
+		Email:    email,
+		Link:     publicURL() + "/users/email/verify?token=" + token,
+		ValidFor: "24 часа",
+	})
+}
+
+// sendEmailChangeNotice предупреждает старый адрес о запрошенной смене
+func sendEmailChangeNotice(user User, newEmail string) {
+	sendMail(user.Email, "Смена email", "email_change_notice", emailMail{
+		Name:  user.Name,
+		Email: newEmail,
+		Link:  publicURL() + "/users/password/forgot",
+	})
+}
+
+// Переход по ссылке из письма
+func verifyEmail(w http.ResponseWriter, r *http.Request) {
+	claims, err := verifier.ParsePurpose(r.URL.Query().Get("token"), emailVerificationPurpose)
+	if err != nil {
+		renderVerification(w, http.StatusBadRequest, "Ссылка недействительна или устарела.")
+		return
+	}
+	id, _ := claims[auth.ClaimUserID].(float64)
+	email, _ := claims[claimEmail].(string)
+
+	tx, err := db.GetDB().Begin()
+	if err != nil {
+		renderVerification(w, http.StatusInternalServerError, "Не удалось подтвердить email, попробуйте позже.")
+		return
+	}
+	defer tx.Rollback()
+
+	var (
+		user         User
+		pendingEmail sql.NullString
+	)
+	err = tx.QueryRow("SELECT id, name, email, email_verified_at IS NOT NULL, pending_email FROM users WHERE id = $1 FOR UPDATE", int(id)).
+		Scan(&user.ID, &user.Name, &user.Email, &user.EmailVerified, &pendingEmail)
+	if err == sql.ErrNoRows {
+		renderVerification(w, http.StatusBadRequest, "Ссылка недействительна или устарела.")
+		return
+	}
+	if err != nil {
+		renderVerification(w, http.StatusInternalServerError, "Не удалось подтвердить email, попробуйте позже.")
+		return
+	}
+
+	var eventType events.Type
+	switch {
+	case email == user.Email && user.EmailVerified:
+		renderVerification(w, http.StatusOK, "Email уже подтвержден.")
+		return
+	case email == user.Email:
+		eventType = events.UserEmailVerified
+		_, err = tx.Exec("UPDATE users SET email_verified_at = now() WHERE id = $1", user.ID)
+	case pendingEmail.Valid && email == pendingEmail.String:
+		eventType = events.UserEmailChanged
+		_, err = tx.Exec("UPDATE users SET email = pending_email, pending_email = NULL, email_verified_at = now() WHERE id = $1", user.ID)
+		user.Email = email
+	default:
+		renderVerification(w, http.StatusBadRequest, "Ссылка недействительна или устарела.")
+		return
+	}
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		renderVerification(w, http.StatusConflict, "Этот email уже используется другим аккаунтом.")
+		return
+	}
+	if err != nil {
+		renderVerification(w, http.StatusInternalServerError, "Не удалось подтвердить email, попробуйте позже.")
+		return
+	}
+
+	msg := events.UserPayload{
+		UserID: user.ID,
+		Name:   user.Name,
+		Email:  user.Email,
+		Status: events.UserStatusActive,
+	}
+	if err := enqueueEvent(tx, eventType, msg); err != nil {
+		renderVerification(w, http.StatusInternalServerError, "Не удалось подтвердить email, попробуйте позже.")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		renderVerification(w, http.StatusInternalServerError, "Не удалось подтвердить email, попробуйте позже.")
+		return
+	}
+
+	// Права из старого токена обновятся при следующем обновлении токена
+	renderVerification(w, http.StatusOK, "Email подтвержден. Войдите заново, чтобы изменения вступили в силу.")
+}
+
+// Повторная отправка ссылки текущему пользователю
+func resendEmailVerification(w http.ResponseWriter, r *http.Request) {
+	if !isPostRequest(w, r) {
+		return
+	}
+	p, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	profile, err := loadProfile(p.ID)
+	if err != nil {
+		http.Error(w, "Could not send verification email", profileErrorStatus(err))
+		return
+	}
+
+	switch {
+	case profile.PendingEmail != "":
+		sendEmailVerification(profile.User, profile.PendingEmail)
+	case !profile.EmailVerified:
+		sendEmailVerification(profile.User, profile.Email)
+	default:
+		http.Error(w, "Email is already verified", http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "Verification email sent"})
+}
+
+func renderVerification(w http.ResponseWriter, status int, message string) {
+	tmpl := template.Must(template.ParseFiles("templates/email_verified.html"))
+	w.WriteHeader(status)
+	tmpl.Execute(w, map[string]string{"Message": message})
+}
@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	tests := []struct {
+		name    string
+		email   string
+		want    string
+		wantErr bool
+	}{
+		{"lower case", "ann@example.com", "ann@example.com", false},
+		{"mixed case and spaces", "  Ann@Example.COM ", "ann@example.com", false},
+		{"display name", "Ann <ann@example.com>", "", true},
+		{"not an address", "ann", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeEmail(tt.email)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("normalizeEmail(%q) = %q, %v, want %q", tt.email, got, err, tt.want)
+			}
+		})
+	}
+}
+
+// Вход ищет пользователя по адресу без учета регистра
+func TestLoginIgnoresEmailCase(t *testing.T) {
+	useLoginAttempts(t)
+	mock := useSQLMock(t)
+	hash, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("FROM users WHERE lower(email)=$1")).WithArgs("ann@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "email", "pass", "role", "email_verified", "suspended", "locked_until"}).
+			AddRow(7, "Ann", "ann@example.com", hash, "user", true, false, nil))
+
+	rec := httptest.NewRecorder()
+	login(rec, loginRequest("Ann@Example.com", "wrong"))
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("code = %d, want %d: %s", rec.Code, http.StatusUnauthorized, rec.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
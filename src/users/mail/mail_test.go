@@ -0,0 +1,104 @@
+package mail
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	m := NewFileMailer(dir, "no-reply@example.com")
+	msg := Message{To: "ann@example.com", Subject: "Сброс пароля", Text: "Ссылка: http://x/1", HTML: "<a href=\"http://x/1\">Ссылка</a>"}
+	if err := m.Send(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := m.Sent()
+	if len(sent) != 1 || sent[0] != msg {
+		t.Fatalf("Sent = %+v, want [%+v]", sent, msg)
+	}
+	// Sent возвращает копию
+	sent[0].To = "changed"
+	if m.Sent()[0].To != msg.To {
+		t.Error("Sent exposes the internal slice")
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("eml files = %v, %v, want one", files, err)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	parsed, err := netmail.ReadMessage(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Header.Get("From") != "no-reply@example.com" || parsed.Header.Get("To") != msg.To {
+		t.Errorf("headers = %v", parsed.Header)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	if err != nil || subject != msg.Subject {
+		t.Errorf("Subject = %q, %v, want %q", subject, err, msg.Subject)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type = %q, %v", mediaType, err)
+	}
+	reader := multipart.NewReader(parsed.Body, params["boundary"])
+	var parts []string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(part)
+		parts = append(parts, part.Header.Get("Content-Type")+": "+string(body))
+	}
+	want := []string{"text/plain; charset=UTF-8: " + msg.Text, "text/html; charset=UTF-8: " + msg.HTML}
+	if strings.Join(parts, "\n") != strings.Join(want, "\n") {
+		t.Errorf("parts = %q, want %q", parts, want)
+	}
+}
+
+func TestFileMailerSkipsEmptyParts(t *testing.T) {
+	m := NewFileMailer(t.TempDir(), "no-reply@example.com")
+	if err := m.Send(Message{To: "ann@example.com", Subject: "s", Text: "only text"}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := encode("no-reply@example.com", m.Sent()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "text/html") {
+		t.Error("empty HTML part is encoded")
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("SMTP_ADDR", "")
+	t.Setenv("MAIL_DIR", dir)
+	if m, ok := FromEnv().(*FileMailer); !ok || m.dir != dir {
+		t.Errorf("FromEnv without SMTP_ADDR = %#v, want FileMailer in %s", m, dir)
+	}
+
+	t.Setenv("SMTP_ADDR", "smtp.example.com:587")
+	t.Setenv("SMTP_USER", "user")
+	m, ok := FromEnv().(*SMTPMailer)
+	if !ok || m.addr != "smtp.example.com:587" || m.auth == nil {
+		t.Errorf("FromEnv with SMTP_ADDR = %#v, want SMTPMailer with auth", m)
+	}
+}
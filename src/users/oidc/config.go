@@ -0,0 +1,65 @@
+// Package oidc вход через внешнего провайдера OpenID Connect по схеме
+// authorization code с PKCE (S256). Провайдеры описываются в JSON-файле
+// конфигурации; адреса эндпоинтов берутся из discovery-документа издателя.
+package oidc
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// ProviderConfig настройки одного провайдера
+type ProviderConfig struct {
+	// Имя провайдера в адресах /users/oidc/<name>/...
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	Issuer      string `json:"issuer"`
+	ClientID    string `json:"client_id"`
+	// Секрет клиента; можно не хранить в файле, а указать переменную окружения
+	ClientSecret    string   `json:"client_secret"`
+	ClientSecretEnv string   `json:"client_secret_env"`
+	Scopes          []string `json:"scopes"`
+}
+
+var providerNamePattern = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// LoadConfig читает список провайдеров из JSON-файла вида {"providers": [...]}
+func LoadConfig(path string) ([]ProviderConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Providers []ProviderConfig `json:"providers"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("oidc: parse %s: %w", path, err)
+	}
+
+	seen := map[string]bool{}
+	for i := range file.Providers {
+		cfg := &file.Providers[i]
+		if !providerNamePattern.MatchString(cfg.Name) {
+			return nil, fmt.Errorf("oidc: invalid provider name %q", cfg.Name)
+		}
+		if seen[cfg.Name] {
+			return nil, fmt.Errorf("oidc: duplicate provider %q", cfg.Name)
+		}
+		seen[cfg.Name] = true
+		if cfg.Issuer == "" || cfg.ClientID == "" {
+			return nil, fmt.Errorf("oidc: provider %q needs issuer and client_id", cfg.Name)
+		}
+		if cfg.ClientSecretEnv != "" {
+			cfg.ClientSecret = os.Getenv(cfg.ClientSecretEnv)
+		}
+		if cfg.DisplayName == "" {
+			cfg.DisplayName = cfg.Name
+		}
+		if len(cfg.Scopes) == 0 {
+			cfg.Scopes = []string{"openid", "email", "profile"}
+		}
+	}
+	return file.Providers, nil
+}
@@ -0,0 +1,329 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"auth"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	testClientID     = "shop"
+	testClientSecret = "secret"
+	testRedirectURI  = "http://shop.test/users/oidc/test/callback"
+)
+
+// fakeIdP локальный провайдер: выдает код на /authorize без участия
+// пользователя и меняет его на ID-токен, проверяя PKCE
+type fakeIdP struct {
+	server *httptest.Server
+	signer *auth.Signer
+
+	mu    sync.Mutex
+	codes map[string]authRequest
+	// Переопределения claims ID-токена для негативных сценариев
+	override jwt.MapClaims
+}
+
+type authRequest struct {
+	challenge string
+	nonce     string
+	redirect  string
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	t.Helper()
+	signer, err := auth.GenerateSigner("RS256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &fakeIdP{signer: signer, codes: map[string]authRequest{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", auth.JWKSHandler(signer))
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *fakeIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != testClientID || q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+	code, _ := RandomString()
+	idp.mu.Lock()
+	idp.codes[code] = authRequest{challenge: q.Get("code_challenge"), nonce: q.Get("nonce"), redirect: q.Get("redirect_uri")}
+	idp.mu.Unlock()
+
+	target, _ := url.Parse(q.Get("redirect_uri"))
+	back := target.Query()
+	back.Set("code", code)
+	back.Set("state", q.Get("state"))
+	target.RawQuery = back.Encode()
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+func (idp *fakeIdP) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok || id != testClientID || secret != testClientSecret {
+		writeTokenError(w, "invalid_client")
+		return
+	}
+	idp.mu.Lock()
+	req, found := idp.codes[r.PostFormValue("code")]
+	delete(idp.codes, r.PostFormValue("code"))
+	idp.mu.Unlock()
+	if !found || req.redirect != r.PostFormValue("redirect_uri") {
+		writeTokenError(w, "invalid_grant")
+		return
+	}
+	if CodeChallenge(r.PostFormValue("code_verifier")) != req.challenge {
+		writeTokenError(w, "invalid_grant")
+		return
+	}
+
+	claims := jwt.MapClaims{
+		"iss":            idp.server.URL,
+		"sub":            "user-42",
+		"aud":            testClientID,
+		"exp":            time.Now().Add(time.Minute).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          req.nonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"name":           "Alice",
+	}
+	for k, v := range idp.override {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+	}
+	idToken, err := idp.signer.Sign(claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "opaque", "token_type": "Bearer", "id_token": idToken})
+}
+
+func writeTokenError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+func (idp *fakeIdP) provider() *Provider {
+	return NewProvider(ProviderConfig{
+		Name:         "test",
+		Issuer:       idp.server.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		Scopes:       []string{"openid", "email"},
+	})
+}
+
+// login проходит шаг авторизации и возвращает код из редиректа
+func login(t *testing.T, p *Provider, state, nonce, codeVerifier string) string {
+	t.Helper()
+	authURL, err := p.AuthCodeURL(context.Background(), testRedirectURI, state, nonce, codeVerifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: status %d", resp.StatusCode)
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := location.Query().Get("state"); got != state {
+		t.Fatalf("state = %q, want %q", got, state)
+	}
+	return location.Query().Get("code")
+}
+
+func TestExchange(t *testing.T) {
+	idp := newFakeIdP(t)
+	p := idp.provider()
+	codeVerifier, _ := RandomString()
+
+	code := login(t, p, "state-1", "nonce-1", codeVerifier)
+	identity, err := p.Exchange(context.Background(), code, testRedirectURI, codeVerifier, "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Identity{Subject: "user-42", Email: "alice@example.com", EmailVerified: true, Name: "Alice"}
+	if identity != want {
+		t.Errorf("identity = %+v, want %+v", identity, want)
+	}
+
+	// Код одноразовый
+	if _, err := p.Exchange(context.Background(), code, testRedirectURI, codeVerifier, "nonce-1"); err == nil {
+		t.Error("code was accepted twice")
+	}
+}
+
+func TestExchangeRejectsWrongCodeVerifier(t *testing.T) {
+	idp := newFakeIdP(t)
+	p := idp.provider()
+	codeVerifier, _ := RandomString()
+	other, _ := RandomString()
+
+	code := login(t, p, "state", "nonce", codeVerifier)
+	_, err := p.Exchange(context.Background(), code, testRedirectURI, other, "nonce")
+	if err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Fatalf("err = %v, want invalid_grant", err)
+	}
+}
+
+func TestExchangeRejectsWrongClientSecret(t *testing.T) {
+	idp := newFakeIdP(t)
+	p := idp.provider()
+	p.Config.ClientSecret = "wrong"
+	codeVerifier, _ := RandomString()
+
+	code := login(t, p, "state", "nonce", codeVerifier)
+	_, err := p.Exchange(context.Background(), code, testRedirectURI, codeVerifier, "nonce")
+	if err == nil || !strings.Contains(err.Error(), "invalid_client") {
+		t.Fatalf("err = %v, want invalid_client", err)
+	}
+}
+
+func TestExchangeValidatesIDToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		override jwt.MapClaims
+		nonce    string
+	}{
+		{name: "nonce mismatch", nonce: "other"},
+		{name: "wrong audience", override: jwt.MapClaims{"aud": "someone-else"}},
+		{name: "wrong issuer", override: jwt.MapClaims{"iss": "https://evil.example"}},
+		{name: "expired", override: jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()}},
+		{name: "no expiry", override: jwt.MapClaims{"exp": nil}},
+		{name: "no subject", override: jwt.MapClaims{"sub": nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := newFakeIdP(t)
+			idp.override = tt.override
+			p := idp.provider()
+			codeVerifier, _ := RandomString()
+
+			code := login(t, p, "state", "nonce", codeVerifier)
+			nonce := "nonce"
+			if tt.nonce != "" {
+				nonce = tt.nonce
+			}
+			_, err := p.Exchange(context.Background(), code, testRedirectURI, codeVerifier, nonce)
+			if !errors.Is(err, ErrInvalidIDToken) {
+				t.Fatalf("err = %v, want ErrInvalidIDToken", err)
+			}
+		})
+	}
+}
+
+func TestExchangeAcceptsAudienceList(t *testing.T) {
+	idp := newFakeIdP(t)
+	idp.override = jwt.MapClaims{"aud": []string{"other", testClientID}}
+	p := idp.provider()
+	codeVerifier, _ := RandomString()
+
+	code := login(t, p, "state", "nonce", codeVerifier)
+	if _, err := p.Exchange(context.Background(), code, testRedirectURI, codeVerifier, "nonce"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExchangeRejectsForeignSignature(t *testing.T) {
+	idp := newFakeIdP(t)
+	p := idp.provider()
+	codeVerifier, _ := RandomString()
+	code := login(t, p, "state", "nonce", codeVerifier)
+
+	// Ключ, которого нет в JWKS провайдера
+	foreign, err := auth.GenerateSigner("RS256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.signer = foreign
+	_, err = p.Exchange(context.Background(), code, testRedirectURI, codeVerifier, "nonce")
+	if !errors.Is(err, ErrInvalidIDToken) {
+		t.Fatalf("err = %v, want ErrInvalidIDToken", err)
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	idp := newFakeIdP(t)
+	p := idp.provider()
+	p.Config.Issuer = idp.server.URL + "/"
+	if _, err := p.AuthCodeURL(context.Background(), testRedirectURI, "s", "n", "v"); err == nil {
+		t.Fatal("issuer mismatch was accepted")
+	}
+}
+
+func TestCodeChallenge(t *testing.T) {
+	// Пример из RFC 7636, приложение B
+	got := CodeChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	if want := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"; got != want {
+		t.Errorf("CodeChallenge = %q, want %q", got, want)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("TEST_OIDC_SECRET", "from-env")
+	path := filepath.Join(t.TempDir(), "providers.json")
+	data := `{"providers": [{"name": "corp", "issuer": "https://idp.example", "client_id": "shop", "client_secret_env": "TEST_OIDC_SECRET"}]}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	providers, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(providers) != 1 {
+		t.Fatalf("got %d providers", len(providers))
+	}
+	cfg := providers[0]
+	if cfg.ClientSecret != "from-env" || cfg.DisplayName != "corp" || len(cfg.Scopes) != 3 {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+
+	bad := `{"providers": [{"name": "Corp Login", "issuer": "https://idp.example", "client_id": "shop"}]}`
+	os.WriteFile(path, []byte(bad), 0o600)
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("invalid provider name was accepted")
+	}
+}
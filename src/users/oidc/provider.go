@@ -0,0 +1,230 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"auth"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	discoveryTTL   = time.Hour
+	requestTimeout = 10 * time.Second
+)
+
+var ErrInvalidIDToken = errors.New("oidc: invalid id token")
+
+// Identity пользователь, подтвержденный провайдером
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider клиент одного провайдера. Discovery-документ и ключи загружаются
+// при первом обращении и кэшируются.
+type Provider struct {
+	Config ProviderConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	meta      discovery
+	keyfunc   jwt.Keyfunc
+	fetchedAt time.Time
+}
+
+func NewProvider(cfg ProviderConfig) *Provider {
+	return &Provider{Config: cfg, client: &http.Client{Timeout: requestTimeout}}
+}
+
+// discover возвращает метаданные издателя, при необходимости загружая их заново
+func (p *Provider) discover(ctx context.Context) (discovery, jwt.Keyfunc, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.keyfunc != nil && time.Since(p.fetchedAt) < discoveryTTL {
+		return p.meta, p.keyfunc, nil
+	}
+
+	wellKnown := strings.TrimSuffix(p.Config.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wellKnown, nil)
+	if err != nil {
+		return discovery{}, nil, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return discovery{}, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return discovery{}, nil, fmt.Errorf("oidc: discovery returned %s", resp.Status)
+	}
+	var meta discovery
+	if err := json.NewDecoder(resp.Body).Decode(&meta); err != nil {
+		return discovery{}, nil, err
+	}
+	if meta.Issuer != p.Config.Issuer {
+		return discovery{}, nil, fmt.Errorf("oidc: discovery issuer %q does not match %q", meta.Issuer, p.Config.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return discovery{}, nil, errors.New("oidc: discovery document is incomplete")
+	}
+
+	if p.keyfunc == nil || meta.JWKSURI != p.meta.JWKSURI {
+		p.keyfunc = auth.RemoteKeyfunc(meta.JWKSURI)
+	}
+	p.meta = meta
+	p.fetchedAt = time.Now()
+	return meta, p.keyfunc, nil
+}
+
+// AuthCodeURL адрес, на который отправляется браузер пользователя
+func (p *Provider) AuthCodeURL(ctx context.Context, redirectURI string, state string, nonce string, codeVerifier string) (string, error) {
+	meta, _, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.Config.ClientID)
+	q.Set("redirect_uri", redirectURI)
+	q.Set("scope", strings.Join(p.Config.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", CodeChallenge(codeVerifier))
+	q.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return meta.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange меняет код на токены и проверяет ID-токен: подпись, издателя,
+// получателя, срок и nonce
+func (p *Provider) Exchange(ctx context.Context, code string, redirectURI string, codeVerifier string, nonce string) (Identity, error) {
+	meta, keyfunc, err := p.discover(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURI)
+	form.Set("client_id", p.Config.ClientID)
+	form.Set("code_verifier", codeVerifier)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Identity{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.Config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.Config.ClientID), url.QueryEscape(p.Config.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return Identity{}, err
+	}
+	defer resp.Body.Close()
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return Identity{}, fmt.Errorf("oidc: token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Identity{}, fmt.Errorf("oidc: token endpoint returned %s: %s %s", resp.Status, tokens.Error, tokens.ErrorDescription)
+	}
+	if tokens.IDToken == "" {
+		return Identity{}, errors.New("oidc: token response has no id_token")
+	}
+	return p.verifyIDToken(tokens.IDToken, keyfunc, nonce)
+}
+
+func (p *Provider) verifyIDToken(idToken string, keyfunc jwt.Keyfunc, nonce string) (Identity, error) {
+	token, err := jwt.Parse(idToken, keyfunc)
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return Identity{}, ErrInvalidIDToken
+	}
+	// jwt-go проверяет exp, только если он есть; в ID-токене он обязателен
+	if _, ok := claims["exp"]; !ok {
+		return Identity{}, fmt.Errorf("%w: no exp", ErrInvalidIDToken)
+	}
+	if iss, _ := claims["iss"].(string); iss != p.Config.Issuer {
+		return Identity{}, fmt.Errorf("%w: issuer %q", ErrInvalidIDToken, iss)
+	}
+	if !hasAudience(claims["aud"], p.Config.ClientID) {
+		return Identity{}, fmt.Errorf("%w: audience mismatch", ErrInvalidIDToken)
+	}
+	if n, _ := claims["nonce"].(string); n == "" || n != nonce {
+		return Identity{}, fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	}
+
+	identity := Identity{}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.EmailVerified, _ = claims["email_verified"].(bool)
+	identity.Name, _ = claims["name"].(string)
+	if identity.Subject == "" {
+		return Identity{}, fmt.Errorf("%w: no subject", ErrInvalidIDToken)
+	}
+	return identity, nil
+}
+
+func hasAudience(aud interface{}, clientID string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == clientID
+	case []interface{}:
+		for _, a := range v {
+			if s, _ := a.(string); s == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RandomString случайная строка для state, nonce и code_verifier
+func RandomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CodeChallenge S256-преобразование code_verifier (RFC 7636)
+func CodeChallenge(codeVerifier string) string {
+	sum := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,141 @@
+// Package ratelimit счетчики неудачных попыток по ключу (IP-адрес, аккаунт).
+// Счетчик живет заданное окно с момента последней неудачи, затем сбрасывается сам.
+// С REDIS_URL счетчики общие для всех экземпляров сервиса, иначе хранятся в памяти процесса.
+package ratelimit
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Attempts неудачные попытки по ключу
+type Attempts struct {
+	Count int
+	Last  time.Time // время последней неудачи
+}
+
+// Store хранилище счетчиков
+type Store interface {
+	// Get возвращает текущие попытки; для неизвестного ключа — нулевое значение
+	Get(ctx context.Context, key string) (Attempts, error)
+	// Fail учитывает неудачу и продлевает жизнь счетчика на window
+	Fail(ctx context.Context, key string, window time.Duration) (Attempts, error)
+	// Reset удаляет счетчик
+	Reset(ctx context.Context, key string) error
+}
+
+// FromEnv возвращает Redis-хранилище, если задан REDIS_URL, иначе хранилище в памяти
+func FromEnv() Store {
+	addr := os.Getenv("REDIS_URL")
+	if addr == "" {
+		log.Println("ratelimit: REDIS_URL is not set, attempt counters are kept in memory")
+		return NewMemoryStore()
+	}
+	return NewRedisStore(redis.NewClient(&redis.Options{Addr: addr}))
+}
+
+const redisPrefix = "attempts:"
+
+// Счетчики в Redis: хэш с полями count и last (unix-время в наносекундах)
+type redisStore struct {
+	client *redis.Client
+}
+
+func NewRedisStore(client *redis.Client) Store {
+	return &redisStore{client: client}
+}
+
+func (s *redisStore) Get(ctx context.Context, key string) (Attempts, error) {
+	fields, err := s.client.HGetAll(ctx, redisPrefix+key).Result()
+	if err != nil {
+		return Attempts{}, err
+	}
+	return parseAttempts(fields), nil
+}
+
+func (s *redisStore) Fail(ctx context.Context, key string, window time.Duration) (Attempts, error) {
+	now := time.Now()
+	var count *redis.IntCmd
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		count = pipe.HIncrBy(ctx, redisPrefix+key, "count", 1)
+		pipe.HSet(ctx, redisPrefix+key, "last", now.UnixNano())
+		pipe.PExpire(ctx, redisPrefix+key, window)
+		return nil
+	})
+	if err != nil {
+		return Attempts{}, err
+	}
+	return Attempts{Count: int(count.Val()), Last: now}, nil
+}
+
+func (s *redisStore) Reset(ctx context.Context, key string) error {
+	return s.client.Del(ctx, redisPrefix+key).Err()
+}
+
+func parseAttempts(fields map[string]string) Attempts {
+	count, _ := strconv.Atoi(fields["count"])
+	last, _ := strconv.ParseInt(fields["last"], 10, 64)
+	if count == 0 {
+		return Attempts{}
+	}
+	return Attempts{Count: count, Last: time.Unix(0, last)}
+}
+
+// Счетчики в памяти процесса: для тестов и локального запуска
+type memoryStore struct {
+	mu       sync.Mutex
+	attempts map[string]memoryEntry
+}
+
+type memoryEntry struct {
+	Attempts
+	expires time.Time
+}
+
+func NewMemoryStore() Store {
+	return &memoryStore{attempts: make(map[string]memoryEntry)}
+}
+
+func (s *memoryStore) Get(ctx context.Context, key string) (Attempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(key), nil
+}
+
+func (s *memoryStore) Fail(ctx context.Context, key string, window time.Duration) (Attempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	entry := memoryEntry{Attempts: s.get(key)}
+	entry.Count++
+	entry.Last = now
+	entry.expires = now.Add(window)
+	s.attempts[key] = entry
+	return entry.Attempts, nil
+}
+
+func (s *memoryStore) Reset(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attempts, key)
+	return nil
+}
+
+// get вызывается под блокировкой; просроченный счетчик удаляется
+func (s *memoryStore) get(key string) Attempts {
+	entry, ok := s.attempts[key]
+	if !ok {
+		return Attempts{}
+	}
+	if time.Now().After(entry.expires) {
+		delete(s.attempts, key)
+		return Attempts{}
+	}
+	return entry.Attempts
+}
@@ -0,0 +1,91 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name   string
+		fails  int
+		window time.Duration
+		reset  bool
+		want   int
+	}{
+		{"unknown key", 0, time.Minute, false, 0},
+		{"counts failures", 3, time.Minute, false, 3},
+		{"reset", 3, time.Minute, true, 0},
+		{"expired window", 2, time.Millisecond, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryStore()
+			var last Attempts
+			for i := 0; i < tt.fails; i++ {
+				var err error
+				if last, err = store.Fail(ctx, "key", tt.window); err != nil {
+					t.Fatal(err)
+				}
+				if last.Count != i+1 {
+					t.Fatalf("Fail #%d count = %d", i+1, last.Count)
+				}
+			}
+			if tt.reset {
+				if err := store.Reset(ctx, "key"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.window < time.Second {
+				time.Sleep(5 * tt.window)
+			}
+			got, err := store.Get(ctx, "key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Count != tt.want {
+				t.Errorf("Get count = %d, want %d", got.Count, tt.want)
+			}
+			if tt.want > 0 && !got.Last.Equal(last.Last) {
+				t.Errorf("Get last = %v, want %v", got.Last, last.Last)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreKeysAreIndependent(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	store.Fail(ctx, "login:ip:10.0.0.1", time.Minute)
+	store.Fail(ctx, "login:ip:10.0.0.1", time.Minute)
+	store.Fail(ctx, "login:account:a@example.com", time.Minute)
+
+	if got, _ := store.Get(ctx, "login:ip:10.0.0.1"); got.Count != 2 {
+		t.Errorf("ip count = %d, want 2", got.Count)
+	}
+	if got, _ := store.Get(ctx, "login:account:a@example.com"); got.Count != 1 {
+		t.Errorf("account count = %d, want 1", got.Count)
+	}
+}
+
+func TestParseAttempts(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields map[string]string
+		want   Attempts
+	}{
+		{"missing key", map[string]string{}, Attempts{}},
+		{"counter", map[string]string{"count": "4", "last": "1700000000000000000"}, Attempts{Count: 4, Last: time.Unix(0, 1700000000000000000)}},
+		{"zero count", map[string]string{"count": "0", "last": "1700000000000000000"}, Attempts{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseAttempts(tt.fields)
+			if got.Count != tt.want.Count || !got.Last.Equal(tt.want.Last) {
+				t.Errorf("parseAttempts = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}